@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	MAX_AUDIT_BODY = 64 * 1024
+)
+
+type AuditEntry struct {
+	Time       time.Time              `json:"time"`
+	User       string                 `json:"user"`
+	ApiKey     string                 `json:"apiKey,omitempty"`
+	RemoteAddr string                 `json:"remoteAddr"`
+	Printer    string                 `json:"printer,omitempty"`
+	Action     string                 `json:"action"`
+	Params     map[string]interface{} `json:"params,omitempty"`
+	Status     int                    `json:"status,omitempty"`
+}
+
+var auditMutex sync.Mutex
+
+// Body fields never written to the audit log, at any depth. Matches
+// field names containing these, e.g. "apiKey" or "mqttPassword".
+var auditRedacted = []string{ "password", "key", "secret", "token" }
+
+func auditFile() string {
+	return dataFile("dashprint-audit.jsonl")
+}
+
+// Append an entry to the audit log
+func recordAudit(entry AuditEntry) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	js, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("Cannot encode audit entry: ", err)
+		return
+	}
+
+	f, err := os.OpenFile(auditFile(), os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println("Cannot open audit log: ", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(js, '\n')); err != nil {
+		log.Println("Cannot write audit log: ", err)
+	}
+}
+
+func newAuditEntry(r *http.Request, action string, printer string) AuditEntry {
+	entry := AuditEntry{
+		Time: time.Now(),
+		RemoteAddr: remoteAddr(r),
+		Printer: printer,
+		Action: action,
+		Params: make(map[string]interface{}),
+	}
+
+	if u := currentUser(r); u != nil {
+		entry.User = u.Username
+		entry.ApiKey = u.apiKey
+	}
+	return entry
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	// User authenticated by requireRole or by the handler itself, i.e. on login
+	user   string
+	apiKey string
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// For http.ResponseController
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Record the user a handler authenticated in the audit entry
+func setAuditUser(w http.ResponseWriter, username string) {
+	if rec, ok := w.(*statusRecorder); ok {
+		rec.user = username
+	}
+}
+
+// Record the user of an authenticated request in the audit entry, the
+// audit wraps authentication so that denied requests are recorded as well
+func setAuditAuth(w http.ResponseWriter, u *User) {
+	if rec, ok := w.(*statusRecorder); ok {
+		rec.user = u.Username
+		rec.apiKey = u.apiKey
+	}
+}
+
+func isAuditRedacted(field string) bool {
+	field = strings.ToLower(field)
+	for _, r := range auditRedacted {
+		if strings.Contains(field, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove redacted fields from decoded JSON
+func redactAudit(v interface{}) {
+	switch v := v.(type) {
+		case map[string]interface{}:
+			for k, child := range v {
+				if isAuditRedacted(k) {
+					delete(v, k)
+				} else {
+					redactAudit(child)
+				}
+			}
+		case []interface{}:
+			for _, child := range v {
+				redactAudit(child)
+			}
+	}
+}
+
+// Whether the body is JSON, which is logged. A missing Content-Type is taken as JSON.
+func isJsonBody(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
+
+// Wrap a mutating handler so that each call is recorded in the audit log
+// with route variables and (redacted) JSON body as parameters
+func audited(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		entry := newAuditEntry(r, action, vars["printerId"])
+
+		for k, v := range vars {
+			if k != "printerId" {
+				entry.Params[k] = v
+			}
+		}
+		for k, v := range r.URL.Query() {
+			if k != "apikey" {
+				entry.Params[k] = v[0]
+			}
+		}
+
+		if isJsonBody(r) {
+			if r.ContentLength > 0 && r.ContentLength <= MAX_AUDIT_BODY {
+				body, err := ioutil.ReadAll(r.Body)
+				if err == nil {
+					var params map[string]interface{}
+					if json.Unmarshal(body, &params) == nil {
+						redactAudit(params)
+						entry.Params["body"] = params
+					}
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+		} else {
+			entry.Params["contentLength"] = r.ContentLength
+		}
+
+		rec := &statusRecorder{ ResponseWriter: w, status: http.StatusOK }
+		handler(rec, r)
+
+		entry.Status = rec.status
+		if entry.User == "" {
+			entry.User = rec.user
+			entry.ApiKey = rec.apiKey
+		}
+		recordAudit(entry)
+	}
+}
+
+// Read audit entries matching filters, newest last
+func queryAudit(username, printer, action string, since, until time.Time, limit int) ([]AuditEntry, error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	entries := make([]AuditEntry, 0)
+
+	f, err := os.Open(auditFile())
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64 * 1024), 4 * MAX_AUDIT_BODY)
+
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+
+		if (username != "" && entry.User != username) ||
+			(printer != "" && entry.Printer != printer) ||
+			(action != "" && entry.Action != action) ||
+			(!since.IsZero() && entry.Time.Before(since)) ||
+			(!until.IsZero() && entry.Time.After(until)) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+
+	return entries, scanner.Err()
+}
+
+// GET /audit?user=&printer=&action=&since=&until=&limit=&format=jsonl
+func handleGetAudit(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	query := r.URL.Query()
+	var since, until time.Time
+	var err error
+
+	if s := query.Get("since"); s != "" {
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "Invalid since: " + err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("until"); s != "" {
+		if until, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "Invalid until: " + err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := 0
+	if s := query.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := queryAudit(query.Get("user"), query.Get("printer"), query.Get("action"), since, until, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if query.Get("format") == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"dashprint-audit.jsonl\"")
+
+		encoder := json.NewEncoder(w)
+		for _, entry := range entries {
+			encoder.Encode(entry)
+		}
+		return
+	}
+
+	js, err := json.Marshal(entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRedactAudit(t *testing.T) {
+	var body map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"username": "alice",
+		"password": "hunter2",
+		"mqtt": { "broker": "tcp://localhost:1883", "password": "p", "clientKey": "k" },
+		"webhooks": [ { "name": "chat", "secret": "s" } ],
+		"apiKey": "abc",
+		"token": "t"
+	}`), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redactAudit(body)
+
+	want := map[string]interface{}{
+		"username": "alice",
+		"mqtt": map[string]interface{}{ "broker": "tcp://localhost:1883" },
+		"webhooks": []interface{}{ map[string]interface{}{ "name": "chat" } },
+	}
+	if !reflect.DeepEqual(body, want) {
+		t.Errorf("Redacted body %v, want %v", body, want)
+	}
+}
+
+func TestIsJsonBody(t *testing.T) {
+	tests := []struct {
+		contentType string
+		json        bool
+	}{
+		{ "", true },
+		{ "application/json", true },
+		{ "application/json; charset=utf-8", true },
+		{ "Application/JSON", true },
+		{ "multipart/form-data; boundary=xyz", false },
+		{ "text/plain", false },
+		{ "application/json;;", false },
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+
+		if got := isJsonBody(r); got != test.json {
+			t.Errorf("isJsonBody(%q) = %v, want %v", test.contentType, got, test.json)
+		}
+	}
+}
+
+// Replace the configured users for a test
+func withUsers(t *testing.T, list []User) {
+	usersMutex.Lock()
+	old := users
+	users = list
+	usersMutex.Unlock()
+
+	t.Cleanup(func() {
+		usersMutex.Lock()
+		users = old
+		usersMutex.Unlock()
+	})
+}
+
+func TestAuditDenied(t *testing.T) {
+	withDataDir(t)
+	withUsers(t, []User{
+		{ Username: "vera", Role: "viewer", ApiKeys: []ApiKey{ { Name: "dashboard", Hash: hashApiKey("vera-key") } } },
+		{ Username: "otto", Role: "operator", ApiKeys: []ApiKey{ { Name: "slicer", Hash: hashApiKey("otto-key") } } },
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/printers/{printerId}/job", audited("job.start", requireRole(ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))).Methods("POST")
+
+	for _, key := range []string{ "", "vera-key", "otto-key" } {
+		r := httptest.NewRequest("POST", "/printers/mk3/job", strings.NewReader("{}"))
+		if key != "" {
+			r.Header.Set("X-Api-Key", key)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	entries, err := queryAudit("", "", "job.start", time.Time{}, time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		user, apiKey string
+		status       int
+	}{
+		{ "", "", http.StatusUnauthorized },
+		{ "vera", "dashboard", http.StatusForbidden },
+		{ "otto", "slicer", http.StatusCreated },
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d audit entries, got %+v", len(expected), entries)
+	}
+	for i, e := range expected {
+		entry := entries[i]
+		if entry.User != e.user || entry.ApiKey != e.apiKey || entry.Status != e.status || entry.Printer != "mk3" {
+			t.Errorf("expected %s with key %q and status %d, got %+v", e.user, e.apiKey, e.status, entry)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	ROLE_NONE     = iota
+	ROLE_VIEWER   = iota
+	ROLE_OPERATOR = iota
+	ROLE_ADMIN    = iota
+)
+
+const (
+	SESSION_COOKIE = "dashprint_session"
+	SESSION_LIFETIME = 24 * time.Hour
+)
+
+type ApiKey struct {
+	Name    string    `json:"name"`
+	// SHA-256 of the key, the key itself is only shown when created
+	Hash    string `json:"hash"`
+	Created string `json:"created"`
+}
+
+type User struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"passwordHash"`
+	// viewer, operator or admin
+	Role         string   `json:"role"`
+	// Printers the user may access, all printers if empty
+	Printers     []string `json:"printers"`
+	ApiKeys      []ApiKey `json:"apiKeys"`
+	// Department charged for the user's prints
+	Department   string   `json:"department"`
+
+	// Name of the API key used to authenticate the request, if any
+	apiKey       string
+}
+
+type session struct {
+	username string
+	expires  time.Time
+}
+
+type contextKey int
+
+const userContextKey contextKey = 0
+
+var users []User
+var usersMutex sync.RWMutex
+
+var sessions map[string]session = make(map[string]session)
+var sessionsMutex sync.Mutex
+
+func roleFromString(role string) int {
+	switch role {
+		case "viewer":
+			return ROLE_VIEWER
+		case "operator":
+			return ROLE_OPERATOR
+		case "admin":
+			return ROLE_ADMIN
+		default:
+			return ROLE_NONE
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal("Cannot generate random token: ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create an initial administrator if there are no users, so that
+// a fresh installation is not left open
+func ensureAdminUser() bool {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	if len(users) > 0 {
+		return false
+	}
+
+	password := randomToken()[:16]
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatal("Cannot hash password: ", err)
+	}
+
+	users = append(users, User{ Username: "admin", PasswordHash: string(hash), Role: "admin" })
+
+	// Only to the terminal, log files may be kept around or shipped elsewhere
+	fmt.Fprintf(os.Stderr, "Created user 'admin' with password '%s'\n", password)
+	log.Println("Created user 'admin', the password was printed to standard error")
+	return true
+}
+
+// Deep copy of all users. Must be called with usersMutex held.
+func copyUsers() []User {
+	rv := make([]User, len(users))
+	for i, u := range users {
+		rv[i] = u
+		rv[i].Printers = append([]string{}, u.Printers...)
+		rv[i].ApiKeys = append([]ApiKey{}, u.ApiKeys...)
+	}
+	return rv
+}
+
+// Must be called with usersMutex held
+func findUser(username string) *User {
+	for i := range users {
+		if users[i].Username == username {
+			return &users[i]
+		}
+	}
+	return nil
+}
+
+func (u *User) role() int {
+	return roleFromString(u.Role)
+}
+
+func (u *User) canAccessPrinter(printer string) bool {
+	if len(u.Printers) == 0 || u.role() == ROLE_ADMIN {
+		return true
+	}
+	for _, p := range u.Printers {
+		if p == printer {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) setPassword(password string) error {
+	if password == "" {
+		return errors.New("Empty password")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+// Check username and password, returns a copy of the user
+func checkPassword(username, password string) *User {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	u := findUser(username)
+	if u == nil || bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return nil
+	}
+
+	rv := *u
+	return &rv
+}
+
+// Find the owner of an API key, returns a copy of the user
+func checkApiKey(key string) *User {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	hash := []byte(hashApiKey(key))
+
+	for _, u := range users {
+		for _, k := range u.ApiKeys {
+			if subtle.ConstantTimeCompare(hash, []byte(k.Hash)) == 1 {
+				rv := u
+				rv.apiKey = k.Name
+				return &rv
+			}
+		}
+	}
+	return nil
+}
+
+func createSession(username string) string {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	token := randomToken()
+	sessions[token] = session{ username: username, expires: time.Now().Add(SESSION_LIFETIME) }
+	return token
+}
+
+func destroySession(token string) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	delete(sessions, token)
+}
+
+// Drop sessions of a deleted user
+func destroyUserSessions(username string) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	for token, s := range sessions {
+		if s.username == username {
+			delete(sessions, token)
+		}
+	}
+}
+
+func checkSession(token string) *User {
+	sessionsMutex.Lock()
+	s, ok := sessions[token]
+	if ok && time.Now().After(s.expires) {
+		delete(sessions, token)
+		ok = false
+	}
+	sessionsMutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	u := findUser(s.username)
+	if u == nil {
+		return nil
+	}
+
+	rv := *u
+	return &rv
+}
+
+// Identify the user by API key (X-Api-Key header, bearer token or apikey
+// query parameter) or by session cookie
+func authenticate(r *http.Request) *User {
+	key := r.Header.Get("X-Api-Key")
+	if key == "" && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if key == "" {
+		key = r.URL.Query().Get("apikey")
+	}
+	if key != "" {
+		return checkApiKey(key)
+	}
+
+	if cookie, err := r.Cookie(SESSION_COOKIE); err == nil {
+		return checkSession(cookie.Value)
+	}
+	return nil
+}
+
+func currentUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userContextKey).(*User)
+	return u
+}
+
+// Wrap a handler so that it can only be called by users with at least the given role.
+// If the route has a {printerId}, the user must also be assigned to that printer.
+func requireRole(role int, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := authenticate(r)
+		if u == nil {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		setAuditAuth(w, u)
+
+		if u.role() < role {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+
+		if printerId, ok := mux.Vars(r)["printerId"]; ok && !u.canAccessPrinter(printerId) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), userContextKey, u)))
+	}
+}
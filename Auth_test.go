@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRoleOrdering(t *testing.T) {
+	withUsers(t, []User{
+		{ Username: "vera", Role: "viewer", ApiKeys: []ApiKey{ { Name: "v", Hash: hashApiKey("viewer-key") } } },
+		{ Username: "otto", Role: "operator", ApiKeys: []ApiKey{ { Name: "o", Hash: hashApiKey("operator-key") } } },
+		{ Username: "ada", Role: "admin", ApiKeys: []ApiKey{ { Name: "a", Hash: hashApiKey("admin-key") } } },
+		{ Username: "nobody", Role: "superuser", ApiKeys: []ApiKey{ { Name: "n", Hash: hashApiKey("unknown-role-key") } } },
+	})
+
+	tests := []struct {
+		key    string
+		role   int
+		status int
+	}{
+		{ "", ROLE_VIEWER, http.StatusUnauthorized },
+		{ "wrong-key", ROLE_VIEWER, http.StatusUnauthorized },
+		{ "unknown-role-key", ROLE_VIEWER, http.StatusForbidden },
+		{ "viewer-key", ROLE_VIEWER, http.StatusOK },
+		{ "viewer-key", ROLE_OPERATOR, http.StatusForbidden },
+		{ "viewer-key", ROLE_ADMIN, http.StatusForbidden },
+		{ "operator-key", ROLE_VIEWER, http.StatusOK },
+		{ "operator-key", ROLE_OPERATOR, http.StatusOK },
+		{ "operator-key", ROLE_ADMIN, http.StatusForbidden },
+		{ "admin-key", ROLE_VIEWER, http.StatusOK },
+		{ "admin-key", ROLE_OPERATOR, http.StatusOK },
+		{ "admin-key", ROLE_ADMIN, http.StatusOK },
+	}
+
+	for _, test := range tests {
+		handler := requireRole(test.role, func(w http.ResponseWriter, r *http.Request) {
+			if currentUser(r) == nil {
+				t.Errorf("%s: no user passed to the handler", test.key)
+			}
+		})
+
+		r := httptest.NewRequest("GET", "/printers", nil)
+		if test.key != "" {
+			r.Header.Set("X-Api-Key", test.key)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%q for role %d: expected status %d, got %d", test.key, test.role, test.status, w.Code)
+		}
+	}
+}
+
+func TestCanAccessPrinter(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    User
+		printer string
+		allowed bool
+	}{
+		{ "unrestricted", User{ Role: "operator" }, "mk3", true },
+		{ "assigned", User{ Role: "operator", Printers: []string{ "mk3", "ender" } }, "ender", true },
+		{ "not assigned", User{ Role: "operator", Printers: []string{ "mk3" } }, "ender", false },
+		{ "viewer not assigned", User{ Role: "viewer", Printers: []string{ "mk3" } }, "ender", false },
+		{ "admin not assigned", User{ Role: "admin", Printers: []string{ "mk3" } }, "ender", true },
+		{ "prefix of an assigned printer", User{ Role: "operator", Printers: []string{ "mk3s" } }, "mk3", false },
+	}
+
+	for _, test := range tests {
+		if allowed := test.user.canAccessPrinter(test.printer); allowed != test.allowed {
+			t.Errorf("%s: expected %v, got %v", test.name, test.allowed, allowed)
+		}
+	}
+
+	// Enforced by requireRole for routes with a printer
+	withUsers(t, []User{
+		{ Username: "otto", Role: "operator", Printers: []string{ "mk3" }, ApiKeys: []ApiKey{ { Name: "o", Hash: hashApiKey("operator-key") } } },
+	})
+	handler := requireRole(ROLE_VIEWER, func(w http.ResponseWriter, r *http.Request) {})
+
+	for printer, status := range map[string]int{ "mk3": http.StatusOK, "ender": http.StatusForbidden } {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/printers/" + printer, nil), map[string]string{ "printerId": printer })
+		r.Header.Set("X-Api-Key", "operator-key")
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != status {
+			t.Errorf("%s: expected status %d, got %d", printer, status, w.Code)
+		}
+	}
+}
+
+func TestCheckApiKey(t *testing.T) {
+	withUsers(t, []User{
+		{ Username: "vera", Role: "viewer", ApiKeys: []ApiKey{ { Name: "dashboard", Hash: hashApiKey("vera-1") } } },
+		{ Username: "otto", Role: "operator", ApiKeys: []ApiKey{
+			{ Name: "slicer", Hash: hashApiKey("otto-1") },
+			{ Name: "phone", Hash: hashApiKey("otto-2") },
+		} },
+		{ Username: "ada", Role: "admin" },
+	})
+
+	tests := []struct {
+		key    string
+		user   string
+		apiKey string
+	}{
+		{ "vera-1", "vera", "dashboard" },
+		{ "otto-1", "otto", "slicer" },
+		{ "otto-2", "otto", "phone" },
+		{ "otto-3", "", "" },
+		{ "", "", "" },
+		// The stored hash is not a key
+		{ hashApiKey("vera-1"), "", "" },
+	}
+
+	for _, test := range tests {
+		u := checkApiKey(test.key)
+		if test.user == "" {
+			if u != nil {
+				t.Errorf("%q: expected no user, got %s", test.key, u.Username)
+			}
+			continue
+		}
+
+		if u == nil || u.Username != test.user || u.apiKey != test.apiKey {
+			t.Errorf("%q: expected %s with key %s, got %+v", test.key, test.user, test.apiKey, u)
+		}
+	}
+
+	// Callers get a copy
+	u := checkApiKey("otto-1")
+	u.Role = "admin"
+	if again := checkApiKey("otto-1"); again.Role != "operator" {
+		t.Errorf("the user changed through a copy, role %s", again.Role)
+	}
+}
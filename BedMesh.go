@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MAX_BED_MESHES = 30
+)
+
+type BedMeshStats struct {
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	// Max - Min
+	Range  float64 `json:"range"`
+	StdDev float64 `json:"stdDev"`
+}
+
+type BedMesh struct {
+	Time    string       `json:"time"`
+	Command string       `json:"command"`
+	// Z offsets by row (front to back) and column (left to right),
+	// null for points that were not probed
+	Points  [][]*float64 `json:"points"`
+	Stats   BedMeshStats `json:"stats"`
+}
+
+var meshIndexRegexp = regexp.MustCompile(`^\d+$`)
+var meshValueRegexp = regexp.MustCompile(`^[+-]?\d*\.\d+$`)
+
+// Firmware is Klipper or a Klipper-like host
+func (p *Printer) isKlipper() bool {
+	return strings.Contains(strings.ToLower(p.firmwareName()), "klipper")
+}
+
+// Parse a mesh from firmware output. Understands Marlin bilinear/MBL grids
+// (M420 V), UBL topography (G29 T) and Klipper probed matrices (BED_MESH_OUTPUT).
+// Only the first grid is used, firmware may follow it with an interpolated one.
+func parseBedMesh(lines []string) ([][]*float64, error) {
+	type row struct {
+		index  int
+		values []*float64
+	}
+	rows := make([]row, 0)
+	indexed := true
+
+	for _, line := range lines {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "//")
+		line = strings.TrimPrefix(strings.TrimSpace(line), "echo:")
+		// UBL separates the row index with | and marks the nozzle position with []
+		line = strings.NewReplacer("|", " ", "[", " ", "]", " ").Replace(line)
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(line, "busy:") {
+			continue
+		}
+
+		index := -1
+		if meshIndexRegexp.MatchString(fields[0]) {
+			index, _ = strconv.Atoi(fields[0])
+			fields = fields[1:]
+		}
+
+		values := make([]*float64, 0, len(fields))
+		hasValue := false
+		valid := true
+
+		for _, f := range fields {
+			if meshValueRegexp.MatchString(f) {
+				v, _ := strconv.ParseFloat(f, 64)
+				values = append(values, &v)
+				hasValue = true
+			} else if f == "." || strings.Trim(f, "=") == "" {
+				// Point not probed
+				values = append(values, nil)
+			} else {
+				valid = false
+				break
+			}
+		}
+
+		if !valid || !hasValue || len(values) < 2 {
+			if len(rows) > 0 {
+				break
+			}
+			continue
+		}
+		if index == -1 {
+			indexed = false
+		}
+
+		rows = append(rows, row{ index: index, values: values })
+	}
+
+	if len(rows) == 0 {
+		return nil, errors.New("No mesh found in firmware output")
+	}
+
+	points := make([][]*float64, len(rows))
+	for i, r := range rows {
+		if len(r.values) != len(rows[0].values) {
+			return nil, errors.New("Mesh rows differ in length")
+		}
+
+		if indexed {
+			if r.index >= len(rows) {
+				return nil, errors.New("Mesh row index out of range")
+			}
+			points[r.index] = r.values
+		} else {
+			points[i] = r.values
+		}
+	}
+
+	for _, r := range points {
+		if r == nil {
+			return nil, errors.New("Mesh rows are incomplete")
+		}
+	}
+
+	return points, nil
+}
+
+func computeMeshStats(points [][]*float64) BedMeshStats {
+	var stats BedMeshStats
+	values := make([]float64, 0)
+
+	for _, r := range points {
+		for _, v := range r {
+			if v != nil {
+				values = append(values, *v)
+			}
+		}
+	}
+
+	if len(values) == 0 {
+		return stats
+	}
+
+	stats.Min = math.Inf(1)
+	stats.Max = math.Inf(-1)
+	sum := 0.0
+
+	for _, v := range values {
+		stats.Min = math.Min(stats.Min, v)
+		stats.Max = math.Max(stats.Max, v)
+		sum += v
+	}
+
+	stats.Mean = sum / float64(len(values))
+	stats.Range = stats.Max - stats.Min
+
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - stats.Mean) * (v - stats.Mean)
+	}
+	stats.StdDev = math.Sqrt(variance / float64(len(values)))
+
+	return stats
+}
+
+// Point by point difference b - a of two meshes of the same size
+func diffBedMeshes(a, b *BedMesh) (*BedMesh, error) {
+	if len(a.Points) != len(b.Points) || len(a.Points) == 0 || len(a.Points[0]) != len(b.Points[0]) {
+		return nil, errors.New("Meshes differ in size")
+	}
+
+	diff := &BedMesh{ Time: b.Time, Command: "diff", Points: make([][]*float64, len(a.Points)) }
+
+	for y := range a.Points {
+		diff.Points[y] = make([]*float64, len(a.Points[y]))
+		for x := range a.Points[y] {
+			if a.Points[y][x] != nil && b.Points[y][x] != nil {
+				d := *b.Points[y][x] - *a.Points[y][x]
+				diff.Points[y][x] = &d
+			}
+		}
+	}
+
+	diff.Stats = computeMeshStats(diff.Points)
+	return diff, nil
+}
+
+// Optionally probe the bed, then read and store the mesh.
+// The firmware specific report command is used unless command is set.
+func (p *Printer) CaptureBedMesh(probe bool, command string) (*BedMesh, error) {
+	commands := make([]string, 0)
+
+	if probe {
+		// Homing and probing would crash into the print
+		if err := p.checkNotPrinting("probe the bed"); err != nil {
+			return nil, err
+		}
+
+		if p.isKlipper() {
+			commands = append(commands, "G28", "BED_MESH_CALIBRATE")
+		} else {
+			commands = append(commands, "G28", "G29")
+		}
+	}
+
+	if command == "" {
+		if p.isKlipper() {
+			command = "BED_MESH_OUTPUT"
+		} else {
+			command = "M420 V"
+		}
+	}
+	commands = append(commands, command)
+
+	var reply []string
+	for _, c := range commands {
+		var cmdErr error
+		p.SendCommand(c, func(r []string, err error) {
+			reply = r
+			cmdErr = err
+		})
+		if cmdErr != nil {
+			return nil, cmdErr
+		}
+	}
+
+	points, err := parseBedMesh(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	mesh := BedMesh{
+		Time: time.Now().Format(time.RFC3339),
+		Command: command,
+		Points: points,
+		Stats: computeMeshStats(points),
+	}
+
+	p.meshLock.Lock()
+	p.BedMeshes = append(p.BedMeshes, mesh)
+	if len(p.BedMeshes) > MAX_BED_MESHES {
+		p.BedMeshes = p.BedMeshes[len(p.BedMeshes)-MAX_BED_MESHES:]
+	}
+	p.meshLock.Unlock()
+
+	saveConfig()
+	return &mesh, nil
+}
+
+// Get a copy of stored meshes
+func (p *Printer) GetBedMeshes() []BedMesh {
+	p.meshLock.Lock()
+	defer p.meshLock.Unlock()
+
+	rv := make([]BedMesh, len(p.BedMeshes))
+	copy(rv, p.BedMeshes)
+	return rv
+}
+
+func (p *Printer) DeleteBedMesh(index int) bool {
+	p.meshLock.Lock()
+	if index < 0 || index >= len(p.BedMeshes) {
+		p.meshLock.Unlock()
+		return false
+	}
+	p.BedMeshes = append(p.BedMeshes[:index], p.BedMeshes[index+1:]...)
+	p.meshLock.Unlock()
+
+	saveConfig()
+	return true
+}
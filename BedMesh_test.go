@@ -0,0 +1,204 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Mesh as rows of strings, "." for points that were not probed
+func meshStrings(points [][]*float64) [][]string {
+	rv := make([][]string, len(points))
+	for y, r := range points {
+		rv[y] = make([]string, len(r))
+		for x, v := range r {
+			if v == nil {
+				rv[y][x] = "."
+			} else {
+				rv[y][x] = strconv.FormatFloat(*v, 'f', -1, 64)
+			}
+		}
+	}
+	return rv
+}
+
+func TestParseBedMesh(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		points [][]string
+	}{
+		{
+			name: "Marlin bilinear",
+			output: `Bilinear Leveling Grid:
+      0      1      2
+ 0 +0.162 +0.137 +0.080
+ 1 +0.170 +0.122 +0.062
+ 2 +0.182 +0.117 -0.055
+
+Subdivided with CATMULL ROM Leveling Grid:
+        0        1        2        3        4
+ 0 +0.16200 +0.15100 +0.13700 +0.11100 +0.08000
+ 1 +0.16600 +0.15000 +0.12900 +0.09900 +0.07100
+ 2 +0.17000 +0.14900 +0.12200 +0.09400 +0.06200
+ 3 +0.17600 +0.14800 +0.11900 +0.08100 +0.00300
+ 4 +0.18200 +0.14900 +0.11700 +0.03000 -0.05500
+
+echo:Bed Leveling ON
+echo:Fade Height 10.00`,
+			points: [][]string{
+				{ "0.162", "0.137", "0.08" },
+				{ "0.17", "0.122", "0.062" },
+				{ "0.182", "0.117", "-0.055" },
+			},
+		},
+		{
+			name: "Marlin bilinear not probed",
+			output: `Bilinear Leveling Grid:
+      0      1      2
+ 0 +0.162 =======  +0.080
+ 1 +0.170 +0.122 +0.062
+echo:Bed Leveling OFF`,
+			points: [][]string{
+				{ "0.162", ".", "0.08" },
+				{ "0.17", "0.122", "0.062" },
+			},
+		},
+		{
+			name: "Marlin MBL",
+			output: `Num X,Y: 3,3
+Z offset: 0.00000
+Measured points:
+        0        1        2
+ 0 +0.07500 +0.04500 -0.01000
+ 1 +0.05000 +0.02000 -0.03500
+ 2 +0.03000 -0.00500 -0.05500`,
+			points: [][]string{
+				{ "0.075", "0.045", "-0.01" },
+				{ "0.05", "0.02", "-0.035" },
+				{ "0.03", "-0.005", "-0.055" },
+			},
+		},
+		{
+			name: "Marlin UBL",
+			output: `
+Bed Topography Report:
+
+    (0,3)                         (3,3)
+    (0,220)                       (220,220)
+        0       1       2       3
+ 3 | +0.150  +0.115  +0.070     .
+   |
+ 2 | +0.137  +0.100 [+0.062] +0.025
+   |
+ 1 | +0.120  +0.083  +0.045  +0.008
+   |
+ 0 | +0.101  +0.063  +0.025  -0.012
+        0       1       2       3
+    (0,0)                         (3,0)
+    (0,0)                         (220,0)`,
+			points: [][]string{
+				{ "0.101", "0.063", "0.025", "-0.012" },
+				{ "0.12", "0.083", "0.045", "0.008" },
+				{ "0.137", "0.1", "0.062", "0.025" },
+				{ "0.15", "0.115", "0.07", "." },
+			},
+		},
+		{
+			name: "Klipper",
+			output: `// Mesh Leveling Probed Z positions:
+//  0.042500 0.020000 -0.015000
+//  0.050000 0.027500 -0.007500
+//  0.062500 0.040000 0.005000
+// Mesh X,Y: 5,5
+// Search Height: 5
+// Mesh Offsets: X=0.0000, Y=0.0000
+// Mesh Average: 0.03
+// Mesh Range: min=-0.0150 max=0.0625
+// Interpolation Algorithm: lagrange
+// Measured points:
+//   0.062500  0.051563  0.040000  0.023594  0.005000
+//   0.056250  0.045391  0.033750  0.016172 -0.001250
+//   0.050000  0.039063  0.027500  0.009844 -0.007500
+//   0.046250  0.034609  0.023750  0.005391 -0.011250
+//   0.042500  0.031563  0.020000  0.001406 -0.015000`,
+			points: [][]string{
+				{ "0.0425", "0.02", "-0.015" },
+				{ "0.05", "0.0275", "-0.0075" },
+				{ "0.0625", "0.04", "0.005" },
+			},
+		},
+	}
+
+	for _, test := range tests {
+		points, err := parseBedMesh(strings.Split(test.output, "\n"))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if got := meshStrings(points); !reflect.DeepEqual(got, test.points) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.points, got)
+		}
+	}
+}
+
+func TestParseBedMeshErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+	}{
+		{ "No mesh", "echo:Bed Leveling OFF\nok" },
+		{ "Invalid mesh", "Mesh bed leveling has no data." },
+		{ "Ragged rows", " 0 +0.1 +0.2 +0.3\n 1 +0.1 +0.2" },
+		{ "Missing row", " 0 +0.1 +0.2\n 2 +0.1 +0.2" },
+	}
+
+	for _, test := range tests {
+		if _, err := parseBedMesh(strings.Split(test.output, "\n")); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestBedMeshStats(t *testing.T) {
+	points, err := parseBedMesh([]string{ " 0 +0.500 -0.250", " 1 +0.750 ." })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := computeMeshStats(points)
+	if stats.Min != -0.25 || stats.Max != 0.75 || stats.Range != 1 {
+		t.Errorf("unexpected min/max/range: %+v", stats)
+	}
+	if math.Abs(stats.Mean - 1.0 / 3) > 1e-9 {
+		t.Errorf("expected the mean of probed points, got %g", stats.Mean)
+	}
+
+	before := &BedMesh{ Points: points }
+	after := &BedMesh{ Points: [][]*float64{ points[1], points[0] } }
+	diff, err := diffBedMeshes(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := meshStrings(diff.Points); !reflect.DeepEqual(got, [][]string{ { "0.25", "." }, { "-0.25", "." } }) {
+		t.Errorf("unexpected diff %v", got)
+	}
+}
+
+func TestProbeWhilePrinting(t *testing.T) {
+	p := LoadPrinter(PrinterSettings{ UniqueName: "test" })
+
+	p.job = &Job{ Id: "abc", State: JOB_PAUSED }
+	if _, err := p.CaptureBedMesh(true, ""); err == nil || !strings.Contains(err.Error(), "job") {
+		t.Errorf("probing during a job should be refused, got %v", err)
+	}
+	p.job = nil
+
+	p.sd.status.Printing = true
+	if _, err := p.CaptureBedMesh(true, ""); err == nil || !strings.Contains(err.Error(), "SD card") {
+		t.Errorf("probing during an SD print should be refused, got %v", err)
+	}
+}
@@ -5,14 +5,41 @@ import (
 	"log"
 	"encoding/json"
 	"io/ioutil"
+	"os"
 	"os/user"
+	"path/filepath"
+	"sync"
 )
 
 type Configuration struct {
 	Printers []PrinterSettings `json:"printers"`
 	Default string `json:"defaultPrinter"`
+	Macros []Macro `json:"macros"`
+	Hooks []Hook `json:"hooks"`
+	Webhooks []Webhook `json:"webhooks"`
+	Mqtt MqttSettings `json:"mqtt"`
+	OctoPrint OctoPrintSettings `json:"octoprint"`
+	Moonraker MoonrakerSettings `json:"moonraker"`
+	Users []User `json:"users"`
+	Spools []Spool `json:"spools"`
+	Costs CostSettings `json:"costs"`
 }
 
+// Directory of the data files instead of ~/.local/share if set, for tests
+var dataDirOverride string
+
+// Path of a file in the data directory
+func dataFile(name string) string {
+	if dataDirOverride != "" {
+		return filepath.Join(dataDirOverride, name)
+	}
+
+	user, err := user.Current()
+	if err != nil {
+		return name
+	}
+	return user.HomeDir + "/.local/share/" + name
+}
 
 func loadConfig() {
 	var configuration Configuration
@@ -23,40 +50,93 @@ func loadConfig() {
 
 	if err := viper.ReadInConfig(); err != nil {
 		log.Println("Cannot load config file: ", err)
+
+		// Starting without a configuration file is fine
+		_, configLoaded = err.(viper.ConfigFileNotFoundError)
 		return
 	}
 
+	// The file holds password hashes and secrets, older versions created it world-readable
+	if info, err := os.Stat(viper.ConfigFileUsed()); err == nil && info.Mode().Perm() & 0077 != 0 {
+		if err := os.Chmod(viper.ConfigFileUsed(), 0600); err != nil {
+			log.Println("Cannot restrict permissions of config file: ", err)
+		}
+	}
+
 	err := viper.Unmarshal(&configuration)
 	if err != nil {
 		log.Println("Unable to decode config file: ", err)
+	} else {
+		configLoaded = true
 	}
 
+	macros = configuration.Macros
+	hooks = configuration.Hooks
+	webhooks = configuration.Webhooks
+	mqttSettings = configuration.Mqtt
+	octoPrintSettings = configuration.OctoPrint
+	moonrakerSettings = configuration.Moonraker
+	users = configuration.Users
+	spools = configuration.Spools
+	costSettings = configuration.Costs
 	loadPrinters(configuration)
 }
 
+// Serializes writing the file, saves run from several goroutines
+var saveMutex sync.Mutex
+
 func saveConfig() {
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+
 	log.Println("Saving configuration...")
 	config := Configuration{}
 
 	config.Default = defaultPrinter
-	config.Printers = make([]PrinterSettings, len(printers))
+	config.Macros = macros
+	config.Hooks = hooks
+	config.Webhooks = getWebhooks()
+	config.Mqtt = mqttSettings
+	config.OctoPrint = octoPrintSettings
+	config.Moonraker = moonrakerSettings
+	config.Costs = costSettings
+
+	usersMutex.RLock()
+	config.Users = copyUsers()
+	usersMutex.RUnlock()
+
+	spoolsMutex.RLock()
+	config.Spools = copySpools()
+	spoolsMutex.RUnlock()
 
-	i := 0
+	printerMutex.RLock()
+	config.Printers = make([]PrinterSettings, 0, len(printers))
 	for _, printer := range printers {
-		config.Printers[i] = printer.PrinterSettings
-		i++
+		config.Printers = append(config.Printers, printer.settingsSnapshot())
 	}
+	printerMutex.RUnlock()
 
 	b, _ := json.MarshalIndent(config, "", "  ")
 
-	user, err := user.Current()
+	// Replace the file at once, a crash while writing must not leave it truncated
+	path := dataFile("dashprint.json")
+	// Created with 0600, the file holds password hashes and secrets
+	f, err := ioutil.TempFile(filepath.Dir(path), ".dashprint-*.json")
 	if err != nil {
 		log.Println("Failed to save configuration: ", err)
 		return
 	}
-	err = ioutil.WriteFile(user.HomeDir + "/.local/share/dashprint.json", b, 0644)
+
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
 
 	if err != nil {
+		os.Remove(f.Name())
 		log.Println("Failed to save configuration: ", err)
 	}
 }
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type CostSettings struct {
+	Currency         string  `json:"currency"`
+	// Price of 1 kWh
+	ElectricityPrice float64 `json:"electricityPrice"`
+}
+
+type PrinterCostSettings struct {
+	// Average power draw while printing
+	Wattage     float64 `json:"wattage"`
+	// Machine wear and depreciation per printing hour
+	WearPerHour float64 `json:"wearPerHour"`
+}
+
+type FilamentCost struct {
+	Extruder int     `json:"extruder"`
+	// Spool the price was taken from, 0 if none is loaded
+	Spool    int     `json:"spool"`
+	Length   float64 `json:"length"`
+	Weight   float64 `json:"weight"`
+	Cost     float64 `json:"cost"`
+}
+
+type CostBreakdown struct {
+	Currency        string         `json:"currency"`
+	// Seconds
+	Duration        float64        `json:"duration"`
+	Filament        []FilamentCost `json:"filament"`
+	FilamentCost    float64        `json:"filamentCost"`
+	Energy          float64        `json:"energy"`
+	ElectricityCost float64        `json:"electricityCost"`
+	WearCost        float64        `json:"wearCost"`
+	Total           float64        `json:"total"`
+}
+
+// A charged print
+type CostRecord struct {
+	Id         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Printer    string    `json:"printer"`
+	User       string    `json:"user"`
+	Department string    `json:"department"`
+	Job        string    `json:"job"`
+	CostBreakdown
+}
+
+var costSettings CostSettings
+var costsMutex sync.Mutex
+
+func costsFile() string {
+	return dataFile("dashprint-costs.jsonl")
+}
+
+// Cost of a print given mm of filament per extruder and its duration.
+// Filament is priced from the spools loaded on the extruders.
+func (p *Printer) EstimateCost(filament []float64, duration time.Duration) CostBreakdown {
+	cost := CostBreakdown{
+		Currency: costSettings.Currency,
+		Duration: duration.Seconds(),
+		Filament: make([]FilamentCost, len(filament)),
+	}
+
+	spoolsMutex.RLock()
+	for i, length := range filament {
+		fc := FilamentCost{ Extruder: i, Length: length }
+
+		s := findLoadedSpool(p.UniqueName, i)
+		if s == nil {
+			// Price unknown, estimate the weight for PLA
+			s = &Spool{ Material: "PLA" }
+			s.normalize()
+		} else {
+			fc.Spool = s.Id
+		}
+
+		fc.Weight = s.weightOf(length)
+		fc.Cost = fc.Weight / 1000 * s.PricePerKg
+
+		cost.Filament[i] = fc
+		cost.FilamentCost += fc.Cost
+	}
+	spoolsMutex.RUnlock()
+
+	hours := duration.Hours()
+	cost.Energy = p.Cost.Wattage * hours / 1000
+	cost.ElectricityCost = cost.Energy * costSettings.ElectricityPrice
+	cost.WearCost = p.Cost.WearPerHour * hours
+	cost.Total = cost.FilamentCost + cost.ElectricityCost + cost.WearCost
+
+	return cost
+}
+
+// Charge a finished job to its user: the filament its lines pushed and
+// the time printed
+func (p *Printer) jobCost(job Job) CostRecord {
+	filament := make([]float64, len(job.Extruded))
+	for i, length := range job.Extruded {
+		filament[i] = math.Max(0, length)
+	}
+
+	record := CostRecord{
+		Id: job.Id,
+		Time: job.Ended,
+		Printer: p.UniqueName,
+		User: job.User,
+		Job: job.Id,
+		CostBreakdown: p.EstimateCost(filament, time.Duration(job.PrintTime * float64(time.Second))),
+	}
+
+	usersMutex.RLock()
+	if u := findUser(job.User); u != nil {
+		record.Department = u.Department
+	}
+	usersMutex.RUnlock()
+
+	return record
+}
+
+// Append a record to the cost ledger
+func recordCost(record CostRecord) error {
+	costsMutex.Lock()
+	defer costsMutex.Unlock()
+
+	js, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(costsFile(), os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(js, '\n'))
+	return err
+}
+
+// Read cost records matching filters, month as YYYY-MM
+func queryCosts(username, department, printer, month string) ([]CostRecord, error) {
+	costsMutex.Lock()
+	defer costsMutex.Unlock()
+
+	records := make([]CostRecord, 0)
+
+	f, err := os.Open(costsFile())
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record CostRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+
+		if (username != "" && record.User != username) ||
+			(department != "" && record.Department != department) ||
+			(printer != "" && record.Printer != printer) ||
+			(month != "" && record.Time.Format("2006-01") != month) {
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// Replace or, if update returns nil, delete the record with the given id.
+// Returns the updated record, nil if there is no record with that id. The
+// ledger is left as it is if update fails.
+func updateCost(id string, update func(record CostRecord) (*CostRecord, error)) (*CostRecord, error) {
+	costsMutex.Lock()
+	defer costsMutex.Unlock()
+
+	data, err := ioutil.ReadFile(costsFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var found *CostRecord
+	var out bytes.Buffer
+
+	for _, line := range bytes.Split(data, []byte{ '\n' }) {
+		if len(line) == 0 {
+			continue
+		}
+
+		var record CostRecord
+		if found != nil || json.Unmarshal(line, &record) != nil || record.Id != id {
+			out.Write(line)
+			out.WriteByte('\n')
+			continue
+		}
+
+		updated, err := update(record)
+		if err != nil {
+			return nil, err
+		}
+
+		found = &record
+		if updated != nil {
+			found = updated
+			js, err := json.Marshal(updated)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(js)
+			out.WriteByte('\n')
+		}
+	}
+
+	if found == nil {
+		return nil, nil
+	}
+
+	// Replace the ledger at once, a crash must not leave it truncated
+	tmp := costsFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, out.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, costsFile()); err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// Spreadsheets run cells starting with these as formulas
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func formatMoney(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+func writeCostRecordsCsv(w *csv.Writer, records []CostRecord) {
+	w.Write([]string{ "id", "time", "printer", "user", "department", "job", "duration_h", "filament_g", "energy_kwh",
+		"filament_cost", "electricity_cost", "wear_cost", "total", "currency" })
+
+	for _, r := range records {
+		weight := 0.0
+		for _, f := range r.Filament {
+			weight += f.Weight
+		}
+
+		w.Write([]string{
+			r.Id, r.Time.Format(time.RFC3339), csvText(r.Printer), csvText(r.User), csvText(r.Department), csvText(r.Job),
+			strconv.FormatFloat(r.Duration / 3600, 'f', 2, 64),
+			strconv.FormatFloat(weight, 'f', 1, 64),
+			strconv.FormatFloat(r.Energy, 'f', 3, 64),
+			formatMoney(r.FilamentCost), formatMoney(r.ElectricityCost), formatMoney(r.WearCost), formatMoney(r.Total),
+			csvText(r.Currency),
+		})
+	}
+}
+
+// Totals per month and user, department or printer
+func writeCostSummaryCsv(w *csv.Writer, records []CostRecord, group string) {
+	type total struct {
+		month, key string
+		jobs int
+		duration, weight, energy, filament, electricity, wear, total float64
+	}
+
+	totals := make(map[string]*total)
+	for _, r := range records {
+		key := r.User
+		if group == "department" {
+			key = r.Department
+		} else if group == "printer" {
+			key = r.Printer
+		}
+
+		month := r.Time.Format("2006-01")
+		t, ok := totals[month + "\x00" + key]
+		if !ok {
+			t = &total{ month: month, key: key }
+			totals[month + "\x00" + key] = t
+		}
+
+		t.jobs++
+		t.duration += r.Duration
+		for _, f := range r.Filament {
+			t.weight += f.Weight
+		}
+		t.energy += r.Energy
+		t.filament += r.FilamentCost
+		t.electricity += r.ElectricityCost
+		t.wear += r.WearCost
+		t.total += r.Total
+	}
+
+	keys := make([]string, 0, len(totals))
+	for k := range totals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.Write([]string{ "month", group, "jobs", "duration_h", "filament_g", "energy_kwh",
+		"filament_cost", "electricity_cost", "wear_cost", "total", "currency" })
+
+	for _, k := range keys {
+		t := totals[k]
+		w.Write([]string{
+			t.month, csvText(t.key), strconv.Itoa(t.jobs),
+			strconv.FormatFloat(t.duration / 3600, 'f', 2, 64),
+			strconv.FormatFloat(t.weight, 'f', 1, 64),
+			strconv.FormatFloat(t.energy, 'f', 3, 64),
+			formatMoney(t.filament), formatMoney(t.electricity), formatMoney(t.wear), formatMoney(t.total),
+			csvText(costSettings.Currency),
+		})
+	}
+}
+
+type RestCostRequest struct {
+	Job      string    `json:"job"`
+	// Stored file, its filament replaces Filament
+	File     string    `json:"file"`
+	// mm of filament per extruder
+	Filament []float64 `json:"filament"`
+	// Seconds
+	Duration float64   `json:"duration"`
+	// User to charge, the current user if empty
+	User     string    `json:"user"`
+}
+
+func decodeCostRequest(w http.ResponseWriter, r *http.Request) *RestCostRequest {
+	var t RestCostRequest
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	if t.Duration < 0 {
+		http.Error(w, "Bad duration", http.StatusBadRequest)
+		return nil
+	}
+
+	return &t
+}
+
+func findCostPrinter(w http.ResponseWriter, r *http.Request) *Printer {
+	printerMutex.RLock()
+	printer, ok := printers[mux.Vars(r)["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+	return printer
+}
+
+// Cost of a request on a printer, taking the filament from the analysis of File if given
+func (t *RestCostRequest) estimate(printer *Printer) (CostBreakdown, error) {
+	filament := t.Filament
+	if t.File != "" {
+		f, err := openStoredFile(t.File)
+		if err != nil {
+			return CostBreakdown{}, err
+		}
+		defer f.Close()
+
+		if filament, err = analyzeFilament(f, jobPosition{}); err != nil {
+			return CostBreakdown{}, err
+		}
+	}
+
+	return printer.EstimateCost(filament, time.Duration(t.Duration * float64(time.Second))), nil
+}
+
+// Cost record for a request, charged to the given user or the current one
+func (t *RestCostRequest) record(printer *Printer, r *http.Request) (CostRecord, error) {
+	record := CostRecord{ Printer: printer.UniqueName, Job: t.Job }
+
+	cost, err := t.estimate(printer)
+	if err != nil {
+		return record, err
+	}
+	record.CostBreakdown = cost
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	u := currentUser(r)
+	if t.User != "" {
+		if u = findUser(t.User); u == nil {
+			return record, errors.New("Unknown user")
+		}
+	}
+
+	if u != nil {
+		record.User = u.Username
+		record.Department = u.Department
+	}
+	return record, nil
+}
+
+func writeCostRecord(w http.ResponseWriter, record *CostRecord, status int) {
+	js, err := json.Marshal(record)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// POST /printers/{printerId}/cost
+func handleEstimateCost(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	printer := findCostPrinter(w, r)
+	if printer == nil {
+		return
+	}
+	t := decodeCostRequest(w, r)
+	if t == nil {
+		return
+	}
+
+	cost, err := t.estimate(printer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	js, err := json.Marshal(cost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// POST /printers/{printerId}/costs, charges a print not run as a job.
+// Jobs are charged when they finish.
+func handleRecordCost(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	printer := findCostPrinter(w, r)
+	if printer == nil {
+		return
+	}
+	t := decodeCostRequest(w, r)
+	if t == nil {
+		return
+	}
+
+	record, err := t.record(printer, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	record.Id = strconv.FormatInt(time.Now().UnixNano(), 36)
+	record.Time = time.Now()
+
+	if err := recordCost(record); err != nil {
+		log.Println("Cannot write cost record: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeCostRecord(w, &record, http.StatusCreated)
+}
+
+// PUT /costs/{costId}, corrects a record, recomputing it on its printer
+func handleModifyCost(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	t := decodeCostRequest(w, r)
+	if t == nil {
+		return
+	}
+
+	var badRequest error
+	record, err := updateCost(mux.Vars(r)["costId"], func(record CostRecord) (*CostRecord, error) {
+		printerMutex.RLock()
+		printer, ok := printers[record.Printer]
+		printerMutex.RUnlock()
+
+		if !ok {
+			badRequest = errors.New("Printer " + record.Printer + " no longer exists")
+			return nil, badRequest
+		}
+
+		updated, err := t.record(printer, r)
+		if err != nil {
+			badRequest = err
+			return nil, err
+		}
+		updated.Id = record.Id
+		updated.Time = record.Time
+		return &updated, nil
+	})
+
+	if badRequest != nil {
+		http.Error(w, badRequest.Error(), http.StatusBadRequest)
+	} else if err != nil {
+		log.Println("Cannot write cost record: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else if record == nil {
+		http.NotFound(w, r)
+	} else {
+		writeCostRecord(w, record, http.StatusOK)
+	}
+}
+
+// DELETE /costs/{costId}
+func handleDeleteCost(w http.ResponseWriter, r *http.Request) {
+	record, err := updateCost(mux.Vars(r)["costId"], func(record CostRecord) (*CostRecord, error) {
+		return nil, nil
+	})
+
+	if err != nil {
+		log.Println("Cannot write cost record: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else if record == nil {
+		http.NotFound(w, r)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GET /costs?user=&department=&printer=&month=YYYY-MM&format=csv&group=user|department|printer
+func handleGetCosts(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	query := r.URL.Query()
+
+	if month := query.Get("month"); month != "" {
+		if _, err := time.Parse("2006-01", month); err != nil {
+			http.Error(w, "Invalid month", http.StatusBadRequest)
+			return
+		}
+	}
+
+	group := query.Get("group")
+	if group != "" && group != "user" && group != "department" && group != "printer" {
+		http.Error(w, "Invalid group", http.StatusBadRequest)
+		return
+	}
+
+	records, err := queryCosts(query.Get("user"), query.Get("department"), query.Get("printer"), query.Get("month"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if query.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"dashprint-costs.csv\"")
+
+		cw := csv.NewWriter(w)
+		if group != "" {
+			writeCostSummaryCsv(cw, records, group)
+		} else {
+			writeCostRecordsCsv(cw, records)
+		}
+		cw.Flush()
+		return
+	}
+
+	js, err := json.Marshal(records)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
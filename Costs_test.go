@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnalyzeFilament(t *testing.T) {
+	gcode := `M83
+G1 X10 E2 ; perimeter
+G1 E-0.8
+G1 E0.8
+T1
+G92 E0
+G1 X20 e5
+t0
+G1 Y10 E1.5
+`
+
+	filament, err := analyzeFilament(strings.NewReader(gcode), jobPosition{})
+	if err != nil || len(filament) != 2 || !almostEqual(filament[0], 3.5) || !almostEqual(filament[1], 5) {
+		t.Errorf("expected 3.5 mm on T0 and 5 mm on T1, got %v, %v", filament, err)
+	}
+
+	if filament, _ = analyzeFilament(strings.NewReader("G28\nG1 E-2\n"), jobPosition{}); len(filament) != 1 || filament[0] != 0 {
+		t.Errorf("retractions only should use no filament, got %v", filament)
+	}
+}
+
+func TestJobCost(t *testing.T) {
+	s := Spool{ Id: 1, Material: "PLA", InitialWeight: 1000, RemainingWeight: 1000, PricePerKg: 20, Printer: "test", Extruder: 0 }
+	s.normalize()
+	withSpools(t, []Spool{ s })
+
+	usersMutex.Lock()
+	oldUsers := users
+	users = []User{ { Username: "alice", Department: "Research" } }
+	usersMutex.Unlock()
+
+	oldSettings := costSettings
+	costSettings = CostSettings{ Currency: "EUR", ElectricityPrice: 0.3 }
+
+	t.Cleanup(func() {
+		usersMutex.Lock()
+		users = oldUsers
+		usersMutex.Unlock()
+		costSettings = oldSettings
+	})
+
+	p := LoadPrinter(PrinterSettings{
+		UniqueName: "test",
+		Cost: PrinterCostSettings{ Wattage: 200, WearPerHour: 0.5 },
+	})
+
+	job := Job{ Id: "abc", File: "benchy.gcode", User: "alice", State: JOB_CANCELLED, Ended: time.Now(), PrintTime: 7200, Progress: 0.25,
+		Filament: []float64{ 1000 }, Extruded: []float64{ 250 } }
+	record := p.jobCost(job)
+
+	if record.Id != "abc" || record.Job != "abc" || record.User != "alice" || record.Department != "Research" || record.Printer != "test" {
+		t.Errorf("unexpected attribution %+v", record)
+	}
+	if len(record.Filament) != 1 || record.Filament[0].Length != 250 || record.Filament[0].Spool != 1 {
+		t.Errorf("expected the extruded filament from spool 1, got %+v", record.Filament)
+	}
+	if !almostEqual(record.FilamentCost, s.weightOf(250) / 1000 * 20) {
+		t.Errorf("unexpected filament cost %g", record.FilamentCost)
+	}
+	if !almostEqual(record.Energy, 0.4) || !almostEqual(record.ElectricityCost, 0.12) || !almostEqual(record.WearCost, 1) {
+		t.Errorf("unexpected time based costs %+v", record.CostBreakdown)
+	}
+
+	// More retracted than pushed, e.g. cancelled during the start script
+	job.Extruded = []float64{ -2 }
+	if record = p.jobCost(job); record.Filament[0].Length != 0 {
+		t.Errorf("retractions should not be charged, got %g mm", record.Filament[0].Length)
+	}
+
+	// Jobs that extruded nothing are charged for time only
+	job.Extruded = nil
+	if record = p.jobCost(job); len(record.Filament) != 0 || !almostEqual(record.Total, 1.12) {
+		t.Errorf("expected time based costs only, got %+v", record.CostBreakdown)
+	}
+}
+
+func TestCostCsvEscaping(t *testing.T) {
+	records := []CostRecord{
+		{
+			Id: "1",
+			Printer: "printer",
+			User: "=HYPERLINK(\"http://example.com\")",
+			Department: "+1",
+			Job: "@SUM(A1)",
+			CostBreakdown: CostBreakdown{ Currency: "-EUR" },
+		},
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	writeCostRecordsCsv(w, records)
+	writeCostSummaryCsv(w, records, "user")
+	w.Flush()
+
+	r := csv.NewReader(&buf)
+	// Records and summary differ in columns
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, row := range rows {
+		for _, cell := range row {
+			if cell != "" && strings.ContainsRune("=+-@", rune(cell[0])) {
+				t.Errorf("cell %q could be run as a formula", cell)
+			}
+		}
+	}
+
+	if user := rows[1][3]; user != "'=HYPERLINK(\"http://example.com\")" {
+		t.Errorf("unexpected user cell %q", user)
+	}
+}
@@ -54,7 +54,7 @@ func unescape(text string) string {
 	re := regexp.MustCompile(`\\x(.{2})`)
 	return ReplaceAllStringSubmatchFunc(re, text, func (groups []string) string {
 		c, _ := strconv.ParseInt(groups[1], 16, 8)
-		return string(c)
+		return string(rune(c))
 	})
 }
 
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// G-code files stored on the host for printing jobs
+
+type StoredFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+var errBadFileName = errors.New("Invalid file name")
+
+func filesDir() string {
+	return dataFile("dashprint-files")
+}
+
+// Names must stay within the files directory. Names starting with a dot are
+// reserved for uploads in progress.
+func validFileName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\\\x00")
+}
+
+func storedFilePath(name string) (string, error) {
+	if !validFileName(name) {
+		return "", errBadFileName
+	}
+	return filepath.Join(filesDir(), name), nil
+}
+
+// Stored files sorted by name
+func listFiles() ([]StoredFile, error) {
+	files := make([]StoredFile, 0)
+
+	infos, err := ioutil.ReadDir(filesDir())
+	if os.IsNotExist(err) {
+		return files, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !validFileName(info.Name()) {
+			continue
+		}
+		files = append(files, StoredFile{ Name: info.Name(), Size: info.Size(), Modified: info.ModTime() })
+	}
+
+	return files, nil
+}
+
+func statFile(name string) (StoredFile, error) {
+	path, err := storedFilePath(name)
+	if err != nil {
+		return StoredFile{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return StoredFile{}, err
+	}
+
+	return StoredFile{ Name: name, Size: info.Size(), Modified: info.ModTime() }, nil
+}
+
+func openStoredFile(name string) (*os.File, error) {
+	path, err := storedFilePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Store a file, replacing the file of the same name only once it is complete
+func storeFile(name string, r io.Reader) (StoredFile, error) {
+	path, err := storedFilePath(name)
+	if err != nil {
+		return StoredFile{}, err
+	}
+
+	if fileInUse(name) {
+		return StoredFile{}, errFileInUse
+	}
+
+	if err := os.MkdirAll(filesDir(), 0700); err != nil {
+		return StoredFile{}, err
+	}
+
+	f, err := ioutil.TempFile(filesDir(), ".upload-*")
+	if err != nil {
+		return StoredFile{}, err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return StoredFile{}, err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return StoredFile{}, err
+	}
+
+	return statFile(name)
+}
+
+func deleteStoredFile(name string) error {
+	path, err := storedFilePath(name)
+	if err != nil {
+		return err
+	}
+
+	if fileInUse(name) {
+		return errFileInUse
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+const (
+	EVENT_FIRMWARE_FLASH_STARTED  = "firmware_flash_started"
+	EVENT_FIRMWARE_FLASH_FINISHED = "firmware_flash_finished"
+	EVENT_FIRMWARE_FLASH_FAILED   = "firmware_flash_failed"
+)
+
+const (
+	// Baud rate of the stk500v2 bootloader on ATmega2560 boards
+	FLASH_AVR_BAUD_RATE     = 115200
+	FLASH_AVR_PAGE_SIZE     = 256
+	FLASH_SIGN_ON_ATTEMPTS  = 10
+	FLASH_REPLY_TIMEOUT     = 1000 // 1 second
+	// How long to wait for the printer to come back after flashing
+	FLASH_RECONNECT_TIMEOUT = 60000 // 1 minute
+	// Largest accepted upload, Intel HEX is more than twice the flash size
+	MAX_FIRMWARE_SIZE       = 16 << 20
+)
+
+const (
+	kTIOCMBIS  = 0x5416
+	kTIOCMBIC  = 0x5417
+	kTIOCM_DTR = 0x002
+)
+
+// STK500v2 protocol constants
+const (
+	stkMessageStart     = 0x1B
+	stkToken            = 0x0E
+	stkCmdSignOn        = 0x01
+	stkCmdLoadAddress   = 0x06
+	stkCmdEnterProgmode = 0x10
+	stkCmdLeaveProgmode = 0x11
+	stkCmdProgramFlash  = 0x13
+	stkCmdReadFlash     = 0x14
+	stkStatusOk         = 0x00
+)
+
+type FlashState struct {
+	Running    bool    `json:"running"`
+	// uploading, resetting, writing, verifying, reconnecting, done
+	Stage      string  `json:"stage"`
+	// Progress of the current stage, 0 to 1
+	Progress   float64 `json:"progress"`
+	File       string  `json:"file"`
+	OldVersion string  `json:"oldVersion"`
+	NewVersion string  `json:"newVersion"`
+	Started    string  `json:"started"`
+	Error      string  `json:"error"`
+}
+
+type printerFlash struct {
+	lock  sync.Mutex
+	state *FlashState
+}
+
+func (p *Printer) GetFlashState() *FlashState {
+	p.flash.lock.Lock()
+	defer p.flash.lock.Unlock()
+
+	if p.flash.state == nil {
+		return nil
+	}
+
+	state := *p.flash.state
+	return &state
+}
+
+func (p *Printer) isFlashing() bool {
+	p.flash.lock.Lock()
+	defer p.flash.lock.Unlock()
+
+	return p.flash.state != nil && p.flash.state.Running
+}
+
+func (p *Printer) setFlashStage(stage string, progress float64) {
+	p.flash.lock.Lock()
+	defer p.flash.lock.Unlock()
+
+	p.flash.state.Stage = stage
+	p.flash.state.Progress = progress
+}
+
+// Start flashing firmware in the background. Intel HEX images are written
+// to AVR boards over the serial port, binary images are copied to the
+// board's SD card mounted at FirmwareVolume (STM32 and similar).
+func (p *Printer) FlashFirmware(fileName string, data []byte) error {
+	var image []byte
+	var err error
+
+	switch strings.ToLower(filepath.Ext(fileName)) {
+		case ".hex":
+			if image, err = parseIntelHex(data); err != nil {
+				return err
+			}
+		case ".bin":
+			if p.FirmwareVolume == "" {
+				return errors.New("No firmware volume configured for this printer")
+			}
+			image = data
+		default:
+			return errors.New("Firmware must be a .hex or .bin file")
+	}
+
+	p.flash.lock.Lock()
+	if p.flash.state != nil && p.flash.state.Running {
+		p.flash.lock.Unlock()
+		return errors.New("Flashing already in progress")
+	}
+	if err := p.checkFlashAllowed(); err != nil {
+		p.flash.lock.Unlock()
+		return err
+	}
+
+	p.flash.state = &FlashState{
+		Running: true,
+		Stage: "starting",
+		File: fileName,
+		OldVersion: p.firmwareName(),
+		Started: time.Now().Format(time.RFC3339),
+	}
+	p.flash.lock.Unlock()
+
+	p.emitEvent(EVENT_FIRMWARE_FLASH_STARTED, map[string]string{ "file": fileName })
+	go p.flashFirmware(fileName, image)
+
+	return nil
+}
+
+// Flashing resets the board, refuse while that would ruin a print or a file
+func (p *Printer) checkFlashAllowed() error {
+	if err := p.checkNotPrinting("flash firmware"); err != nil {
+		return err
+	}
+
+	p.sd.lock.Lock()
+	defer p.sd.lock.Unlock()
+
+	if p.sd.upload != nil && p.sd.upload.Running {
+		return errors.New("Cannot flash firmware during an upload to SD card")
+	}
+	return nil
+}
+
+func (p *Printer) flashFirmware(fileName string, image []byte) {
+	var err error
+	wasStopped := p.GetState() == STATE_STOPPED
+
+	p.log().Infof("Flashing firmware %s (%d bytes)", fileName, len(image))
+
+	if filepath.Ext(strings.ToLower(fileName)) == ".hex" {
+		p.Stop()
+		err = p.flashAvr(image)
+		p.Start()
+	} else {
+		err = p.flashVolume(image)
+	}
+
+	if err == nil {
+		err = p.verifyFirmware()
+	}
+
+	if wasStopped {
+		p.Stop()
+	}
+
+	p.flash.lock.Lock()
+	p.flash.state.Running = false
+	if err != nil {
+		p.flash.state.Error = err.Error()
+	} else {
+		p.flash.state.Stage = "done"
+		p.flash.state.Progress = 1
+	}
+	state := *p.flash.state
+	p.flash.lock.Unlock()
+
+	if err != nil {
+		p.log().Errorf("Flashing firmware %s failed: %v", fileName, err)
+		p.emitEvent(EVENT_FIRMWARE_FLASH_FAILED, map[string]string{ "file": fileName, "error": err.Error() })
+	} else {
+		p.log().Infof("Flashed firmware %s, now running %s", fileName, state.NewVersion)
+		p.emitEvent(EVENT_FIRMWARE_FLASH_FINISHED, map[string]string{
+			"file": fileName,
+			"oldVersion": state.OldVersion,
+			"newVersion": state.NewVersion,
+		})
+	}
+}
+
+// Copy firmware.bin to the board's SD card and reboot into the bootloader
+func (p *Printer) flashVolume(image []byte) error {
+	p.setFlashStage("writing", 0)
+
+	file, err := os.Create(filepath.Join(p.FirmwareVolume, "firmware.bin"))
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(image); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	p.setFlashStage("resetting", 0)
+
+	// The board won't reply once it starts rebooting
+	if p.GetState() == STATE_CONNECTED {
+		p.sendCommand("M997", nil, false)
+	}
+
+	p.Stop()
+	p.Start()
+
+	return nil
+}
+
+// Wait for the printer to reconnect and read the new firmware version
+func (p *Printer) verifyFirmware() error {
+	p.setFlashStage("reconnecting", 0)
+
+	deadline := time.Now().Add(time.Millisecond * FLASH_RECONNECT_TIMEOUT)
+	for p.GetState() != STATE_CONNECTED {
+		if time.Now().After(deadline) {
+			return errors.New("Printer did not reconnect after flashing")
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	var params map[string]string
+	var cmdErr error
+
+	p.sendCommand("M115", func(reply []string, err error) {
+		cmdErr = err
+		if err == nil {
+			params = firmwareInfo(reply)
+		}
+	}, false)
+
+	if cmdErr != nil {
+		return cmdErr
+	}
+	if params == nil {
+		return errors.New("Printer did not report a firmware name after flashing")
+	}
+
+	p.setBaseParameters(params)
+	version := params["FIRMWARE_NAME"]
+
+	p.flash.lock.Lock()
+	p.flash.state.NewVersion = version
+	p.flash.lock.Unlock()
+
+	return nil
+}
+
+// Parse an Intel HEX file into a flat image starting at address 0
+func parseIntelHex(data []byte) ([]byte, error) {
+	image := make([]byte, 0)
+	var base uint32
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" {
+			continue
+		}
+		if line[0] != ':' {
+			return nil, fmt.Errorf("Line %d: missing start code", lineNo)
+		}
+
+		record, err := hex.DecodeString(line[1:])
+		if err != nil || len(record) < 5 || len(record) != int(record[0]) + 5 {
+			return nil, fmt.Errorf("Line %d: malformed record", lineNo)
+		}
+
+		var sum byte
+		for _, b := range record {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, fmt.Errorf("Line %d: checksum mismatch", lineNo)
+		}
+
+		payload := record[4:len(record)-1]
+		address := base + uint32(record[1]) << 8 + uint32(record[2])
+
+		switch record[3] {
+			case 0x00: // Data
+				end := int(address) + len(payload)
+				for len(image) < end {
+					image = append(image, 0xFF)
+				}
+				copy(image[address:], payload)
+			case 0x01: // End of file
+				return image, nil
+			case 0x02: // Extended segment address
+				if len(payload) != 2 {
+					return nil, fmt.Errorf("Line %d: malformed record", lineNo)
+				}
+				base = (uint32(payload[0]) << 8 | uint32(payload[1])) << 4
+			case 0x04: // Extended linear address
+				if len(payload) != 2 {
+					return nil, fmt.Errorf("Line %d: malformed record", lineNo)
+				}
+				base = (uint32(payload[0]) << 8 | uint32(payload[1])) << 16
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, errors.New("Missing end of file record")
+}
+
+type stk500v2 struct {
+	port io.ReadWriter
+	// Port with read deadline support, nil when talking to something else
+	file *os.File
+	seq  byte
+}
+
+func (s *stk500v2) send(body []byte) error {
+	msg := []byte{ stkMessageStart, s.seq, byte(len(body) >> 8), byte(len(body)), stkToken }
+	msg = append(msg, body...)
+
+	var cs byte
+	for _, b := range msg {
+		cs ^= b
+	}
+	msg = append(msg, cs)
+
+	_, err := s.port.Write(msg)
+	return err
+}
+
+func (s *stk500v2) readByte(deadline time.Time) (byte, error) {
+	if s.file != nil {
+		s.file.SetReadDeadline(deadline)
+	}
+
+	buf := make([]byte, 1)
+	for {
+		n, err := s.port.Read(buf)
+		if n == 1 {
+			return buf[0], nil
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) || time.Now().After(deadline) {
+			return 0, errors.New("Timeout waiting for bootloader")
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+}
+
+func (s *stk500v2) receive(deadline time.Time) ([]byte, error) {
+	for {
+		b, err := s.readByte(deadline)
+		if err != nil {
+			return nil, err
+		}
+		if b != stkMessageStart {
+			continue
+		}
+
+		header := []byte{ b }
+		for len(header) < 5 {
+			if b, err = s.readByte(deadline); err != nil {
+				return nil, err
+			}
+			header = append(header, b)
+		}
+
+		if header[1] != s.seq || header[4] != stkToken {
+			continue
+		}
+
+		size := int(header[2]) << 8 | int(header[3])
+		body := make([]byte, 0, size)
+		for len(body) < size + 1 {
+			if b, err = s.readByte(deadline); err != nil {
+				return nil, err
+			}
+			body = append(body, b)
+		}
+
+		var cs byte
+		for _, b := range header {
+			cs ^= b
+		}
+		for _, b := range body {
+			cs ^= b
+		}
+		if cs != 0 {
+			return nil, errors.New("Bootloader reply checksum mismatch")
+		}
+
+		return body[:size], nil
+	}
+}
+
+// Send a command and wait for a successful answer
+func (s *stk500v2) command(body []byte) ([]byte, error) {
+	if err := s.send(body); err != nil {
+		return nil, err
+	}
+
+	answer, err := s.receive(time.Now().Add(time.Millisecond * FLASH_REPLY_TIMEOUT))
+	s.seq++
+
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) < 2 || answer[0] != body[0] {
+		return nil, fmt.Errorf("Unexpected bootloader answer to command 0x%02x", body[0])
+	}
+	if answer[1] != stkStatusOk {
+		return nil, fmt.Errorf("Bootloader command 0x%02x failed with status 0x%02x", body[0], answer[1])
+	}
+
+	return answer, nil
+}
+
+func (s *stk500v2) signOn() error {
+	var err error
+	for i := 0; i < FLASH_SIGN_ON_ATTEMPTS; i++ {
+		if _, err = s.command([]byte{ stkCmdSignOn }); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *stk500v2) loadAddress(address int) error {
+	// Word address, the high bit enables addressing beyond 64 KiB
+	word := uint32(address / 2) | 0x80000000
+	_, err := s.command([]byte{ stkCmdLoadAddress, byte(word >> 24), byte(word >> 16), byte(word >> 8), byte(word) })
+	return err
+}
+
+// Write an image page by page and read it back, reporting progress from 0 to 1
+func (s *stk500v2) program(image []byte, progress func(stage string, done float64)) error {
+	enter := []byte{ stkCmdEnterProgmode, 200, 100, 25, 32, 0, 0x53, 3, 0xAC, 0x53, 0x00, 0x00 }
+	if _, err := s.command(enter); err != nil {
+		return err
+	}
+
+	// Pad to whole pages
+	for len(image) % FLASH_AVR_PAGE_SIZE != 0 {
+		image = append(image, 0xFF)
+	}
+
+	for addr := 0; addr < len(image); addr += FLASH_AVR_PAGE_SIZE {
+		progress("writing", float64(addr) / float64(len(image)))
+
+		if err := s.loadAddress(addr); err != nil {
+			return err
+		}
+
+		cmd := []byte{ stkCmdProgramFlash, FLASH_AVR_PAGE_SIZE >> 8, FLASH_AVR_PAGE_SIZE & 0xFF, 0xC1, 10, 0x40, 0x4C, 0x20, 0x00, 0x00 }
+		cmd = append(cmd, image[addr:addr+FLASH_AVR_PAGE_SIZE]...)
+
+		if _, err := s.command(cmd); err != nil {
+			return fmt.Errorf("Writing page at 0x%05x: %v", addr, err)
+		}
+	}
+
+	for addr := 0; addr < len(image); addr += FLASH_AVR_PAGE_SIZE {
+		progress("verifying", float64(addr) / float64(len(image)))
+
+		if err := s.loadAddress(addr); err != nil {
+			return err
+		}
+
+		answer, err := s.command([]byte{ stkCmdReadFlash, FLASH_AVR_PAGE_SIZE >> 8, FLASH_AVR_PAGE_SIZE & 0xFF, 0x20 })
+		if err != nil {
+			return fmt.Errorf("Reading page at 0x%05x: %v", addr, err)
+		}
+
+		// Answer is command, status, data, status
+		if len(answer) < FLASH_AVR_PAGE_SIZE + 2 || !bytes.Equal(answer[2:FLASH_AVR_PAGE_SIZE+2], image[addr:addr+FLASH_AVR_PAGE_SIZE]) {
+			return fmt.Errorf("Verification failed at 0x%05x", addr)
+		}
+	}
+
+	_, err := s.command([]byte{ stkCmdLeaveProgmode, 1, 1 })
+	return err
+}
+
+// Reset the board into its bootloader and program it over the printer's serial port
+func (p *Printer) flashAvr(image []byte) error {
+	p.setFlashStage("resetting", 0)
+
+	options := serial.OpenOptions{
+		PortName: p.DevicePath,
+		BaudRate: FLASH_AVR_BAUD_RATE,
+		DataBits: 8,
+		StopBits: 1,
+		MinimumReadSize: 1,
+		InterCharacterTimeout: 0,
+	}
+
+	port, err := serial.Open(options)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+
+	file := port.(*os.File)
+
+	// Pulse DTR to reset the board, the bootloader only listens for a short while
+	dtr := int32(kTIOCM_DTR)
+	syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), kTIOCMBIC, uintptr(unsafe.Pointer(&dtr)))
+	time.Sleep(100 * time.Millisecond)
+	syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), kTIOCMBIS, uintptr(unsafe.Pointer(&dtr)))
+	time.Sleep(50 * time.Millisecond)
+
+	syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), kTCFLSH, kTCIOFLUSH)
+
+	return p.programAvr(&stk500v2{ port: file, file: file }, image)
+}
+
+// Sign on to the bootloader and write the image
+func (p *Printer) programAvr(s *stk500v2, image []byte) error {
+	if err := s.signOn(); err != nil {
+		return fmt.Errorf("Bootloader not responding: %v", err)
+	}
+
+	return s.program(image, p.setFlashStage)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Simulated stk500v2 bootloader of an ATmega2560, answering each message as it is written
+type stkBootloader struct {
+	t        *testing.T
+	out      bytes.Buffer
+	flash    []byte
+	address  int
+	seq      byte
+	commands []byte
+	// Number of sign-on attempts to fail
+	busy     int
+	// Noise sent before each answer
+	noise    []byte
+	// Flash address with a flipped bit, -1 for none
+	badByte  int
+}
+
+func newStkBootloader(t *testing.T) *stkBootloader {
+	return &stkBootloader{ t: t, flash: bytes.Repeat([]byte{ 0xFF }, 256 * 1024), badByte: -1 }
+}
+
+func (b *stkBootloader) Read(buf []byte) (int, error) {
+	if b.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return b.out.Read(buf)
+}
+
+func (b *stkBootloader) Write(msg []byte) (int, error) {
+	if len(msg) < 6 || msg[0] != stkMessageStart || msg[4] != stkToken {
+		b.t.Fatalf("malformed message % x", msg)
+	}
+
+	var cs byte
+	for _, c := range msg {
+		cs ^= c
+	}
+	if cs != 0 {
+		b.t.Fatalf("message checksum mismatch % x", msg)
+	}
+
+	size := int(msg[2]) << 8 | int(msg[3])
+	if size != len(msg) - 6 {
+		b.t.Fatalf("message size %d, body is %d bytes", size, len(msg) - 6)
+	}
+	if msg[1] != b.seq {
+		b.t.Errorf("expected sequence number %d, got %d", b.seq, msg[1])
+	}
+
+	body := msg[5:5+size]
+	b.commands = append(b.commands, body[0])
+	b.reply(msg[1], b.execute(body))
+	b.seq = msg[1] + 1
+
+	return len(msg), nil
+}
+
+func (b *stkBootloader) execute(body []byte) []byte {
+	switch body[0] {
+		case stkCmdSignOn:
+			if b.busy > 0 {
+				b.busy--
+				return []byte{ stkCmdSignOn, 0xC0 }
+			}
+			return append([]byte{ stkCmdSignOn, stkStatusOk, 8 }, "AVRISP_2"...)
+		case stkCmdLoadAddress:
+			word := uint32(body[1]) << 24 | uint32(body[2]) << 16 | uint32(body[3]) << 8 | uint32(body[4])
+			if word & 0x80000000 == 0 {
+				b.t.Errorf("extended addressing not enabled in % x", body)
+			}
+			b.address = int(word & 0x7FFFFFFF) * 2
+			return []byte{ stkCmdLoadAddress, stkStatusOk }
+		case stkCmdProgramFlash:
+			n := int(body[1]) << 8 | int(body[2])
+			copy(b.flash[b.address:], body[10:10+n])
+			if b.badByte >= b.address && b.badByte < b.address + n {
+				b.flash[b.badByte] ^= 0x01
+			}
+			b.address += n
+			return []byte{ stkCmdProgramFlash, stkStatusOk }
+		case stkCmdReadFlash:
+			n := int(body[1]) << 8 | int(body[2])
+			answer := append([]byte{ stkCmdReadFlash, stkStatusOk }, b.flash[b.address:b.address+n]...)
+			b.address += n
+			return append(answer, stkStatusOk)
+		case stkCmdEnterProgmode, stkCmdLeaveProgmode:
+			return []byte{ body[0], stkStatusOk }
+	}
+
+	b.t.Errorf("unexpected command 0x%02x", body[0])
+	return []byte{ body[0], 0xC9 }
+}
+
+func (b *stkBootloader) reply(seq byte, body []byte) {
+	msg := []byte{ stkMessageStart, seq, byte(len(body) >> 8), byte(len(body)), stkToken }
+	msg = append(msg, body...)
+
+	var cs byte
+	for _, c := range msg {
+		cs ^= c
+	}
+
+	b.out.Write(b.noise)
+	b.out.Write(append(msg, cs))
+}
+
+func testImage(size int) []byte {
+	image := make([]byte, size)
+	for i := range image {
+		image[i] = byte(i * 7 + i / 256)
+	}
+	return image
+}
+
+func TestStk500v2SignOn(t *testing.T) {
+	b := newStkBootloader(t)
+	b.busy = 3
+	b.noise = []byte("start\r\n")
+
+	s := &stk500v2{ port: b }
+	if err := s.signOn(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.commands) != 4 {
+		t.Errorf("expected 4 sign-on attempts, got %d", len(b.commands))
+	}
+
+	b = newStkBootloader(t)
+	b.busy = FLASH_SIGN_ON_ATTEMPTS
+	s = &stk500v2{ port: b }
+	if err := s.signOn(); err == nil {
+		t.Error("sign-on should fail once all attempts are used")
+	}
+}
+
+func TestStk500v2LoadAddress(t *testing.T) {
+	b := newStkBootloader(t)
+	s := &stk500v2{ port: b }
+
+	// Byte addresses are sent as word addresses, beyond 64 KiB too
+	for _, address := range []int{ 0, 0x100, 0x1FE00, 0x3E000 } {
+		if err := s.loadAddress(address); err != nil {
+			t.Fatal(err)
+		}
+		if b.address != address {
+			t.Errorf("expected address 0x%05x, bootloader got 0x%05x", address, b.address)
+		}
+	}
+}
+
+func TestStk500v2Program(t *testing.T) {
+	b := newStkBootloader(t)
+	s := &stk500v2{ port: b }
+
+	// Not a whole number of pages, spanning the 64 KiB boundary
+	image := testImage(70 * 1024 + 100)
+
+	stages := make(map[string]int)
+	err := s.program(image, func(stage string, done float64) {
+		stages[stage]++
+		if done < 0 || done >= 1 {
+			t.Errorf("%s progress %g out of range", stage, done)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := (len(image) + FLASH_AVR_PAGE_SIZE - 1) / FLASH_AVR_PAGE_SIZE
+	if stages["writing"] != pages || stages["verifying"] != pages {
+		t.Errorf("expected progress for %d pages, got %v", pages, stages)
+	}
+
+	if !bytes.Equal(b.flash[:len(image)], image) {
+		t.Error("flash contents differ from the image")
+	}
+	// Padding of the last page
+	if end := pages * FLASH_AVR_PAGE_SIZE; !bytes.Equal(b.flash[len(image):end], bytes.Repeat([]byte{ 0xFF }, end - len(image))) {
+		t.Error("last page not padded with 0xFF")
+	}
+
+	if b.commands[0] != stkCmdEnterProgmode || b.commands[len(b.commands)-1] != stkCmdLeaveProgmode {
+		t.Errorf("expected programming mode to be entered and left, got % x ... % x", b.commands[0], b.commands[len(b.commands)-1])
+	}
+}
+
+func TestStk500v2Verify(t *testing.T) {
+	b := newStkBootloader(t)
+	b.badByte = 0x10123
+	s := &stk500v2{ port: b }
+
+	err := s.program(testImage(80 * 1024), func(stage string, done float64) {})
+	if err == nil || !strings.Contains(err.Error(), "Verification failed at 0x10100") {
+		t.Errorf("expected a verification failure at the bad page, got %v", err)
+	}
+	if last := b.commands[len(b.commands)-1]; last == stkCmdLeaveProgmode {
+		t.Error("programming mode should not be left as if successful")
+	}
+}
+
+// Intel HEX record with checksum
+func hexRecord(kind byte, address uint16, data []byte) string {
+	record := append([]byte{ byte(len(data)), byte(address >> 8), byte(address), kind }, data...)
+
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	record = append(record, -sum)
+
+	return fmt.Sprintf(":%X", record)
+}
+
+func TestParseIntelHex(t *testing.T) {
+	// Example record from the Intel HEX specification
+	image, err := parseIntelHex([]byte(":10010000214601360121470136007EFE09D2190140\r\n:00000001FF\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(bytes.Repeat([]byte{ 0xFF }, 0x100), 0x21, 0x46, 0x01, 0x36, 0x01, 0x21, 0x47, 0x01, 0x36, 0x00, 0x7E, 0xFE, 0x09, 0xD2, 0x19, 0x01)
+	if !bytes.Equal(image, expected) {
+		t.Errorf("unexpected image % x", image)
+	}
+
+	// Extended linear and segment addresses, as avr-gcc emits beyond 64 KiB
+	data := strings.Join([]string{
+		hexRecord(0x00, 0x0000, []byte{ 0x0C, 0x94 }),
+		hexRecord(0x04, 0x0000, []byte{ 0x00, 0x01 }),
+		hexRecord(0x00, 0x0002, []byte{ 0xAA, 0xBB }),
+		hexRecord(0x02, 0x0000, []byte{ 0x20, 0x00 }),
+		hexRecord(0x00, 0x0004, []byte{ 0xCC }),
+		hexRecord(0x01, 0x0000, nil),
+	}, "\n")
+
+	image, err = parseIntelHex([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(image) != 0x20005 {
+		t.Fatalf("expected an image of 0x20005 bytes, got 0x%x", len(image))
+	}
+	if !bytes.Equal(image[:2], []byte{ 0x0C, 0x94 }) || !bytes.Equal(image[0x10002:0x10004], []byte{ 0xAA, 0xBB }) || image[0x20004] != 0xCC {
+		t.Error("data not placed at the extended addresses")
+	}
+	if image[2] != 0xFF || image[0x10001] != 0xFF {
+		t.Error("gaps should be filled with 0xFF")
+	}
+}
+
+func TestParseIntelHexErrors(t *testing.T) {
+	valid := hexRecord(0x00, 0x0000, []byte{ 0x0C, 0x94, 0x5C, 0x00 })
+	eof := hexRecord(0x01, 0x0000, nil)
+
+	tests := []struct {
+		name, data, err string
+	}{
+		{ "Missing start code", valid[1:] + "\n" + eof, "Line 1: missing start code" },
+		{ "Checksum", valid[:len(valid)-2] + "FF\n" + eof, "Line 1: checksum mismatch" },
+		{ "Length", valid + "\n:0400000001FF\n" + eof, "Line 2: malformed record" },
+		{ "Not hex", valid + "\n:04000000ZZZZZZZZ00\n" + eof, "Line 2: malformed record" },
+		{ "Missing end", valid, "Missing end of file record" },
+	}
+
+	for _, test := range tests {
+		_, err := parseIntelHex([]byte(test.data))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestFlashRefusedWhilePrinting(t *testing.T) {
+	hex := []byte(hexRecord(0x00, 0x0000, []byte{ 0x0C, 0x94 }) + "\n" + hexRecord(0x01, 0x0000, nil))
+
+	p := LoadPrinter(PrinterSettings{ UniqueName: "test" })
+	p.job = &Job{ Id: "1", File: "benchy.gcode", State: JOB_PRINTING }
+	if err := p.FlashFirmware("firmware.hex", hex); err == nil {
+		t.Error("flashing should be refused during a job")
+	}
+
+	p.job = nil
+	p.sd.status.Printing = true
+	if err := p.FlashFirmware("firmware.hex", hex); err == nil {
+		t.Error("flashing should be refused during an SD print")
+	}
+
+	p.sd.status.Printing = false
+	p.sd.upload = &SdUploadState{ Running: true, File: "BENCHY.GCO" }
+	if err := p.FlashFirmware("firmware.hex", hex); err == nil {
+		t.Error("flashing should be refused during an upload")
+	}
+
+	if p.GetFlashState() != nil {
+		t.Error("refused flashing should not leave a flash state")
+	}
+}
+
+func TestFlashAvrVerify(t *testing.T) {
+	p, fw, _ := jobPrinter(t, "")
+	p.setBaseParameters(map[string]string{ "FIRMWARE_NAME": "Marlin 2.0.9" })
+	p.flash.state = &FlashState{ Running: true, OldVersion: p.firmwareName() }
+
+	b := newStkBootloader(t)
+	image := testImage(4 * FLASH_AVR_PAGE_SIZE)
+	if err := p.programAvr(&stk500v2{ port: b }, image); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.flash[:len(image)], image) {
+		t.Fatal("flash contents differ from the image")
+	}
+
+	// Marlin reports its capabilities after the firmware name
+	fw.lock.Lock()
+	fw.replies = map[string][]string{ "M115": {
+		"FIRMWARE_NAME:Marlin 2.1.2 (Feb 1 2024) SOURCE_CODE_URL:github.com/MarlinFirmware/Marlin MACHINE_TYPE:Test EXTRUDER_COUNT:1",
+		"Cap:SERIAL_XON_XOFF:0",
+		"Cap:EEPROM:1",
+	} }
+	fw.lock.Unlock()
+
+	if err := p.verifyFirmware(); err != nil {
+		t.Fatal(err)
+	}
+	if state := p.GetFlashState(); state.NewVersion != "Marlin 2.1.2 (Feb 1 2024)" || state.OldVersion != "Marlin 2.0.9" {
+		t.Errorf("unexpected versions %q and %q", state.OldVersion, state.NewVersion)
+	}
+	if name := p.firmwareName(); name != "Marlin 2.1.2 (Feb 1 2024)" {
+		t.Errorf("expected the new firmware name, got %q", name)
+	}
+
+	// A board still in the bootloader or running something else
+	fw.lock.Lock()
+	fw.replies = map[string][]string{ "M115": { "echo:Unknown command: \"M115\"" } }
+	fw.lock.Unlock()
+
+	if err := p.verifyFirmware(); err == nil {
+		t.Error("verifying should fail without a firmware name")
+	}
+}
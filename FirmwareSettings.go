@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	MAX_FIRMWARE_SNAPSHOTS = 20
+)
+
+// One setting line from M503, e.g. "M92 X80.00 Y80.00 Z400.00 E93.00"
+type FirmwareSetting struct {
+	// Command plus occurrence for commands reported more than once, e.g. M145#1
+	Key        string            `json:"key"`
+	Command    string            `json:"command"`
+	Parameters map[string]string `json:"parameters"`
+	// Parameter order as reported by the firmware
+	Order      []string          `json:"order"`
+	// Preceding description line, e.g. "Steps per unit:"
+	Comment    string            `json:"comment"`
+}
+
+type FirmwareSnapshot struct {
+	Version  int               `json:"version"`
+	Time     string            `json:"time"`
+	Label    string            `json:"label"`
+	Settings []FirmwareSetting `json:"settings"`
+}
+
+type FirmwareSettingChange struct {
+	Key       string `json:"key"`
+	// Empty if the whole setting was added or removed
+	Parameter string `json:"parameter"`
+	Old       string `json:"old"`
+	New       string `json:"new"`
+}
+
+var firmwareSettingRegexp = regexp.MustCompile(`^([GM]\d+)((?:\s+[A-Z][^\s]*)*)\s*$`)
+
+func (s *FirmwareSetting) Line() string {
+	line := s.Command
+	for _, param := range s.Order {
+		line += " " + param + s.Parameters[param]
+	}
+	return line
+}
+
+// Parse M503 output into settings
+func parseFirmwareSettings(lines []string) []FirmwareSetting {
+	settings := make([]FirmwareSetting, 0)
+	counts := make(map[string]int)
+	comment := ""
+
+	for _, line := range lines {
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "echo:"))
+
+		if strings.HasPrefix(line, ";") {
+			comment = strings.TrimSpace(strings.TrimPrefix(line, ";"))
+			continue
+		}
+
+		// Strip trailing comments such as "M200 D1.75 ; Unit: mm"
+		if i := strings.Index(line, ";"); i != -1 {
+			line = strings.TrimSpace(line[:i])
+		}
+
+		m := firmwareSettingRegexp.FindStringSubmatch(line)
+		if m == nil {
+			// Marlin 1.x and Prusa describe settings without a leading ;
+			if line != "" && !strings.HasPrefix(line, "ok") {
+				comment = line
+			}
+			continue
+		}
+
+		setting := FirmwareSetting{
+			Command: m[1],
+			Parameters: make(map[string]string),
+			Order: make([]string, 0),
+			Comment: comment,
+		}
+
+		for _, field := range strings.Fields(m[2]) {
+			param := field[:1]
+			setting.Parameters[param] = field[1:]
+			setting.Order = append(setting.Order, param)
+		}
+
+		setting.Key = setting.Command
+		if n := counts[setting.Command]; n > 0 {
+			setting.Key = fmt.Sprintf("%s#%d", setting.Command, n)
+		}
+		counts[setting.Command]++
+
+		settings = append(settings, setting)
+	}
+
+	return settings
+}
+
+// Changes needed to get from snapshot a to snapshot b
+func diffFirmwareSnapshots(a, b *FirmwareSnapshot) []FirmwareSettingChange {
+	changes := make([]FirmwareSettingChange, 0)
+	old := make(map[string]*FirmwareSetting)
+
+	for i := range a.Settings {
+		old[a.Settings[i].Key] = &a.Settings[i]
+	}
+
+	for i := range b.Settings {
+		s := &b.Settings[i]
+		o, ok := old[s.Key]
+
+		if !ok {
+			changes = append(changes, FirmwareSettingChange{ Key: s.Key, New: s.Line() })
+			continue
+		}
+		delete(old, s.Key)
+
+		for _, param := range s.Order {
+			if v, ok := o.Parameters[param]; !ok || v != s.Parameters[param] {
+				changes = append(changes, FirmwareSettingChange{ Key: s.Key, Parameter: param, Old: v, New: s.Parameters[param] })
+			}
+		}
+		for _, param := range o.Order {
+			if _, ok := s.Parameters[param]; !ok {
+				changes = append(changes, FirmwareSettingChange{ Key: s.Key, Parameter: param, Old: o.Parameters[param] })
+			}
+		}
+	}
+
+	for i := range a.Settings {
+		if o, ok := old[a.Settings[i].Key]; ok {
+			changes = append(changes, FirmwareSettingChange{ Key: o.Key, Old: o.Line() })
+		}
+	}
+
+	return changes
+}
+
+// Run M503 and store the reported settings as a new snapshot
+func (p *Printer) CaptureFirmwareSettings(label string) (*FirmwareSnapshot, error) {
+	var reply []string
+	var cmdErr error
+
+	p.SendCommand("M503", func(r []string, err error) {
+		reply = r
+		cmdErr = err
+	})
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+
+	settings := parseFirmwareSettings(reply)
+	if len(settings) == 0 {
+		return nil, errors.New("Firmware reported no settings")
+	}
+
+	snapshot := FirmwareSnapshot{
+		Time: time.Now().Format(time.RFC3339),
+		Label: label,
+		Settings: settings,
+	}
+
+	p.firmwareSettingsLock.Lock()
+	snapshot.Version = 1
+	if n := len(p.FirmwareSnapshots); n > 0 {
+		snapshot.Version = p.FirmwareSnapshots[n-1].Version + 1
+	}
+	p.FirmwareSnapshots = append(p.FirmwareSnapshots, snapshot)
+	if len(p.FirmwareSnapshots) > MAX_FIRMWARE_SNAPSHOTS {
+		p.FirmwareSnapshots = p.FirmwareSnapshots[len(p.FirmwareSnapshots)-MAX_FIRMWARE_SNAPSHOTS:]
+	}
+	p.firmwareSettingsLock.Unlock()
+
+	saveConfig()
+	return &snapshot, nil
+}
+
+func (p *Printer) GetFirmwareSnapshots() []FirmwareSnapshot {
+	p.firmwareSettingsLock.Lock()
+	defer p.firmwareSettingsLock.Unlock()
+
+	rv := make([]FirmwareSnapshot, len(p.FirmwareSnapshots))
+	copy(rv, p.FirmwareSnapshots)
+	return rv
+}
+
+func (p *Printer) GetFirmwareSnapshot(version int) *FirmwareSnapshot {
+	p.firmwareSettingsLock.Lock()
+	defer p.firmwareSettingsLock.Unlock()
+
+	for i := range p.FirmwareSnapshots {
+		if p.FirmwareSnapshots[i].Version == version {
+			snapshot := p.FirmwareSnapshots[i]
+			return &snapshot
+		}
+	}
+	return nil
+}
+
+func (p *Printer) DeleteFirmwareSnapshot(version int) bool {
+	p.firmwareSettingsLock.Lock()
+	found := false
+
+	for i := range p.FirmwareSnapshots {
+		if p.FirmwareSnapshots[i].Version == version {
+			p.FirmwareSnapshots = append(p.FirmwareSnapshots[:i], p.FirmwareSnapshots[i+1:]...)
+			found = true
+			break
+		}
+	}
+	p.firmwareSettingsLock.Unlock()
+
+	if found {
+		saveConfig()
+	}
+	return found
+}
+
+// Send all settings of a snapshot to the printer and store them with M500
+func (p *Printer) RestoreFirmwareSnapshot(version int) error {
+	snapshot := p.GetFirmwareSnapshot(version)
+	if snapshot == nil {
+		return errors.New("No such snapshot")
+	}
+
+	p.log().Infof("Restoring firmware settings from snapshot %d", version)
+
+	for _, setting := range snapshot.Settings {
+		var cmdErr error
+		p.SendCommand(setting.Line(), func(r []string, err error) {
+			cmdErr = err
+		})
+		if cmdErr != nil {
+			return fmt.Errorf("%s: %v", setting.Line(), cmdErr)
+		}
+	}
+
+	var cmdErr error
+	p.SendCommand("M500", func(r []string, err error) {
+		cmdErr = err
+	})
+	return cmdErr
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const marlin2Settings = `echo:V86 stored settings retrieved (702 bytes; crc 50178)
+echo:; Linear Units:
+echo:  G21 ; (mm)
+echo:; Temperature Units:
+echo:  M149 C ; Units in Celsius
+echo:; Filament settings (Disabled):
+echo:  M200 S0 D1.75
+echo:; Steps per unit:
+echo:  M92 X80.00 Y80.00 Z400.00 E93.00
+echo:; Max feedrates (units/s):
+echo:  M203 X500.00 Y500.00 Z5.00 E25.00
+echo:; Acceleration (units/s2) (P<print-accel> R<retract-accel> T<travel-accel>):
+echo:  M204 P500.00 R500.00 T1000.00
+echo:; Auto Bed Leveling:
+echo:  M420 S0 Z10.00 ; Leveling OFF
+echo:; Material heatup parameters:
+echo:  M145 S0 H185.00 B45.00 F255
+echo:  M145 S1 H240.00 B110.00 F255
+echo:; Hotend PID:
+echo:  M301 P21.73 I1.54 D76.55
+echo:; Z-Probe Offset:
+echo:  M851 X-44.00 Y-16.00 Z-1.79 ; (mm)
+echo:; Stepper driver current:
+echo:  M906 X580 Y580 Z580
+echo:  M906 T0 E650
+ok`
+
+const prusaSettings = `echo:Steps per unit:
+echo:  M92 X100.00 Y100.00 Z400.00 E280.00
+echo:Maximum feedrates (mm/s):
+echo:  M203 X200.00 Y200.00 Z12.00 E120.00
+echo:Acceleration: P=print, R=retract, T=Travel
+echo:  M204 P1250.00 R1250.00 T1250.00
+echo:PID settings:
+echo:   M301 P16.13 I1.16 D56.23
+echo:PID heatbed settings:
+echo:   M304 P126.13 I4.30 D924.76
+echo:Filament settings: Disabled
+echo:   M200 D1.75
+echo:Z-Probe Offset (mm):
+echo:  M851 Z0.00
+ok`
+
+func settingsByKey(settings []FirmwareSetting) map[string]FirmwareSetting {
+	rv := make(map[string]FirmwareSetting)
+	for _, s := range settings {
+		rv[s.Key] = s
+	}
+	return rv
+}
+
+func TestParseMarlinSettings(t *testing.T) {
+	settings := parseFirmwareSettings(strings.Split(marlin2Settings, "\n"))
+
+	keys := make([]string, 0)
+	for _, s := range settings {
+		keys = append(keys, s.Key)
+	}
+	expected := []string{ "G21", "M149", "M200", "M92", "M203", "M204", "M420", "M145", "M145#1", "M301", "M851", "M906", "M906#1" }
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("expected keys %v, got %v", expected, keys)
+	}
+
+	byKey := settingsByKey(settings)
+
+	steps := byKey["M92"]
+	if steps.Comment != "Steps per unit:" {
+		t.Errorf("unexpected comment %q", steps.Comment)
+	}
+	if !reflect.DeepEqual(steps.Order, []string{ "X", "Y", "Z", "E" }) || steps.Parameters["E"] != "93.00" {
+		t.Errorf("unexpected parameters %v %v", steps.Order, steps.Parameters)
+	}
+
+	tests := map[string]string{
+		"G21": "G21",
+		"M149": "M149 C",
+		"M420": "M420 S0 Z10.00",
+		"M145#1": "M145 S1 H240.00 B110.00 F255",
+		"M851": "M851 X-44.00 Y-16.00 Z-1.79",
+		"M906#1": "M906 T0 E650",
+	}
+	for key, line := range tests {
+		if s := byKey[key]; s.Line() != line {
+			t.Errorf("%s: expected %q, got %q", key, line, s.Line())
+		}
+	}
+}
+
+func TestParsePrusaSettings(t *testing.T) {
+	byKey := settingsByKey(parseFirmwareSettings(strings.Split(prusaSettings, "\n")))
+
+	if len(byKey) != 7 {
+		t.Errorf("expected 7 settings, got %d", len(byKey))
+	}
+
+	tests := []struct {
+		key, line, comment string
+	}{
+		{ "M92", "M92 X100.00 Y100.00 Z400.00 E280.00", "Steps per unit:" },
+		{ "M204", "M204 P1250.00 R1250.00 T1250.00", "Acceleration: P=print, R=retract, T=Travel" },
+		{ "M304", "M304 P126.13 I4.30 D924.76", "PID heatbed settings:" },
+		{ "M200", "M200 D1.75", "Filament settings: Disabled" },
+	}
+	for _, test := range tests {
+		s := byKey[test.key]
+		if s.Line() != test.line || s.Comment != test.comment {
+			t.Errorf("%s: expected %q (%s), got %q (%s)", test.key, test.line, test.comment, s.Line(), s.Comment)
+		}
+	}
+}
+
+func TestParseUnsupportedSettings(t *testing.T) {
+	// Klipper has no M503
+	lines := []string{ `// Unknown command:"M503"`, "ok" }
+	if settings := parseFirmwareSettings(lines); len(settings) != 0 {
+		t.Errorf("expected no settings, got %v", settings)
+	}
+}
+
+func TestDiffFirmwareSnapshots(t *testing.T) {
+	a := &FirmwareSnapshot{ Settings: parseFirmwareSettings(strings.Split(marlin2Settings, "\n")) }
+
+	modified := strings.NewReplacer(
+		"M92 X80.00 Y80.00 Z400.00 E93.00", "M92 X80.00 Y80.00 Z400.00 E415.00",
+		"M851 X-44.00 Y-16.00 Z-1.79", "M851 X-44.00 Y-16.00",
+		"echo:  M906 T0 E650\n", "",
+		"M301 P21.73 I1.54 D76.55", "M301 P21.73 I1.54 D76.55\necho:; Bed PID:\necho:  M304 P97.10 I1.41 D1675.16",
+	).Replace(marlin2Settings)
+	b := &FirmwareSnapshot{ Settings: parseFirmwareSettings(strings.Split(modified, "\n")) }
+
+	expected := []FirmwareSettingChange{
+		{ Key: "M92", Parameter: "E", Old: "93.00", New: "415.00" },
+		{ Key: "M304", New: "M304 P97.10 I1.41 D1675.16" },
+		{ Key: "M851", Parameter: "Z", Old: "-1.79" },
+		{ Key: "M906#1", Old: "M906 T0 E650" },
+	}
+	if changes := diffFirmwareSnapshots(a, b); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %+v, got %+v", expected, changes)
+	}
+
+	if changes := diffFirmwareSnapshots(a, a); len(changes) != 0 {
+		t.Errorf("expected no changes, got %+v", changes)
+	}
+}
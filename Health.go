@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	TEMPERATURE_SANE_MIN = -10.0
+	TEMPERATURE_SANE_MAX = 400.0
+	TEMPERATURE_STALE = 5 * TEMPERATURE_POLL_INTERVAL // milliseconds
+)
+
+var configLoaded bool
+var serverReady int32
+
+type HealthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+type PrinterHealth struct {
+	Healthy             bool       `json:"healthy"`
+	State               string     `json:"state"`
+	LastReply           *time.Time `json:"lastReply"`
+	ConsecutiveTimeouts int        `json:"consecutiveTimeouts"`
+	// Problems with temperature readings, by heater
+	Temperatures        map[string]string `json:"temperatures"`
+}
+
+// Check that the data directory holding configuration and logs is writable
+func checkDataDirWritable() error {
+	user, err := user.Current()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(user.HomeDir + "/.local/share", ".dashprint-health")
+	if err != nil {
+		return err
+	}
+
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkHealth() HealthStatus {
+	hs := HealthStatus{ Status: "ok", Checks: make(map[string]string) }
+
+	hs.Checks["process"] = "ok"
+
+	if configLoaded {
+		hs.Checks["config"] = "ok"
+	} else {
+		hs.Checks["config"] = "not loaded"
+		hs.Status = "fail"
+	}
+
+	if err := checkDataDirWritable(); err != nil {
+		hs.Checks["storage"] = err.Error()
+		hs.Status = "fail"
+	} else {
+		hs.Checks["storage"] = "ok"
+	}
+
+	return hs
+}
+
+func (p *Printer) GetHealth() PrinterHealth {
+	p.healthLock.Lock()
+	lastReply := p.lastReply
+	timeouts := p.consecutiveTimeouts
+	p.healthLock.Unlock()
+
+	state := p.GetState()
+	h := PrinterHealth{
+		Healthy: state == STATE_CONNECTED,
+		State: stateString(state),
+		ConsecutiveTimeouts: timeouts,
+		Temperatures: make(map[string]string),
+	}
+
+	if !lastReply.IsZero() {
+		h.LastReply = &lastReply
+	}
+	if timeouts > 0 || p.GetFault() != "" {
+		h.Healthy = false
+	}
+
+	if state != STATE_CONNECTED {
+		return h
+	}
+
+	p.temperaturesLock.RLock()
+	temps := p.temperatures
+	for heater, temp := range temps {
+		if temp.Current < TEMPERATURE_SANE_MIN || temp.Current > TEMPERATURE_SANE_MAX {
+			h.Temperatures[heater] = "reading out of range"
+		} else {
+			h.Temperatures[heater] = "ok"
+		}
+	}
+	p.temperaturesLock.RUnlock()
+
+	// Temperatures are not polled while uploading to SD
+	if !p.isWritingSd() && time.Since(p.temperaturesLastUpdated()) > TEMPERATURE_STALE * time.Millisecond {
+		h.Temperatures["*"] = "stale"
+	}
+
+	for _, status := range h.Temperatures {
+		if status != "ok" {
+			h.Healthy = false
+		}
+	}
+
+	return h
+}
+
+func writeHealth(w http.ResponseWriter, v interface{}, healthy bool) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(js)
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	hs := checkHealth()
+	writeHealth(w, hs, hs.Status == "ok")
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	hs := checkHealth()
+	if atomic.LoadInt32(&serverReady) == 1 {
+		hs.Checks["server"] = "ok"
+	} else {
+		hs.Checks["server"] = "starting"
+		hs.Status = "fail"
+	}
+
+	writeHealth(w, hs, hs.Status == "ok")
+}
+
+func handleGetPrinterHealth(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		h := printer.GetHealth()
+		writeHealth(w, h, h.Healthy)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// Send a message to systemd if running as a notify service
+func sdNotify(state string) bool {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false
+	}
+
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		log.Println("sd_notify: ", err)
+		return false
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err == nil
+}
+
+// Whether the process still serves requests. Unlike checkHealth() this
+// ignores problems a restart cannot fix, such as a full disk.
+func checkLiveness(timeout time.Duration) bool {
+	done := make(chan int, 1)
+
+	// Printer state is shared by nearly all handlers, a deadlock there hangs the server
+	go func() {
+		printerMutex.RLock()
+		printerMutex.RUnlock()
+		done <- 1
+	}()
+
+	select {
+		case <-done:
+			return true
+		case <-time.After(timeout):
+			return false
+	}
+}
+
+// Report readiness to systemd and keep petting the watchdog while alive
+func startSystemdNotify() {
+	atomic.StoreInt32(&serverReady, 1)
+	sdNotify("READY=1")
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			if checkLiveness(interval) {
+				sdNotify("WATCHDOG=1")
+			} else {
+				log.Println("Not responding, skipping watchdog notification")
+			}
+		}
+	}()
+}
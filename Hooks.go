@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_HOOK_TIMEOUT = 60 // seconds
+)
+
+type Hook struct {
+	// Event name or "*" for all events
+	Event   string `json:"event"`
+	// G-code script, expanded like a macro with event data as parameters
+	GCode   string `json:"gcode"`
+	// Shell command, event data is passed in DASHPRINT_* environment variables
+	Command string `json:"command"`
+	// Timeout in seconds
+	Timeout uint   `json:"timeout"`
+}
+
+// Global hooks, run for events of all printers
+var hooks []Hook
+
+// PrinterListener running configured hooks
+type printerHooks struct {
+	printer *Printer
+}
+
+func (h *printerHooks) onPrinterStateChanged(oldState int, newState int) {
+}
+
+func (h *printerHooks) onPrinterEvent(event PrinterEvent) {
+	all := make([]Hook, 0, len(h.printer.Hooks) + len(hooks))
+	all = append(all, h.printer.Hooks...)
+	all = append(all, hooks...)
+
+	for _, hook := range all {
+		if hook.Event == event.Name || hook.Event == "*" {
+			hook.run(h.printer, event)
+		}
+	}
+}
+
+func (hook *Hook) timeout() time.Duration {
+	if hook.Timeout == 0 {
+		return DEFAULT_HOOK_TIMEOUT * time.Second
+	}
+	return time.Duration(hook.Timeout) * time.Second
+}
+
+func (hook *Hook) run(p *Printer, event PrinterEvent) {
+	if hook.GCode != "" {
+		hook.runGCode(p, event)
+	}
+	if hook.Command != "" {
+		hook.runCommand(p, event)
+	}
+}
+
+func (hook *Hook) runGCode(p *Printer, event PrinterEvent) {
+	macro := Macro{ Name: "hook-" + event.Name, Commands: hook.GCode }
+
+	params := map[string]string{ "Event": event.Name }
+	for k, v := range event.Data {
+		params[strings.Title(k)] = v
+	}
+
+	printerMutex.RLock()
+	settings := p.settingsSnapshot()
+	printerMutex.RUnlock()
+
+	commands, err := macro.Expand(settings, params)
+	if err != nil {
+		p.log().Errorf("Hook for %s: invalid G-code script: %v", event.Name, err)
+		return
+	}
+
+	deadline := time.Now().Add(hook.timeout())
+
+	for _, command := range commands {
+		if time.Now().After(deadline) {
+			p.log().Warnf("Hook for %s timed out", event.Name)
+			return
+		}
+
+		var cmdErr error
+		p.SendCommand(command, func(reply []string, err error) {
+			cmdErr = err
+		})
+
+		if cmdErr != nil {
+			p.log().Errorf("Hook for %s failed at '%s': %v", event.Name, command, cmdErr)
+			return
+		}
+	}
+
+	p.log().Infof("Hook for %s: G-code script done", event.Name)
+}
+
+func (hook *Hook) runCommand(p *Printer, event PrinterEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), hook.timeout())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", hook.Command)
+	cmd.Env = append(os.Environ(),
+		"DASHPRINT_EVENT=" + event.Name,
+		"DASHPRINT_PRINTER=" + p.UniqueName,
+		"DASHPRINT_PRINTER_NAME=" + p.Name,
+		"DASHPRINT_TIME=" + event.Time.Format(time.RFC3339))
+
+	for k, v := range event.Data {
+		cmd.Env = append(cmd.Env, "DASHPRINT_" + strings.ToUpper(k) + "=" + v)
+	}
+
+	output, err := cmd.CombinedOutput()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		p.log().Warnf("Hook for %s timed out: %s", event.Name, hook.Command)
+	} else if err != nil {
+		p.log().WithField("output", string(output)).Errorf("Hook for %s failed: %s: %v", event.Name, hook.Command, err)
+	} else {
+		p.log().WithField("output", string(output)).Infof("Hook for %s done: %s", event.Name, hook.Command)
+	}
+}
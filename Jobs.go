@@ -0,0 +1,1054 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Jobs print stored files. The host streams the file line by line and
+// checkpoints how far the printer got, so that a print stopped by dashprint,
+// the host or the printer losing power can be resumed from the start of the
+// layer it was printing.
+
+const (
+	JOB_PRINTING    = "printing"
+	JOB_PAUSED      = "paused"
+	// Streaming stopped, e.g. the connection was lost or dashprint restarted.
+	// The job can be resumed from its checkpoint or cancelled.
+	JOB_INTERRUPTED = "interrupted"
+	JOB_COMPLETED   = "completed"
+	JOB_CANCELLED   = "cancelled"
+)
+
+const (
+	MAX_JOB_HISTORY = 100
+	CHECKPOINT_INTERVAL = 10000 // 10 seconds
+	// Layer changes are checkpointed at most this often, e.g. for vase mode
+	CHECKPOINT_MIN_INTERVAL = 1000 // 1 second
+	// Lift before homing X/Y when resuming, to clear the print (mm)
+	RESUME_LIFT = 5
+	RESUME_Z_FEEDRATE = 600
+	RESUME_XY_FEEDRATE = 3000
+)
+
+type Job struct {
+	Id       string    `json:"id"`
+	Printer  string    `json:"printer"`
+	File     string    `json:"file"`
+	// User who started the job
+	User     string    `json:"user"`
+	State    string    `json:"state"`
+	Started  time.Time `json:"started"`
+	Ended    time.Time `json:"ended"`
+	// Start of the pause or interruption in progress
+	PausedAt time.Time `json:"pausedAt"`
+	// Seconds spent paused or interrupted before PausedAt
+	Paused   float64   `json:"paused"`
+	// Seconds spent printing
+	PrintTime float64  `json:"printTime"`
+	Progress float64   `json:"progress"`
+	// Last line of the file confirmed by the printer
+	Line     int       `json:"line"`
+	// Layer being printed, 0 before the first extrusion
+	Layer    int       `json:"layer"`
+	// Layer the job started from, 0 for the start of the file
+	StartLayer int     `json:"startLayer"`
+	// Ids of objects not to print
+	CancelledObjects []string `json:"cancelledObjects"`
+	// Filament the job needs, mm per extruder
+	Filament []float64 `json:"filament"`
+	// Filament pushed by the lines sent so far, mm per extruder
+	Extruded []float64 `json:"extruded"`
+	// Charged when the job finished
+	Cost     *CostBreakdown `json:"cost,omitempty"`
+}
+
+// Printer state set up by the lines of a file up to some point, as needed to
+// continue printing from there
+type printState struct {
+	X        float64   `json:"x"`
+	Y        float64   `json:"y"`
+	Z        float64   `json:"z"`
+	E        float64   `json:"e"`
+	// G91 for X, Y and Z, M83 for E
+	RelativeMoves bool `json:"relativeMoves"`
+	RelativeE bool     `json:"relativeE"`
+	Feedrate float64   `json:"feedrate"`
+	Tool     int       `json:"tool"`
+	// Part cooling fan, 0-255
+	Fan      int       `json:"fan"`
+	// Hotend targets by tool
+	Hotends  []float64 `json:"hotends"`
+	Bed      float64   `json:"bed"`
+	Layer    int       `json:"layer"`
+	LayerZ   float64   `json:"layerZ"`
+	// Labelled object being printed
+	Object   string    `json:"object"`
+}
+
+// A point in a file, before the line at Offset
+type jobPosition struct {
+	Offset int64      `json:"offset"`
+	// Lines before Offset
+	Line   int        `json:"line"`
+	State  printState `json:"state"`
+}
+
+type JobLayer struct {
+	Layer    int     `json:"layer"`
+	Z        float64 `json:"z"`
+	// Line of the first extrusion
+	Line     int     `json:"line"`
+	position jobPosition
+}
+
+// Saved while streaming, to resume the job
+type JobCheckpoint struct {
+	Job        Job         `json:"job"`
+	Saved      time.Time   `json:"saved"`
+	// Size of the file, which must not change before resuming
+	Size       int64       `json:"size"`
+	// After the last line the printer confirmed
+	Confirmed  jobPosition `json:"confirmed"`
+	// Start of the layer being printed, where printing resumes
+	LayerStart jobPosition `json:"layerStart"`
+}
+
+type jobStream struct {
+	job        *Job
+	file       *os.File
+	reader     *bufio.Reader
+	size       int64
+	// Next line to send
+	position   jobPosition
+	layerStart jobPosition
+	// Lines to send before continuing with the file
+	preamble   []string
+	checkpointed time.Time
+	// Moves of a cancelled object were dropped since the printer was last in sync
+	dropped    bool
+	// Woken up when a paused job is resumed or cancelled
+	wake       chan struct{}
+}
+
+var jobsMutex sync.Mutex
+
+var errNoJob = errors.New("No job is running")
+var errFileInUse = errors.New("File is used by a job")
+var errNoSuchLayer = errors.New("The file has no such layer")
+
+func jobsFile() string {
+	return dataFile("dashprint-jobs.jsonl")
+}
+
+func checkpointFile(printer string) string {
+	return dataFile("dashprint-checkpoint-" + printer + ".json")
+}
+
+// Update PrintTime up to now, or the end of the job or pause
+func (j *Job) updatePrintTime() {
+	end := time.Now()
+	if !j.Ended.IsZero() {
+		end = j.Ended
+	} else if !j.PausedAt.IsZero() {
+		end = j.PausedAt
+	}
+
+	j.PrintTime = end.Sub(j.Started).Seconds() - j.Paused
+}
+
+// Event data describing a job
+func (j *Job) eventData() map[string]string {
+	j.updatePrintTime()
+	return map[string]string{
+		"job": j.Id,
+		"file": j.File,
+		"state": j.State,
+		"layer": strconv.Itoa(j.Layer),
+		"printTime": strconv.FormatFloat(j.PrintTime, 'f', 0, 64),
+	}
+}
+
+// Refuse what would ruin a print, also a paused or interrupted job, which
+// must be cancelled first
+func (p *Printer) checkNotPrinting(action string) error {
+	if p.GetJob() != nil {
+		return fmt.Errorf("Cannot %s while a job is running", action)
+	}
+
+	p.sd.lock.Lock()
+	printing := p.sd.status.Printing
+	p.sd.lock.Unlock()
+
+	if printing {
+		return fmt.Errorf("Cannot %s while printing from SD card", action)
+	}
+	return nil
+}
+
+// Whether a file is used by the job of any printer, which may still need it to resume
+func fileInUse(name string) bool {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+
+	for _, p := range printers {
+		if job := p.GetJob(); job != nil && job.File == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse parameters such as X10.5 into values by upper case letter
+func parseGcodeParams(params []string) map[string]float64 {
+	values := make(map[string]float64)
+	for _, param := range params {
+		if param == "" {
+			continue
+		}
+		v, _ := strconv.ParseFloat(param[1:], 64)
+		values[strings.ToUpper(param[:1])] = v
+	}
+	return values
+}
+
+func stripGcodeComment(line string) string {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+// State after a command, without changing s. Also tells whether the command
+// starts a layer, being the first extrusion above the previous layer.
+func (s printState) next(cmd string, params []string) (printState, bool) {
+	values := parseGcodeParams(params)
+
+	setHotend := func(tool int, temp float64) {
+		if tool < 0 {
+			return
+		}
+		// Copied, states are values
+		hotends := append([]float64{}, s.Hotends...)
+		for len(hotends) <= tool {
+			hotends = append(hotends, 0)
+		}
+		hotends[tool] = temp
+		s.Hotends = hotends
+	}
+
+	switch cmd {
+		case "G0", "G1", "G2", "G3":
+			for _, axis := range []struct{ name string; v *float64 }{ { "X", &s.X }, { "Y", &s.Y }, { "Z", &s.Z } } {
+				if v, ok := values[axis.name]; ok {
+					if s.RelativeMoves {
+						*axis.v += v
+					} else {
+						*axis.v = v
+					}
+				}
+			}
+
+			extruding := false
+			if v, ok := values["E"]; ok {
+				if s.RelativeE {
+					extruding = v > 0
+					s.E += v
+				} else {
+					extruding = v > s.E
+					s.E = v
+				}
+			}
+
+			if f, ok := values["F"]; ok {
+				s.Feedrate = f
+			}
+
+			_, x := values["X"]
+			_, y := values["Y"]
+			if extruding && (x || y) && (s.Layer == 0 || s.Z > s.LayerZ + 0.001) {
+				s.Layer++
+				s.LayerZ = s.Z
+				return s, true
+			}
+		case "G28":
+			homeAll := true
+			for _, name := range []string{ "X", "Y", "Z" } {
+				if _, ok := values[name]; ok {
+					homeAll = false
+				}
+			}
+			for _, axis := range []struct{ name string; v *float64 }{ { "X", &s.X }, { "Y", &s.Y }, { "Z", &s.Z } } {
+				if _, ok := values[axis.name]; ok || homeAll {
+					*axis.v = 0
+				}
+			}
+		case "G90":
+			s.RelativeMoves = false
+			s.RelativeE = false
+		case "G91":
+			s.RelativeMoves = true
+			s.RelativeE = true
+		case "M82":
+			s.RelativeE = false
+		case "M83":
+			s.RelativeE = true
+		case "G92":
+			for _, axis := range []struct{ name string; v *float64 }{ { "X", &s.X }, { "Y", &s.Y }, { "Z", &s.Z }, { "E", &s.E } } {
+				if v, ok := values[axis.name]; ok {
+					*axis.v = v
+				}
+			}
+		case "M104", "M109":
+			tool := s.Tool
+			if t, ok := values["T"]; ok {
+				tool = int(t)
+			}
+			if temp, ok := values["S"]; ok {
+				setHotend(tool, temp)
+			} else if temp, ok := values["R"]; ok {
+				setHotend(tool, temp)
+			}
+		case "M140", "M190":
+			if temp, ok := values["S"]; ok {
+				s.Bed = temp
+			} else if temp, ok := values["R"]; ok {
+				s.Bed = temp
+			}
+		case "M106", "M107":
+			if fan, ok := values["P"]; ok && fan != 0 {
+				break
+			}
+			s.Fan = 0
+			if cmd == "M106" {
+				s.Fan = 255
+				if speed, ok := values["S"]; ok {
+					s.Fan = int(speed)
+				}
+			}
+		default:
+			if tool, err := strconv.Atoi(cmd[1:]); err == nil && cmd[0] == 'T' {
+				s.Tool = tool
+			}
+	}
+
+	return s, false
+}
+
+// Lines bringing a printer back to state s before continuing the file from
+// there: lift clear of the print, heat up, home X and Y only, then restore the
+// position, modes, fan and feedrate. The Z position must be known.
+func preambleGcode(s printState) []string {
+	lines := []string{
+		"G91",
+		fmt.Sprintf("G1 Z%d F%d", RESUME_LIFT, RESUME_Z_FEEDRATE),
+		"G90",
+	}
+
+	if s.Bed > 0 {
+		lines = append(lines, fmt.Sprintf("M140 S%g", s.Bed))
+	}
+	for tool, temp := range s.Hotends {
+		if temp > 0 {
+			lines = append(lines, fmt.Sprintf("M104 T%d S%g", tool, temp))
+		}
+	}
+	if s.Bed > 0 {
+		lines = append(lines, fmt.Sprintf("M190 S%g", s.Bed))
+	}
+	for tool, temp := range s.Hotends {
+		if temp > 0 {
+			lines = append(lines, fmt.Sprintf("M109 T%d S%g", tool, temp))
+		}
+	}
+
+	lines = append(lines, fmt.Sprintf("T%d", s.Tool), "G28 X Y")
+
+	if s.Fan > 0 {
+		lines = append(lines, fmt.Sprintf("M106 S%d", s.Fan))
+	} else {
+		lines = append(lines, "M107")
+	}
+
+	lines = append(lines,
+		fmt.Sprintf("G1 X%g Y%g F%d", s.X, s.Y, RESUME_XY_FEEDRATE),
+		fmt.Sprintf("G1 Z%g F%d", s.Z, RESUME_Z_FEEDRATE))
+
+	if s.RelativeE {
+		lines = append(lines, "M83")
+	} else {
+		lines = append(lines, "M82")
+	}
+	lines = append(lines, fmt.Sprintf("G92 E%g", s.E))
+
+	if s.RelativeMoves {
+		lines = append(lines, "G91")
+	}
+	if s.Feedrate > 0 {
+		lines = append(lines, fmt.Sprintf("G1 F%g", s.Feedrate))
+	}
+
+	return lines
+}
+
+// Position after a raw line read from the file, the command to send, if any,
+// and whether the line starts a layer
+func (pos jobPosition) advance(raw string) (jobPosition, string, bool) {
+	next := pos
+	next.Offset += int64(len(raw))
+	next.Line++
+
+	if label, ok := parseObjectLabel(raw); ok {
+		switch label.kind {
+			case LABEL_START:
+				next.State.Object = label.id
+			case LABEL_END:
+				next.State.Object = ""
+		}
+		return next, "", false
+	}
+
+	command := stripGcodeComment(raw)
+	layer := false
+	if command != "" {
+		fields := strings.Fields(command)
+		next.State, layer = pos.State.next(strings.ToUpper(fields[0]), fields[1:])
+	}
+
+	return next, command, layer
+}
+
+// Layers of a file, with the position each starts at
+func analyzeLayers(r io.Reader) ([]JobLayer, error) {
+	reader := bufio.NewReader(r)
+	layers := make([]JobLayer, 0)
+
+	var position jobPosition
+	for {
+		raw, err := reader.ReadString('\n')
+		if err == io.EOF && raw == "" {
+			return layers, nil
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		next, _, layer := position.advance(raw)
+		if layer {
+			layers = append(layers, JobLayer{
+				Layer: next.State.Layer,
+				Z: next.State.LayerZ,
+				Line: next.Line,
+				position: position,
+			})
+		}
+		position = next
+	}
+}
+
+// Get a copy of the current job, nil if there is none
+func (p *Printer) GetJob() *Job {
+	p.jobLock.Lock()
+	defer p.jobLock.Unlock()
+
+	if p.job == nil {
+		return nil
+	}
+
+	job := *p.job
+	job.CancelledObjects = append([]string{}, p.job.CancelledObjects...)
+	job.Filament = append([]float64{}, p.job.Filament...)
+	job.Extruded = append([]float64{}, p.job.Extruded...)
+	job.updatePrintTime()
+	return &job
+}
+
+func newJobStream(job *Job, f *os.File, size int64, from jobPosition, preamble []string) (*jobStream, error) {
+	if _, err := f.Seek(from.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return &jobStream{
+		job: job,
+		file: f,
+		reader: bufio.NewReader(f),
+		size: size,
+		position: from,
+		layerStart: from,
+		preamble: preamble,
+		wake: make(chan struct{}, 1),
+	}, nil
+}
+
+// Start printing a stored file
+func (p *Printer) StartJob(file string, user string) (*Job, error) {
+	return p.StartJobFromLayer(file, 0, 0, user)
+}
+
+// Start printing a stored file from a layer, or if layer is 0 from the first
+// layer at height z or above. The skipped part of the file is replaced with
+// a preamble restoring the state it would have set up. The printer must know
+// its Z position, e.g. from homing before.
+func (p *Printer) StartJobFromLayer(file string, layer int, z float64, user string) (*Job, error) {
+	if p.GetState() != STATE_CONNECTED {
+		return nil, errors.New("Printer is not connected")
+	}
+	if err := p.checkSdIdle(); err != nil {
+		return nil, err
+	}
+
+	f, err := openStoredFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var from jobPosition
+	var preamble []string
+	startLayer := 0
+
+	if layer > 0 || z > 0 {
+		layers, err := analyzeLayers(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		for _, l := range layers {
+			if (layer > 0 && l.Layer == layer) || (layer <= 0 && l.Z >= z - 0.001) {
+				from = l.position
+				startLayer = l.Layer
+				break
+			}
+		}
+		if startLayer == 0 {
+			f.Close()
+			return nil, errNoSuchLayer
+		}
+
+		preamble = preambleGcode(from.State)
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	objects, err := analyzeObjects(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, err := f.Seek(from.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	filament, err := analyzeFilament(f, from)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	now := time.Now()
+	job := &Job{
+		Id: strconv.FormatInt(now.UnixNano(), 36),
+		Printer: p.UniqueName,
+		File: file,
+		User: user,
+		State: JOB_PRINTING,
+		Started: now,
+		StartLayer: startLayer,
+		Filament: filament,
+	}
+
+	s, err := newJobStream(job, f, info.Size(), from, preamble)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	p.jobLock.Lock()
+	if p.job != nil {
+		interrupted := p.job.State == JOB_INTERRUPTED
+		p.jobLock.Unlock()
+		f.Close()
+
+		if interrupted {
+			return nil, errors.New("The interrupted job must be resumed or cancelled first")
+		}
+		return nil, errors.New("A job is already running")
+	}
+	p.job = job
+	p.stream = s
+	p.objects = objects
+	data := job.eventData()
+	p.jobLock.Unlock()
+
+	p.log().Infof("Job %s started: %s", job.Id, file)
+	p.emitEvent(EVENT_JOB_STARTED, data)
+	p.warnFilament(job)
+
+	go p.streamJob(s)
+	return p.GetJob(), nil
+}
+
+func (p *Printer) PauseJob() error {
+	p.jobLock.Lock()
+	defer p.jobLock.Unlock()
+
+	if p.job == nil || p.job.State != JOB_PRINTING {
+		return errors.New("No job is printing")
+	}
+
+	p.job.State = JOB_PAUSED
+	p.job.PausedAt = time.Now()
+	p.emitEvent(EVENT_JOB_PAUSED, p.job.eventData())
+	return nil
+}
+
+// Continue a paused job, or an interrupted one from its checkpoint
+func (p *Printer) ResumeJob() error {
+	p.jobLock.Lock()
+	defer p.jobLock.Unlock()
+
+	if p.job == nil {
+		return errNoJob
+	}
+
+	switch p.job.State {
+		case JOB_PAUSED:
+			p.job.State = JOB_PRINTING
+			p.job.Paused += time.Since(p.job.PausedAt).Seconds()
+			p.job.PausedAt = time.Time{}
+
+			select {
+				case p.stream.wake <- struct{}{}:
+				default:
+			}
+			p.emitEvent(EVENT_JOB_RESUMED, p.job.eventData())
+			return nil
+		case JOB_INTERRUPTED:
+			if err := p.checkSdIdle(); err != nil {
+				return err
+			}
+			if err := p.resumeFromCheckpoint(); err != nil {
+				return err
+			}
+			p.emitEvent(EVENT_JOB_RESUMED, p.job.eventData())
+			return nil
+		default:
+			return errors.New("No job is paused or interrupted")
+	}
+}
+
+// Reheat, home X/Y and continue from the start of the layer that was being
+// printed. Must be called with jobLock held.
+func (p *Printer) resumeFromCheckpoint() error {
+	job, cp := p.job, p.checkpoint
+	if cp == nil {
+		return errors.New("The job has no checkpoint to resume from")
+	}
+
+	if p.GetState() != STATE_CONNECTED {
+		return errors.New("Printer is not connected")
+	}
+
+	f, err := openStoredFile(job.File)
+	if err != nil {
+		return err
+	}
+
+	if info, err := f.Stat(); err != nil || info.Size() != cp.Size {
+		f.Close()
+		return errors.New("The file has changed since the job started")
+	}
+
+	// The printer may have lost its position. The print head is still at the
+	// height where it stopped.
+	preamble := append([]string{ fmt.Sprintf("G92 Z%g", cp.Confirmed.State.Z) }, preambleGcode(cp.LayerStart.State)...)
+	s, err := newJobStream(job, f, cp.Size, cp.LayerStart, preamble)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	job.State = JOB_PRINTING
+	job.Paused += time.Since(job.PausedAt).Seconds()
+	job.PausedAt = time.Time{}
+	p.stream = s
+
+	p.log().Infof("Resuming job %s from line %d, layer %d", job.Id, cp.LayerStart.Line + 1, cp.LayerStart.State.Layer)
+
+	go p.streamJob(s)
+	return nil
+}
+
+// Stop the job and turn off the heaters. A line being sent is completed first.
+func (p *Printer) CancelJob() error {
+	p.jobLock.Lock()
+	job, s := p.job, p.stream
+	p.jobLock.Unlock()
+
+	if job == nil {
+		return errNoJob
+	}
+
+	p.finishJob(job, JOB_CANCELLED)
+
+	if s != nil {
+		// The stream stops printing once it notices
+		select {
+			case s.wake <- struct{}{}:
+			default:
+		}
+	} else {
+		p.stopPrinting()
+	}
+	return nil
+}
+
+// Turn off all heaters and the part cooling fan
+func (p *Printer) stopPrinting() {
+	for _, command := range append(p.heatersOffCommands(), "M107") {
+		p.SendCommand(command, nil)
+	}
+}
+
+// End a job and move it to the job history
+func (p *Printer) finishJob(job *Job, state string) {
+	p.jobLock.Lock()
+	if p.job != job {
+		p.jobLock.Unlock()
+		return
+	}
+
+	if !job.PausedAt.IsZero() {
+		job.Paused += time.Since(job.PausedAt).Seconds()
+		job.PausedAt = time.Time{}
+	}
+	job.State = state
+	job.Ended = time.Now()
+	if state == JOB_COMPLETED {
+		job.Progress = 1
+	}
+	job.updatePrintTime()
+
+	p.job = nil
+	p.stream = nil
+	p.checkpoint = nil
+	p.objects = nil
+
+	if err := os.Remove(checkpointFile(p.UniqueName)); err != nil && !os.IsNotExist(err) {
+		p.log().Errorf("Cannot remove job checkpoint: %v", err)
+	}
+
+	record := *job
+	p.jobLock.Unlock()
+
+	cost := p.jobCost(record)
+	record.Cost = &cost.CostBreakdown
+
+	p.log().Infof("Job %s %s: %s", record.Id, state, record.File)
+	p.emitEvent(EVENT_JOB_FINISHED, record.eventData())
+
+	if err := recordJob(record); err != nil {
+		p.log().Errorf("Cannot write job history: %v", err)
+	}
+	if err := recordCost(cost); err != nil {
+		p.log().Errorf("Cannot write cost record: %v", err)
+	}
+}
+
+// Keep the job and its checkpoint for resuming later
+func (p *Printer) interruptJob(s *jobStream, reason error) {
+	p.jobLock.Lock()
+	if p.job != s.job {
+		p.jobLock.Unlock()
+		return
+	}
+
+	s.job.State = JOB_INTERRUPTED
+	s.job.PausedAt = time.Now()
+	p.stream = nil
+
+	// Until the preamble is through, the checkpoint resumed from still applies
+	if len(s.preamble) == 0 {
+		p.saveCheckpoint(s)
+	}
+	data := s.job.eventData()
+	p.jobLock.Unlock()
+
+	p.log().Warnf("Job %s interrupted at line %d: %v", s.job.Id, s.position.Line, reason)
+	data["error"] = reason.Error()
+	p.emitEvent(EVENT_JOB_INTERRUPTED, data)
+}
+
+// Must be called with jobLock held
+func (p *Printer) saveCheckpoint(s *jobStream) {
+	s.job.updatePrintTime()
+
+	cp := &JobCheckpoint{
+		Job: *s.job,
+		Saved: time.Now(),
+		Size: s.size,
+		Confirmed: s.position,
+		LayerStart: s.layerStart,
+	}
+	p.checkpoint = cp
+	s.checkpointed = cp.Saved
+
+	if err := writeCheckpoint(checkpointFile(p.UniqueName), cp); err != nil {
+		p.log().Errorf("Cannot save job checkpoint: %v", err)
+	}
+}
+
+// Replace the checkpoint file at once, so that a crash leaves either version
+func writeCheckpoint(path string, cp *JobCheckpoint) error {
+	js, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".dashprint-checkpoint-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(js)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Offer to resume the job that was printing when dashprint stopped
+func (p *Printer) loadCheckpoint() {
+	data, err := ioutil.ReadFile(checkpointFile(p.UniqueName))
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		p.log().Errorf("Cannot read job checkpoint: %v", err)
+		return
+	}
+
+	var cp JobCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		p.log().Errorf("Cannot parse job checkpoint: %v", err)
+		return
+	}
+
+	job := cp.Job
+	job.State = JOB_INTERRUPTED
+	if job.PausedAt.IsZero() {
+		job.PausedAt = cp.Saved
+	}
+
+	var objects []JobObject
+	if f, err := openStoredFile(job.File); err == nil {
+		objects, _ = analyzeObjects(f)
+		f.Close()
+	}
+
+	p.jobLock.Lock()
+	p.job = &job
+	p.checkpoint = &cp
+	p.objects = objects
+	p.jobLock.Unlock()
+
+	p.log().Warnf("Job %s was interrupted at line %d, layer %d, and can be resumed", job.Id, cp.Confirmed.Line, cp.LayerStart.State.Layer)
+}
+
+func (p *Printer) sendJobLine(command string) error {
+	var cmdErr error
+	p.SendCommand(command, func(reply []string, err error) {
+		cmdErr = err
+	})
+	return cmdErr
+}
+
+func (p *Printer) streamJob(s *jobStream) {
+	defer s.file.Close()
+
+	for {
+		p.jobLock.Lock()
+		state := ""
+		if p.job == s.job {
+			state = s.job.State
+		}
+		p.jobLock.Unlock()
+
+		switch state {
+			case JOB_PRINTING:
+			case JOB_PAUSED:
+				<-s.wake
+				continue
+			default:
+				// Cancelled
+				p.stopPrinting()
+				return
+		}
+
+		if len(s.preamble) > 0 {
+			if err := p.sendJobLine(s.preamble[0]); err != nil {
+				p.interruptJob(s, err)
+				return
+			}
+			s.preamble = s.preamble[1:]
+			continue
+		}
+
+		raw, err := s.reader.ReadString('\n')
+		if err == io.EOF && raw == "" {
+			p.finishJob(s.job, JOB_COMPLETED)
+			return
+		} else if err != nil && err != io.EOF {
+			p.interruptJob(s, err)
+			return
+		}
+
+		next, command, layer := s.position.advance(raw)
+		extruded := 0.0
+		if command != "" {
+			move := isMoveCommand(command)
+			cancelled := p.streamObjectCancelled(s, s.position.State.Object)
+
+			if move && cancelled {
+				s.dropped = true
+			} else {
+				lines := []string{ command }
+				if s.dropped && (move || !cancelled) {
+					lines = append(resyncGcode(s.position.State), command)
+					s.dropped = false
+				}
+
+				for _, line := range lines {
+					if err := p.sendJobLine(line); err != nil {
+						p.interruptJob(s, err)
+						return
+					}
+				}
+
+				if move {
+					extruded = next.State.E - s.position.State.E
+				}
+			}
+		}
+
+		if layer {
+			s.layerStart = s.position
+		}
+		tool := s.position.State.Tool
+		s.position = next
+		p.updateJob(s, layer, tool, extruded)
+		p.trackJobPrintTime()
+	}
+}
+
+// Record the progress of the stream and the filament pushed by the last
+// line, checkpointing it now and then
+func (p *Printer) updateJob(s *jobStream, layer bool, tool int, extruded float64) {
+	p.jobLock.Lock()
+	defer p.jobLock.Unlock()
+
+	if p.job != s.job {
+		return
+	}
+
+	if extruded != 0 && tool >= 0 {
+		for len(s.job.Extruded) <= tool {
+			s.job.Extruded = append(s.job.Extruded, 0)
+		}
+		s.job.Extruded[tool] += extruded
+	}
+
+	s.job.Line = s.position.Line
+	s.job.Layer = s.position.State.Layer
+	if s.size > 0 {
+		s.job.Progress = float64(s.position.Offset) / float64(s.size)
+	}
+
+	since := time.Since(s.checkpointed)
+	if since >= CHECKPOINT_INTERVAL * time.Millisecond || (layer && since >= CHECKPOINT_MIN_INTERVAL * time.Millisecond) {
+		p.saveCheckpoint(s)
+	}
+}
+
+// Append a finished job to the history
+func recordJob(job Job) error {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	js, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(jobsFile(), os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(js, '\n'))
+	return err
+}
+
+// Most recent finished jobs of a printer, newest first
+func queryJobs(printer string, limit int) ([]Job, error) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	jobs := make([]Job, 0)
+
+	f, err := os.Open(jobsFile())
+	if os.IsNotExist(err) {
+		return jobs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var job Job
+		if err := json.Unmarshal(scanner.Bytes(), &job); err != nil {
+			continue
+		}
+
+		if printer == "" || job.Printer == printer {
+			jobs = append(jobs, job)
+		}
+	}
+
+	for i, j := 0, len(jobs)-1; i < j; i, j = i+1, j-1 {
+		jobs[i], jobs[j] = jobs[j], jobs[i]
+	}
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+
+	return jobs, scanner.Err()
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testLineRegexp = regexp.MustCompile(`^N\d+ (.*) \*\d+$`)
+
+// Stand-in for the firmware, answering ok to every line. The answer to the
+// line hold is delayed until release is closed.
+type testFirmware struct {
+	lock    sync.Mutex
+	lines   []string
+	hold    string
+	held    chan struct{}
+	release chan struct{}
+	// Lines sent before the ok to a command
+	replies map[string][]string
+}
+
+func (fw *testFirmware) run(p *Printer, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := testLineRegexp.FindStringSubmatch(line); m != nil {
+			line = m[1]
+		}
+
+		fw.lock.Lock()
+		fw.lines = append(fw.lines, line)
+		hold := line == fw.hold
+		if hold {
+			fw.hold = ""
+		}
+		reply := fw.replies[line]
+		fw.lock.Unlock()
+
+		if hold {
+			close(fw.held)
+			<-fw.release
+		}
+
+		for i := range reply {
+			p.readChannel <- &reply[i]
+		}
+		ok := "ok"
+		p.readChannel <- &ok
+	}
+}
+
+func (fw *testFirmware) received() []string {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	return append([]string{}, fw.lines...)
+}
+
+type testEvents struct {
+	lock   sync.Mutex
+	names  []string
+}
+
+func (l *testEvents) onPrinterStateChanged(oldState int, newState int) {}
+
+func (l *testEvents) onPrinterEvent(event PrinterEvent) {
+	l.lock.Lock()
+	l.names = append(l.names, event.Name)
+	l.lock.Unlock()
+}
+
+func (l *testEvents) count(name string) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	n := 0
+	for _, received := range l.names {
+		if received == name {
+			n++
+		}
+	}
+	return n
+}
+
+func (l *testEvents) has(name string) bool {
+	return l.count(name) > 0
+}
+
+// Give a test its own files, checkpoints, job history and configuration.
+// Saves started in the background read the directory under saveMutex.
+func withDataDir(t *testing.T) {
+	dir := t.TempDir()
+	saveMutex.Lock()
+	old := dataDirOverride
+	dataDirOverride = dir
+	saveMutex.Unlock()
+
+	withSpools(t, nil)
+	t.Cleanup(func() {
+		saveMutex.Lock()
+		dataDirOverride = old
+		saveMutex.Unlock()
+	})
+}
+
+// A connected printer streaming to a testFirmware
+func jobPrinter(t *testing.T, hold string) (*Printer, *testFirmware, *testEvents) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := LoadPrinter(PrinterSettings{ UniqueName: "test" })
+	p.port = w
+	p.sendWaitChan = make(chan int, 1)
+	p.readChannel = make(chan *string, 1)
+	p.state = STATE_CONNECTED
+	p.resetMotion()
+	p.usage.lastSave = time.Now()
+
+	events := &testEvents{}
+	p.AddListener(events)
+
+	fw := &testFirmware{ hold: hold, held: make(chan struct{}), release: make(chan struct{}) }
+	go fw.run(p, r)
+
+	t.Cleanup(func() {
+		w.Close()
+	})
+	return p, fw, events
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func waitHeld(t *testing.T, fw *testFirmware) {
+	select {
+		case <-fw.held:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the job did not reach the held line")
+	}
+}
+
+func storeTestFile(t *testing.T, lines ...string) string {
+	if _, err := storeFile("test.gcode", strings.NewReader(strings.Join(lines, "\n") + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	return "test.gcode"
+}
+
+func lastJob(t *testing.T) Job {
+	jobs, err := queryJobs("test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("expected a job in the history, got %d", len(jobs))
+	}
+	return jobs[0]
+}
+
+func contains(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+func TestJobPauseResume(t *testing.T) {
+	withDataDir(t)
+	p, fw, events := jobPrinter(t, "M400")
+	file := storeTestFile(t, "G28", "G1 Z0.2", "G1 X10 Y10 E1", "M400", "G1 X20 Y10 E2", "G1 X20 Y20 E3")
+
+	job, err := p.StartJob(file, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != JOB_PRINTING || job.User != "alice" {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if _, err := p.StartJob(file, "bob"); err == nil {
+		t.Error("a second job should not start")
+	}
+
+	waitHeld(t, fw)
+	if err := p.PauseJob(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.PauseJob(); err == nil {
+		t.Error("a paused job should not pause again")
+	}
+	close(fw.release)
+
+	// The line being sent completes, nothing follows while paused
+	time.Sleep(50 * time.Millisecond)
+	if j := p.GetJob(); j == nil || j.State != JOB_PAUSED {
+		t.Fatalf("expected a paused job, got %+v", j)
+	}
+	if received := fw.received(); contains(received, "G1 X20 Y10 E2") {
+		t.Fatalf("lines sent while paused: %q", received)
+	}
+
+	if err := p.ResumeJob(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the job to finish", func() bool { return p.GetJob() == nil })
+
+	received := fw.received()
+	if last := received[len(received)-1]; last != "G1 X20 Y20 E3" {
+		t.Errorf("expected the file to be sent to the end, last line %q", last)
+	}
+
+	record := lastJob(t)
+	if record.Id != job.Id || record.State != JOB_COMPLETED || record.Progress != 1 {
+		t.Errorf("unexpected history record %+v", record)
+	}
+	if len(record.Extruded) != 1 || record.Extruded[0] != 3 {
+		t.Errorf("expected 3 mm extruded, got %v", record.Extruded)
+	}
+
+	for _, name := range []string{ EVENT_JOB_STARTED, EVENT_JOB_PAUSED, EVENT_JOB_RESUMED, EVENT_JOB_FINISHED } {
+		waitFor(t, name, func() bool { return events.has(name) })
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	withDataDir(t)
+	p, fw, _ := jobPrinter(t, "M400")
+	p.temperatures["T0"] = Temperature{ Current: 200, Target: 200 }
+	p.temperatures["T1"] = Temperature{ Current: 180, Target: 180 }
+	p.temperatures["B"] = Temperature{ Current: 60, Target: 60 }
+	file := storeTestFile(t, "G28", "M400", "G1 X10 Y10 E1")
+
+	if _, err := p.StartJob(file, ""); err != nil {
+		t.Fatal(err)
+	}
+	waitHeld(t, fw)
+
+	if err := p.CancelJob(); err != nil {
+		t.Fatal(err)
+	}
+	close(fw.release)
+
+	waitFor(t, "the heaters to be turned off", func() bool { return contains(fw.received(), "M107") })
+
+	received := fw.received()
+	if contains(received, "G1 X10 Y10 E1") {
+		t.Error("the file was sent after cancelling")
+	}
+	expected := []string{ "M104 T0 S0", "M104 T1 S0", "M140 S0", "M107" }
+	if tail := received[len(received)-len(expected):]; strings.Join(tail, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected %q after cancelling, got %q", expected, tail)
+	}
+
+	if record := lastJob(t); record.State != JOB_CANCELLED {
+		t.Errorf("expected a cancelled job, got %s", record.State)
+	}
+	if err := p.CancelJob(); err != errNoJob {
+		t.Errorf("expected no job to cancel, got %v", err)
+	}
+}
+
+func TestJobRecovery(t *testing.T) {
+	withDataDir(t)
+	p, fw, events := jobPrinter(t, "M400")
+	file := storeTestFile(t,
+		"M104 S200",
+		"G28",
+		"G1 Z0.2",
+		"G1 X10 Y10 E1",
+		"G1 Z0.4",
+		"G1 X20 Y10 E2",
+		"M400",
+		"G1 X30 Y10 E3",
+		"G1 X30 Y20 E4")
+
+	job, err := p.StartJob(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitHeld(t, fw)
+
+	// The connection is lost while the printer works on M400
+	p.state = STATE_DISCONNECTED
+	close(fw.release)
+
+	waitFor(t, "the job to be interrupted", func() bool {
+		j := p.GetJob()
+		return j != nil && j.State == JOB_INTERRUPTED
+	})
+	waitFor(t, EVENT_JOB_INTERRUPTED, func() bool { return events.has(EVENT_JOB_INTERRUPTED) })
+	if _, err := os.Stat(checkpointFile("test")); err != nil {
+		t.Fatalf("expected a checkpoint: %v", err)
+	}
+
+	// Started again, dashprint offers to resume the job from the checkpoint
+	restarted, fw, _ := jobPrinter(t, "")
+	restarted.loadCheckpoint()
+
+	j := restarted.GetJob()
+	if j == nil || j.Id != job.Id || j.State != JOB_INTERRUPTED {
+		t.Fatalf("expected the interrupted job, got %+v", j)
+	}
+	if _, err := restarted.StartJob(file, ""); err == nil {
+		t.Error("a job should not start before the interrupted one is resumed or cancelled")
+	}
+
+	if err := restarted.ResumeJob(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the job to finish", func() bool { return restarted.GetJob() == nil })
+
+	// The layer being printed is started over at the height where the print head stopped
+	received := fw.received()
+	if received[0] != "G92 Z0.4" {
+		t.Errorf("expected the Z position to be set first, got %q", received[0])
+	}
+	for _, line := range []string{ "M109 T0 S200", "G28 X Y", "G1 Z0.4 F600", "G92 E1" } {
+		if !contains(received, line) {
+			t.Errorf("expected %q in the preamble, got %q", line, received)
+		}
+	}
+	expected := []string{ "G1 X20 Y10 E2", "M400", "G1 X30 Y10 E3", "G1 X30 Y20 E4" }
+	if tail := received[len(received)-len(expected):]; strings.Join(tail, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected the layer to be printed again, got %q", received)
+	}
+
+	if record := lastJob(t); record.Id != job.Id || record.State != JOB_COMPLETED {
+		t.Errorf("unexpected history record %+v", record)
+	}
+	if _, err := os.Stat(checkpointFile("test")); !os.IsNotExist(err) {
+		t.Errorf("expected the checkpoint to be removed, got %v", err)
+	}
+}
+
+func TestCheckpointChangedFile(t *testing.T) {
+	withDataDir(t)
+	p, fw, _ := jobPrinter(t, "M400")
+	file := storeTestFile(t, "G28", "G1 Z0.2", "G1 X10 Y10 E1", "M400", "G1 X20 Y10 E2")
+
+	if _, err := p.StartJob(file, ""); err != nil {
+		t.Fatal(err)
+	}
+	waitHeld(t, fw)
+	p.state = STATE_DISCONNECTED
+	close(fw.release)
+	waitFor(t, "the job to be interrupted", func() bool {
+		j := p.GetJob()
+		return j != nil && j.State == JOB_INTERRUPTED
+	})
+
+	// Replacing the file of a job is refused, so change it behind dashprint's back
+	path, _ := storedFilePath(file)
+	if err := ioutil.WriteFile(path, []byte("G28\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p.state = STATE_CONNECTED
+	if err := p.ResumeJob(); err == nil {
+		t.Error("a job should not resume from a changed file")
+	}
+	if j := p.GetJob(); j == nil || j.State != JOB_INTERRUPTED {
+		t.Errorf("expected the job to stay interrupted, got %+v", j)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var logLevel = flag.String("log-level", "info", "Log level: error, warn, info or debug")
+var logFormat = flag.String("log-format", "text", "Log format: text or json")
+var logFile = flag.String("log-file", "", "Also write logs to this file, rotated by size")
+var logMaxSize = flag.Int("log-max-size", 10, "Maximum log file size in megabytes before rotating")
+var logMaxBackups = flag.Int("log-max-backups", 5, "Number of rotated log files to keep")
+
+const (
+	MAX_PRINTER_LOG_ENTRIES = 1000
+)
+
+var logger = logrus.New()
+
+type LogEntry struct {
+	Time    time.Time              `json:"time"`
+	Level   string                 `json:"level"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields"`
+}
+
+// Ring buffer of recent log entries of a printer
+type printerLog struct {
+	entries []LogEntry
+	next    int
+	full    bool
+}
+
+// Logrus hook keeping recent entries of each printer in memory
+type printerLogHook struct {
+	lock sync.Mutex
+	logs map[string]*printerLog
+}
+
+var printerLogs = &printerLogHook{ logs: make(map[string]*printerLog) }
+
+func setupLogging() {
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal("Invalid log level: ", err)
+	}
+	logger.SetLevel(level)
+
+	if *logFormat == "json" {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logger.SetFormatter(&logrus.TextFormatter{ FullTimestamp: true })
+	}
+
+	var out io.Writer = os.Stderr
+	if *logFile != "" {
+		out = io.MultiWriter(os.Stderr, &lumberjack.Logger{
+			Filename: *logFile,
+			MaxSize: *logMaxSize,
+			MaxBackups: *logMaxBackups,
+		})
+	}
+	logger.SetOutput(out)
+	logger.AddHook(printerLogs)
+
+	// Route messages of the standard logger through logrus
+	log.SetFlags(0)
+	log.SetOutput(logger.WriterLevel(logrus.InfoLevel))
+}
+
+func (h *printerLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *printerLogHook) Fire(entry *logrus.Entry) error {
+	printer, ok := entry.Data["printer"].(string)
+	if !ok {
+		return nil
+	}
+
+	fields := make(map[string]interface{})
+	for k, v := range entry.Data {
+		if k != "printer" {
+			fields[k] = v
+		}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	pl, ok := h.logs[printer]
+	if !ok {
+		pl = &printerLog{ entries: make([]LogEntry, MAX_PRINTER_LOG_ENTRIES) }
+		h.logs[printer] = pl
+	}
+
+	pl.entries[pl.next] = LogEntry{ Time: entry.Time, Level: entry.Level.String(), Message: entry.Message, Fields: fields }
+	pl.next++
+	if pl.next == len(pl.entries) {
+		pl.next = 0
+		pl.full = true
+	}
+
+	return nil
+}
+
+// Get up to limit most recent entries of a printer, oldest first
+func (h *printerLogHook) get(printer string, limit int) []LogEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	rv := make([]LogEntry, 0)
+
+	pl, ok := h.logs[printer]
+	if !ok {
+		return rv
+	}
+
+	if pl.full {
+		rv = append(rv, pl.entries[pl.next:]...)
+	}
+	rv = append(rv, pl.entries[:pl.next]...)
+
+	if limit > 0 && len(rv) > limit {
+		rv = rv[len(rv)-limit:]
+	}
+	return rv
+}
+
+// Logger with the printer field set
+func (p *Printer) log() *logrus.Entry {
+	return logger.WithField("printer", p.UniqueName)
+}
+
+func (p *Printer) SetSerialTrace(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&p.serialTrace, v)
+}
+
+func (p *Printer) isTracingSerial() bool {
+	return atomic.LoadInt32(&p.serialTrace) != 0
+}
+
+// Log serial traffic if tracing is enabled for the printer
+func (p *Printer) traceSerial(direction string, line string) {
+	if !p.isTracingSerial() {
+		return
+	}
+
+	entry := p.log().WithField("direction", direction)
+
+	var lineNo int
+	if _, err := fmt.Sscanf(line, "N%d ", &lineNo); err == nil {
+		entry = entry.WithField("line", lineNo)
+	}
+	entry.Info(line)
+}
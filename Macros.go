@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type MacroParameter struct {
+	Name    string `json:"name"`
+	Default string `json:"default"`
+}
+
+type Macro struct {
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	Parameters  []MacroParameter `json:"parameters"`
+	// G-code lines, may contain text/template actions such as {{.Temp}}
+	Commands    string           `json:"commands"`
+}
+
+// Macro currently being executed on a printer
+type MacroExecution struct {
+	Name  string
+	abort chan int
+	once  sync.Once
+}
+
+// Macro call from the websocket terminal, e.g.
+// {"printer": "mk3", "macro": "preheat", "params": {"Temp": "215"}}
+type MacroRequest struct {
+	Printer string            `json:"printer"`
+	Macro   string            `json:"macro"`
+	Params  map[string]string `json:"params"`
+	// Abort the running macro instead
+	Abort   bool              `json:"abort"`
+}
+
+type MacroResponse struct {
+	Printer string `json:"printer"`
+	Macro   string `json:"macro"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Global macros, available on all printers
+var macros []Macro
+
+var ErrMacroRunning = errors.New("Another macro is already running")
+
+func (m *MacroExecution) Abort() {
+	m.once.Do(func() { close(m.abort) })
+}
+
+// Find a macro by name. Printer specific macros take precedence over global ones.
+func (p *Printer) FindMacro(name string) *Macro {
+	for i := range p.Macros {
+		if p.Macros[i].Name == name {
+			return &p.Macros[i]
+		}
+	}
+	for i := range macros {
+		if macros[i].Name == name {
+			return &macros[i]
+		}
+	}
+	return nil
+}
+
+// List macros available on the printer
+func (p *Printer) GetMacros() []Macro {
+	rv := make([]Macro, 0, len(p.Macros) + len(macros))
+	rv = append(rv, p.Macros...)
+
+	for _, m := range macros {
+		overridden := false
+		for _, pm := range p.Macros {
+			if pm.Name == m.Name {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			rv = append(rv, m)
+		}
+	}
+	return rv
+}
+
+// Expand macro template into a list of G-code commands. The printer's
+// settings are available to the template as .Printer.
+func (m *Macro) Expand(settings PrinterSettings, params map[string]string) ([]string, error) {
+	tmpl, err := template.New(m.Name).Option("missingkey=error").Parse(m.Commands)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]interface{})
+	for _, param := range m.Parameters {
+		data[param.Name] = param.Default
+	}
+	for k, v := range params {
+		data[k] = v
+	}
+	data["Printer"] = settings
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+
+	commands := make([]string, 0)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		// Strip comments
+		if pos := strings.Index(line, ";"); pos != -1 {
+			line = line[:pos]
+		}
+		line = strings.TrimSpace(line)
+
+		if line != "" {
+			commands = append(commands, line)
+		}
+	}
+
+	return commands, nil
+}
+
+// Start executing a macro in the background. Only a single macro may be
+// running on a printer at a time. Must be called with printerMutex held.
+func (p *Printer) RunMacro(name string, params map[string]string) error {
+	macro := p.FindMacro(name)
+	if macro == nil {
+		return errors.New("No such macro")
+	}
+
+	commands, err := macro.Expand(p.settingsSnapshot(), params)
+	if err != nil {
+		return err
+	}
+
+	p.macroLock.Lock()
+	defer p.macroLock.Unlock()
+
+	if p.runningMacro != nil {
+		return ErrMacroRunning
+	}
+
+	exec := &MacroExecution{ Name: name, abort: make(chan int) }
+	p.runningMacro = exec
+
+	go p.executeMacro(exec, commands)
+	return nil
+}
+
+// Abort the running macro. The command currently being executed is allowed to finish.
+func (p *Printer) AbortMacro() bool {
+	p.macroLock.Lock()
+	defer p.macroLock.Unlock()
+
+	if p.runningMacro == nil {
+		return false
+	}
+
+	p.runningMacro.Abort()
+	return true
+}
+
+// Name of the running macro or an empty string
+func (p *Printer) GetRunningMacro() string {
+	p.macroLock.Lock()
+	defer p.macroLock.Unlock()
+
+	if p.runningMacro == nil {
+		return ""
+	}
+	return p.runningMacro.Name
+}
+
+// Run or abort a macro for a websocket client, allowed and audited like the REST API
+func handleMacroRequest(req MacroRequest, user *User, remoteAddr string) MacroResponse {
+	entry := AuditEntry{
+		Time: time.Now(),
+		User: user.Username,
+		ApiKey: user.apiKey,
+		RemoteAddr: remoteAddr,
+		Printer: req.Printer,
+		Action: "macro.run",
+		Params: map[string]interface{}{ "name": req.Macro },
+	}
+	if req.Abort {
+		entry.Action = "macro.abort"
+	} else if len(req.Params) > 0 {
+		entry.Params["params"] = req.Params
+	}
+
+	status, err := runMacroRequest(req, user)
+	entry.Status = status
+	recordAudit(entry)
+
+	resp := MacroResponse{ Printer: req.Printer, Macro: req.Macro }
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+func runMacroRequest(req MacroRequest, user *User) (int, error) {
+	if user.role() < ROLE_OPERATOR || !user.canAccessPrinter(req.Printer) {
+		return http.StatusForbidden, errors.New("Permission denied")
+	}
+
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+
+	printer, ok := printers[req.Printer]
+	if !ok {
+		return http.StatusNotFound, errors.New("No such printer")
+	}
+
+	if req.Abort {
+		if !printer.AbortMacro() {
+			return http.StatusNotFound, errors.New("No macro is running")
+		}
+		return http.StatusOK, nil
+	}
+
+	if err := printer.RunMacro(req.Macro, req.Params); err == ErrMacroRunning {
+		return http.StatusConflict, err
+	} else if err != nil {
+		return http.StatusBadRequest, err
+	}
+	return http.StatusAccepted, nil
+}
+
+func (p *Printer) executeMacro(exec *MacroExecution, commands []string) {
+	defer func() {
+		p.macroLock.Lock()
+		p.runningMacro = nil
+		p.macroLock.Unlock()
+	}()
+
+	p.log().Infof("Running macro %s", exec.Name)
+
+	for _, command := range commands {
+		select {
+			case <-exec.abort:
+				p.log().Infof("Macro %s aborted", exec.Name)
+				return
+			default:
+		}
+
+		var cmdErr error
+		p.SendCommand(command, func(reply []string, err error) {
+			cmdErr = err
+		})
+
+		if cmdErr != nil {
+			p.log().Errorf("Macro %s failed at '%s': %v", exec.Name, command, cmdErr)
+			return
+		}
+	}
+
+	p.log().Infof("Macro %s finished", exec.Name)
+}
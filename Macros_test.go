@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMacroExpand(t *testing.T) {
+	settings := PrinterSettings{ UniqueName: "test", PrintArea: PrintArea{ Width: 200, Depth: 180 } }
+	macro := Macro{
+		Name: "purge",
+		Parameters: []MacroParameter{ { Name: "Temp", Default: "200" } },
+		Commands: "M109 S{{.Temp}} ; heat up\n\n  G1 X{{.Printer.PrintArea.Width}} Y{{.Printer.PrintArea.Depth}}  \n;only a comment\n",
+	}
+
+	commands, err := macro.Expand(settings, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{ "M109 S200", "G1 X200 Y180" }; !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected %q, got %q", expected, commands)
+	}
+
+	commands, err = macro.Expand(settings, map[string]string{ "Temp": "215" })
+	if err != nil || commands[0] != "M109 S215" {
+		t.Errorf("expected the parameter to override its default, got %q (%v)", commands, err)
+	}
+
+	for _, bad := range []string{ "M104 S{{.Missing}}", "M104 S{{.Temp" } {
+		macro := Macro{ Name: "bad", Commands: bad }
+		if _, err := macro.Expand(settings, nil); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestFindMacro(t *testing.T) {
+	old := macros
+	macros = []Macro{ { Name: "preheat", Commands: "M104 S200" }, { Name: "park", Commands: "G1 X0" } }
+	t.Cleanup(func() {
+		macros = old
+	})
+
+	p := LoadPrinter(PrinterSettings{ UniqueName: "test", Macros: []Macro{ { Name: "preheat", Commands: "M104 S240" } } })
+
+	if m := p.FindMacro("preheat"); m == nil || m.Commands != "M104 S240" {
+		t.Errorf("expected the printer's macro to take precedence, got %+v", m)
+	}
+	if m := p.FindMacro("park"); m == nil || m.Commands != "G1 X0" {
+		t.Errorf("expected the global macro, got %+v", m)
+	}
+	if m := p.FindMacro("unknown"); m != nil {
+		t.Errorf("expected no macro, got %+v", m)
+	}
+	if list := p.GetMacros(); len(list) != 2 {
+		t.Errorf("expected 2 macros, got %+v", list)
+	}
+}
+
+func runTestMacro(p *Printer, name string, params map[string]string) error {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	return p.RunMacro(name, params)
+}
+
+func TestRunMacro(t *testing.T) {
+	withDataDir(t)
+	p, fw, _ := jobPrinter(t, "M400")
+	p.Macros = []Macro{ { Name: "wait", Parameters: []MacroParameter{ { Name: "Text", Default: "done" } }, Commands: "G28\nM400\nM117 {{.Text}}" } }
+
+	if err := runTestMacro(p, "unknown", nil); err == nil {
+		t.Error("an unknown macro should not run")
+	}
+	if err := runTestMacro(p, "wait", map[string]string{ "Text": "ready" }); err != nil {
+		t.Fatal(err)
+	}
+	waitHeld(t, fw)
+
+	if name := p.GetRunningMacro(); name != "wait" {
+		t.Errorf("expected the macro to be running, got %q", name)
+	}
+	if err := runTestMacro(p, "wait", nil); err != ErrMacroRunning {
+		t.Errorf("expected %v, got %v", ErrMacroRunning, err)
+	}
+
+	close(fw.release)
+	waitFor(t, "the macro to finish", func() bool { return p.GetRunningMacro() == "" })
+
+	if received := fw.received(); !reflect.DeepEqual(received, []string{ "G28", "M400", "M117 ready" }) {
+		t.Errorf("unexpected commands sent %q", received)
+	}
+}
+
+func TestAbortMacro(t *testing.T) {
+	withDataDir(t)
+	p, fw, _ := jobPrinter(t, "M400")
+	p.Macros = []Macro{ { Name: "wait", Commands: "G28\nM400\nM117 done" } }
+
+	if p.AbortMacro() {
+		t.Error("no macro should be running")
+	}
+	if err := runTestMacro(p, "wait", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitHeld(t, fw)
+
+	// The command being executed finishes, the rest is dropped
+	if !p.AbortMacro() || !p.AbortMacro() {
+		t.Error("expected the running macro to be aborted")
+	}
+	close(fw.release)
+	waitFor(t, "the macro to stop", func() bool { return p.GetRunningMacro() == "" })
+
+	if received := fw.received(); !reflect.DeepEqual(received, []string{ "G28", "M400" }) {
+		t.Errorf("expected the macro to stop after M400, got %q", received)
+	}
+}
+
+func TestMacroRequest(t *testing.T) {
+	withDataDir(t)
+	p, fw, _ := jobPrinter(t, "")
+	p.Macros = []Macro{ { Name: "home", Commands: "G28" } }
+	close(fw.release)
+
+	printerMutex.Lock()
+	printers["test"] = p
+	printerMutex.Unlock()
+	t.Cleanup(func() {
+		printerMutex.Lock()
+		delete(printers, "test")
+		printerMutex.Unlock()
+	})
+
+	tests := []struct {
+		user   User
+		req    MacroRequest
+		status int
+	}{
+		{ User{ Username: "viewer", Role: "viewer" }, MacroRequest{ Printer: "test", Macro: "home" }, http.StatusForbidden },
+		{ User{ Username: "other", Role: "operator", Printers: []string{ "mk3" } }, MacroRequest{ Printer: "test", Macro: "home" }, http.StatusForbidden },
+		{ User{ Username: "operator", Role: "operator" }, MacroRequest{ Printer: "mk3", Macro: "home" }, http.StatusNotFound },
+		{ User{ Username: "operator", Role: "operator" }, MacroRequest{ Printer: "test", Macro: "unknown" }, http.StatusBadRequest },
+		{ User{ Username: "operator", Role: "operator" }, MacroRequest{ Printer: "test", Abort: true }, http.StatusNotFound },
+		{ User{ Username: "operator", Role: "operator" }, MacroRequest{ Printer: "test", Macro: "home" }, http.StatusAccepted },
+	}
+
+	for i, test := range tests {
+		resp := handleMacroRequest(test.req, &test.user, "127.0.0.1")
+		if (test.status >= 300) != (resp.Error != "") {
+			t.Errorf("%d: unexpected response %+v", i, resp)
+		}
+
+		entries, err := queryAudit(test.user.Username, "", "", time.Time{}, time.Time{}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Status != test.status || !strings.HasPrefix(entries[0].Action, "macro.") {
+			t.Errorf("%d: expected an audit entry with status %d, got %+v", i, test.status, entries)
+		}
+	}
+
+	waitFor(t, "the macro to run", func() bool { return p.GetRunningMacro() == "" && len(fw.received()) == 1 })
+}
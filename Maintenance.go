@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	EVENT_MAINTENANCE_DUE = "maintenance_due"
+)
+
+const (
+	// Longer gaps between SD progress reports or job lines don't count as printing time
+	MAINTENANCE_IDLE_GAP  = 30000 // 30 seconds
+	// How often updated counters are written to the configuration
+	MAINTENANCE_SAVE_INTERVAL = 300000 // 5 minutes
+	MAX_MAINTENANCE_LOG   = 200
+)
+
+// Counters a maintenance task can be based on
+const (
+	COUNTER_PRINT_HOURS     = "print_hours"
+	COUNTER_EXTRUDED_METERS = "extruded_meters"
+	COUNTER_TRAVEL_METERS   = "travel_meters"
+	COUNTER_X_TRAVEL_METERS = "x_travel_meters"
+	COUNTER_Y_TRAVEL_METERS = "y_travel_meters"
+	COUNTER_Z_TRAVEL_METERS = "z_travel_meters"
+)
+
+type UsageCounters struct {
+	PrintHours     float64 `json:"printHours"`
+	ExtrudedMeters float64 `json:"extrudedMeters"`
+	TravelMeters   float64 `json:"travelMeters"`
+	XTravelMeters  float64 `json:"xTravelMeters"`
+	YTravelMeters  float64 `json:"yTravelMeters"`
+	ZTravelMeters  float64 `json:"zTravelMeters"`
+}
+
+type MaintenanceTask struct {
+	Name         string  `json:"name"`
+	Description  string  `json:"description"`
+	// One of the COUNTER_* names
+	Counter      string  `json:"counter"`
+	Interval     float64 `json:"interval"`
+	// Counter value when last done
+	LastDone     float64 `json:"lastDone"`
+	LastDoneTime string  `json:"lastDoneTime"`
+	// Due notification was sent
+	Notified     bool    `json:"notified"`
+}
+
+type MaintenanceLogEntry struct {
+	Time     string        `json:"time"`
+	Task     string        `json:"task"`
+	User     string        `json:"user"`
+	Note     string        `json:"note"`
+	Counters UsageCounters `json:"counters"`
+}
+
+type MaintenanceSettings struct {
+	Counters UsageCounters         `json:"counters"`
+	Tasks    []MaintenanceTask     `json:"tasks"`
+	Log      []MaintenanceLogEntry `json:"log"`
+}
+
+// Task with its current state
+type MaintenanceTaskStatus struct {
+	MaintenanceTask
+	// Counter units used since last done
+	Used      float64 `json:"used"`
+	Remaining float64 `json:"remaining"`
+	Due       bool    `json:"due"`
+}
+
+type MaintenanceStatus struct {
+	Counters UsageCounters           `json:"counters"`
+	Tasks    []MaintenanceTaskStatus `json:"tasks"`
+	Log      []MaintenanceLogEntry   `json:"log"`
+}
+
+// Activity of a printer
+type usageState struct {
+	lastSd    time.Time
+	lastJob   time.Time
+	lastSave  time.Time
+}
+
+func (c *UsageCounters) value(counter string) (float64, bool) {
+	switch counter {
+		case COUNTER_PRINT_HOURS:
+			return c.PrintHours, true
+		case COUNTER_EXTRUDED_METERS:
+			return c.ExtrudedMeters, true
+		case COUNTER_TRAVEL_METERS:
+			return c.TravelMeters, true
+		case COUNTER_X_TRAVEL_METERS:
+			return c.XTravelMeters, true
+		case COUNTER_Y_TRAVEL_METERS:
+			return c.YTravelMeters, true
+		case COUNTER_Z_TRAVEL_METERS:
+			return c.ZTravelMeters, true
+	}
+	return 0, false
+}
+
+// Count travel of a move acknowledged by the printer
+func (p *Printer) trackUsage(move *motionMove) {
+	p.countTravel(move.travel, move.length)
+	p.usageUpdated()
+}
+
+// Count travel along each axis and in space, mm
+func (p *Printer) countTravel(travel [3]float64, length float64) {
+	p.maintenanceLock.Lock()
+	c := &p.Maintenance.Counters
+	c.XTravelMeters += travel[0] / 1000
+	c.YTravelMeters += travel[1] / 1000
+	c.ZTravelMeters += travel[2] / 1000
+	c.TravelMeters += length / 1000
+	p.maintenanceLock.Unlock()
+}
+
+// Count printing time from SD progress reports. Only time since the previous
+// report counts, if the print advanced and the report is not long overdue,
+// so pauses, jogging and idle time are not counted.
+func (p *Printer) trackSdPrintTime(advanced bool) {
+	p.maintenanceLock.Lock()
+	p.addPrintTime(&p.usage.lastSd, advanced)
+	p.maintenanceLock.Unlock()
+
+	p.usageUpdated()
+}
+
+// Count printing time from lines of a job the printer acknowledged
+func (p *Printer) trackJobPrintTime() {
+	p.maintenanceLock.Lock()
+	p.addPrintTime(&p.usage.lastJob, true)
+	p.maintenanceLock.Unlock()
+
+	p.usageUpdated()
+}
+
+// Count time since the previous activity as printing if the gap is short.
+// Must be called with maintenanceLock held.
+func (p *Printer) addPrintTime(last *time.Time, advanced bool) {
+	now := time.Now()
+	if gap := now.Sub(*last); advanced && gap < time.Millisecond * MAINTENANCE_IDLE_GAP {
+		p.Maintenance.Counters.PrintHours += gap.Hours()
+	}
+	*last = now
+}
+
+func (p *Printer) countExtruded(length float64) {
+	p.maintenanceLock.Lock()
+	p.Maintenance.Counters.ExtrudedMeters += length / 1000
+	p.maintenanceLock.Unlock()
+}
+
+// Notify about tasks that became due and save counters now and then
+func (p *Printer) usageUpdated() {
+	due := make([]MaintenanceTask, 0)
+
+	p.maintenanceLock.Lock()
+	for i := range p.Maintenance.Tasks {
+		t := &p.Maintenance.Tasks[i]
+		if v, ok := p.Maintenance.Counters.value(t.Counter); ok && !t.Notified && v - t.LastDone >= t.Interval {
+			t.Notified = true
+			due = append(due, *t)
+		}
+	}
+
+	save := time.Since(p.usage.lastSave) > time.Millisecond * MAINTENANCE_SAVE_INTERVAL || len(due) > 0
+	if save {
+		p.usage.lastSave = time.Now()
+	}
+	p.maintenanceLock.Unlock()
+
+	for _, t := range due {
+		p.log().Warnf("Maintenance due: %s", t.Name)
+		p.emitEvent(EVENT_MAINTENANCE_DUE, map[string]string{
+			"task": t.Name,
+			"description": t.Description,
+			"counter": t.Counter,
+			"interval": strconv.FormatFloat(t.Interval, 'f', -1, 64),
+		})
+	}
+
+	if save {
+		// Called from the serial loop, which must not wait for the disk
+		go saveConfig()
+	}
+}
+
+func (p *Printer) GetMaintenance() MaintenanceStatus {
+	p.maintenanceLock.Lock()
+	defer p.maintenanceLock.Unlock()
+
+	status := MaintenanceStatus{
+		Counters: p.Maintenance.Counters,
+		Tasks: make([]MaintenanceTaskStatus, len(p.Maintenance.Tasks)),
+		Log: make([]MaintenanceLogEntry, len(p.Maintenance.Log)),
+	}
+	copy(status.Log, p.Maintenance.Log)
+
+	for i, t := range p.Maintenance.Tasks {
+		v, _ := p.Maintenance.Counters.value(t.Counter)
+		used := v - t.LastDone
+
+		status.Tasks[i] = MaintenanceTaskStatus{
+			MaintenanceTask: t,
+			Used: used,
+			Remaining: math.Max(0, t.Interval - used),
+			Due: used >= t.Interval,
+		}
+	}
+
+	return status
+}
+
+func (p *Printer) AddMaintenanceTask(task MaintenanceTask) error {
+	if task.Name == "" || task.Interval <= 0 {
+		return errors.New("Bad task parameters")
+	}
+
+	p.maintenanceLock.Lock()
+
+	v, ok := p.Maintenance.Counters.value(task.Counter)
+	if !ok {
+		p.maintenanceLock.Unlock()
+		return errors.New("Unknown counter " + task.Counter)
+	}
+
+	for _, t := range p.Maintenance.Tasks {
+		if t.Name == task.Name {
+			p.maintenanceLock.Unlock()
+			return errors.New("Task already exists")
+		}
+	}
+
+	// A new task starts counting now
+	task.LastDone = v
+	task.LastDoneTime = ""
+	task.Notified = false
+	p.Maintenance.Tasks = append(p.Maintenance.Tasks, task)
+	p.maintenanceLock.Unlock()
+
+	saveConfig()
+	return nil
+}
+
+func (p *Printer) DeleteMaintenanceTask(name string) bool {
+	p.maintenanceLock.Lock()
+	found := false
+
+	for i := range p.Maintenance.Tasks {
+		if p.Maintenance.Tasks[i].Name == name {
+			p.Maintenance.Tasks = append(p.Maintenance.Tasks[:i], p.Maintenance.Tasks[i+1:]...)
+			found = true
+			break
+		}
+	}
+	p.maintenanceLock.Unlock()
+
+	if found {
+		saveConfig()
+	}
+	return found
+}
+
+// Reset a task's interval and record it in the maintenance log
+func (p *Printer) CompleteMaintenanceTask(name string, username string, note string) bool {
+	p.maintenanceLock.Lock()
+
+	var task *MaintenanceTask
+	for i := range p.Maintenance.Tasks {
+		if p.Maintenance.Tasks[i].Name == name {
+			task = &p.Maintenance.Tasks[i]
+			break
+		}
+	}
+
+	if task == nil {
+		p.maintenanceLock.Unlock()
+		return false
+	}
+
+	now := time.Now().Format(time.RFC3339)
+
+	task.LastDone, _ = p.Maintenance.Counters.value(task.Counter)
+	task.LastDoneTime = now
+	task.Notified = false
+
+	p.Maintenance.Log = append(p.Maintenance.Log, MaintenanceLogEntry{
+		Time: now,
+		Task: name,
+		User: username,
+		Note: note,
+		Counters: p.Maintenance.Counters,
+	})
+	if len(p.Maintenance.Log) > MAX_MAINTENANCE_LOG {
+		p.Maintenance.Log = p.Maintenance.Log[len(p.Maintenance.Log)-MAX_MAINTENANCE_LOG:]
+	}
+	p.maintenanceLock.Unlock()
+
+	p.log().Infof("Maintenance done: %s", name)
+	saveConfig()
+	return true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func maintenancePrinter(t *testing.T) (*Printer, *testEvents) {
+	withDataDir(t)
+
+	p := LoadPrinter(PrinterSettings{ UniqueName: "test" })
+	p.resetMotion()
+	p.usage.lastSave = time.Now()
+
+	events := &testEvents{}
+	p.AddListener(events)
+	return p, events
+}
+
+// Run moves through the usage tracking as if the printer acknowledged them
+func trackMoves(p *Printer, lines ...string) {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		p.trackMotion(fields[0], fields[1:])
+	}
+}
+
+func TestMaintenanceTasks(t *testing.T) {
+	p, _ := maintenancePrinter(t)
+
+	for _, task := range []MaintenanceTask{
+		{ Name: "", Counter: COUNTER_PRINT_HOURS, Interval: 100 },
+		{ Name: "Nozzle", Counter: COUNTER_PRINT_HOURS, Interval: 0 },
+		{ Name: "Nozzle", Counter: "hours", Interval: 100 },
+	} {
+		if err := p.AddMaintenanceTask(task); err == nil {
+			t.Errorf("task %+v should be refused", task)
+		}
+	}
+
+	trackMoves(p, "G28", "G1 X100 E500")
+
+	// A new task starts counting from the current value
+	if err := p.AddMaintenanceTask(MaintenanceTask{ Name: "Nozzle", Counter: COUNTER_EXTRUDED_METERS, Interval: 1, Notified: true }); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddMaintenanceTask(MaintenanceTask{ Name: "Nozzle", Counter: COUNTER_TRAVEL_METERS, Interval: 1 }); err == nil {
+		t.Error("a second task of the same name should be refused")
+	}
+
+	task := p.GetMaintenance().Tasks[0]
+	if task.LastDone != 0.5 || task.Used != 0 || task.Remaining != 1 || task.Notified {
+		t.Errorf("unexpected new task %+v", task)
+	}
+
+	if !p.DeleteMaintenanceTask("Nozzle") || p.DeleteMaintenanceTask("Nozzle") {
+		t.Error("expected the task to be deleted once")
+	}
+	if tasks := p.GetMaintenance().Tasks; len(tasks) != 0 {
+		t.Errorf("expected no tasks, got %+v", tasks)
+	}
+}
+
+func TestMaintenanceDue(t *testing.T) {
+	p, events := maintenancePrinter(t)
+
+	if err := p.AddMaintenanceTask(MaintenanceTask{ Name: "Belts", Counter: COUNTER_X_TRAVEL_METERS, Interval: 1 }); err != nil {
+		t.Fatal(err)
+	}
+
+	trackMoves(p, "G28", "G1 X500", "G1 X200")
+	task := p.GetMaintenance().Tasks[0]
+	if task.Due || task.Notified || math.Abs(task.Remaining - 0.2) > 1e-9 {
+		t.Fatalf("expected 0.2 m remaining, got %+v", task)
+	}
+
+	// Due once 1 m was travelled along X, notified only once
+	trackMoves(p, "G1 X600")
+	task = p.GetMaintenance().Tasks[0]
+	if !task.Due || !task.Notified || task.Remaining != 0 {
+		t.Fatalf("expected the task to be due, got %+v", task)
+	}
+	waitFor(t, EVENT_MAINTENANCE_DUE, func() bool { return events.has(EVENT_MAINTENANCE_DUE) })
+
+	trackMoves(p, "G1 X100")
+	time.Sleep(20 * time.Millisecond)
+	if n := events.count(EVENT_MAINTENANCE_DUE); n != 1 {
+		t.Errorf("expected a single notification, got %d", n)
+	}
+
+	// Completing the task starts the interval over and logs it
+	if p.CompleteMaintenanceTask("Unknown", "alice", "") {
+		t.Error("an unknown task should not complete")
+	}
+	if !p.CompleteMaintenanceTask("Belts", "alice", "Tensioned") {
+		t.Fatal("expected the task to complete")
+	}
+
+	status := p.GetMaintenance()
+	task = status.Tasks[0]
+	if task.Due || task.Notified || task.Used != 0 || task.LastDoneTime == "" {
+		t.Errorf("expected the task to start over, got %+v", task)
+	}
+	if len(status.Log) != 1 || status.Log[0].Task != "Belts" || status.Log[0].User != "alice" || status.Log[0].Note != "Tensioned" {
+		t.Errorf("unexpected maintenance log %+v", status.Log)
+	}
+	if math.Abs(status.Log[0].Counters.XTravelMeters - 1.7) > 1e-9 {
+		t.Errorf("expected the counters at completion in the log, got %+v", status.Log[0].Counters)
+	}
+
+	// And becomes due again after another interval
+	trackMoves(p, "G1 X700", "G1 X200")
+	waitFor(t, "a second notification", func() bool { return events.count(EVENT_MAINTENANCE_DUE) == 2 })
+}
+
+func TestSdPrintUsage(t *testing.T) {
+	p, _ := maintenancePrinter(t)
+	p.SdUsage = map[string]GcodeUsage{ "BENCHY.GCO": analyzeGcode([]string{ "G28", "G1 X30 Y40 E2000", "G1 Z10" }) }
+
+	p.parseSdStatus("File opened: BENCHY.GCO Size: 1000")
+	p.parseSdStatus("SD printing byte 500/1000")
+	p.parseSdStatus("Done printing file")
+
+	c := p.GetMaintenance().Counters
+	for _, expected := range []struct{ name string; value, expected float64 }{
+		{ "extruded", c.ExtrudedMeters, 2 },
+		{ "travel", c.TravelMeters, 0.06 },
+		{ "X travel", c.XTravelMeters, 0.03 },
+		{ "Y travel", c.YTravelMeters, 0.04 },
+		{ "Z travel", c.ZTravelMeters, 0.01 },
+	} {
+		if math.Abs(expected.value - expected.expected) > 1e-9 {
+			t.Errorf("expected %g m %s, got %g m", expected.expected, expected.name, expected.value)
+		}
+	}
+}
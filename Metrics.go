@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricCommandsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dashprint_commands_sent_total",
+		Help: "G-code commands sent to the printer.",
+	}, []string{ "printer" })
+
+	metricBytesWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dashprint_serial_bytes_written_total",
+		Help: "Bytes written to the serial port.",
+	}, []string{ "printer" })
+
+	metricResends = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dashprint_resends_total",
+		Help: "Resend requests received from the printer.",
+	}, []string{ "printer" })
+
+	metricCommTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dashprint_comm_timeouts_total",
+		Help: "Timeouts waiting for a reply from the printer.",
+	}, []string{ "printer" })
+
+	metricReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dashprint_reconnects_total",
+		Help: "Reconnections scheduled after losing the serial port.",
+	}, []string{ "printer" })
+
+	metricChecksumErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dashprint_checksum_errors_total",
+		Help: "Checksum and line number errors reported by the printer.",
+	}, []string{ "printer" })
+
+	metricCommandLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "dashprint_command_duration_seconds",
+		Help: "Time from sending a command to receiving ok.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{ "printer" })
+)
+
+var (
+	descState = prometheus.NewDesc("dashprint_printer_state",
+		"Printer state: 0 stopped, 1 disconnected, 2 initializing, 3 connected.", []string{ "printer" }, nil)
+	descConnected = prometheus.NewDesc("dashprint_printer_connected",
+		"Whether the printer is connected.", []string{ "printer" }, nil)
+	descTemperature = prometheus.NewDesc("dashprint_heater_temperature_celsius",
+		"Current heater temperature.", []string{ "printer", "heater" }, nil)
+	descTarget = prometheus.NewDesc("dashprint_heater_target_celsius",
+		"Target heater temperature.", []string{ "printer", "heater" }, nil)
+	descJobState = prometheus.NewDesc("dashprint_job_state",
+		"Whether the printer's job is in the given state.", []string{ "printer", "state" }, nil)
+	descJobProgress = prometheus.NewDesc("dashprint_job_progress_ratio",
+		"Progress of the printer's job from 0 to 1.", []string{ "printer" }, nil)
+)
+
+var jobStates = []string{ JOB_PRINTING, JOB_PAUSED, JOB_INTERRUPTED }
+
+// Collects printer gauges at scrape time
+type printerCollector struct{}
+
+func (c printerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descState
+	ch <- descConnected
+	ch <- descTemperature
+	ch <- descTarget
+	ch <- descJobState
+	ch <- descJobProgress
+}
+
+func (c printerCollector) Collect(ch chan<- prometheus.Metric) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+
+	for name, printer := range printers {
+		state := printer.GetState()
+		connected := 0.0
+		if state == STATE_CONNECTED {
+			connected = 1
+		}
+
+		ch <- prometheus.MustNewConstMetric(descState, prometheus.GaugeValue, float64(state), name)
+		ch <- prometheus.MustNewConstMetric(descConnected, prometheus.GaugeValue, connected, name)
+
+		// Interrupted jobs outlive the connection
+		job := printer.GetJob()
+		for _, s := range jobStates {
+			value := 0.0
+			if job != nil && job.State == s {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(descJobState, prometheus.GaugeValue, value, name, s)
+		}
+		if job != nil {
+			ch <- prometheus.MustNewConstMetric(descJobProgress, prometheus.GaugeValue, job.Progress, name)
+		}
+
+		if state != STATE_CONNECTED {
+			continue
+		}
+
+		for heater, temp := range printer.GetTemperatures() {
+			ch <- prometheus.MustNewConstMetric(descTemperature, prometheus.GaugeValue, temp.Current, name, heater)
+			ch <- prometheus.MustNewConstMetric(descTarget, prometheus.GaugeValue, temp.Target, name, heater)
+		}
+	}
+}
+
+func init() {
+	prometheus.MustRegister(metricCommandsSent, metricBytesWritten, metricResends, metricCommTimeouts,
+		metricReconnects, metricChecksumErrors, metricCommandLatency, printerCollector{})
+}
+
+func observeCommandLatency(printer string, start time.Time) {
+	metricCommandLatency.WithLabelValues(printer).Observe(time.Since(start).Seconds())
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Subset of the Moonraker API (JSON-RPC over websocket and HTTP),
+// so that Mainsail, Fluidd and KlipperScreen can drive a printer.
+// Uploaded files go to the file store and are printed from there as
+// dashprint jobs.
+
+const (
+	MOONRAKER_STATUS_INTERVAL = 1000 // 1 second
+	// Requests of a client waiting to be handled
+	MOONRAKER_QUEUE_SIZE = 16
+)
+
+type MoonrakerSettings struct {
+	Enabled bool   `json:"enabled"`
+	// Printer exposed to Moonraker clients, the default printer if empty
+	Printer string `json:"printer"`
+}
+
+var moonrakerSettings MoonrakerSettings
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+var errMethodNotFound = &rpcError{ Code: -32601, Message: "Method not found" }
+var errInvalidParams = &rpcError{ Code: -32602, Message: "Invalid params" }
+var errPermissionDenied = &rpcError{ Code: 403, Message: "Permission denied" }
+
+type rpcRequest struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	Id      interface{}     `json:"id"`
+}
+
+type rpcResponse struct {
+	JsonRpc string      `json:"jsonrpc"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   *rpcError   `json:"error,omitempty"`
+	Id      interface{} `json:"id"`
+}
+
+type rpcNotification struct {
+	JsonRpc string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+// Websocket client speaking Moonraker JSON-RPC
+type moonrakerClient struct {
+	conn          *websocket.Conn
+	user          *User
+	remoteAddr    string
+	writeLock     sync.Mutex
+	subscription  map[string][]string
+	subscribeLock sync.Mutex
+	// Requests are handled one at a time, in the order they arrived
+	queue         chan []byte
+	done          chan int
+}
+
+func newMoonrakerClient(conn *websocket.Conn, r *http.Request) *moonrakerClient {
+	mc := &moonrakerClient{
+		conn: conn,
+		user: currentUser(r),
+		remoteAddr: remoteAddr(r),
+		queue: make(chan []byte, MOONRAKER_QUEUE_SIZE),
+		done: make(chan int),
+	}
+
+	go mc.handleQueue()
+	return mc
+}
+
+// Queue a request received from the client
+func (mc *moonrakerClient) receive(message []byte) {
+	select {
+		case mc.queue <- message:
+		case <-mc.done:
+	}
+}
+
+func (mc *moonrakerClient) handleQueue() {
+	for {
+		select {
+			case message := <-mc.queue:
+				mc.handleMessage(message)
+			case <-mc.done:
+				return
+		}
+	}
+}
+
+func (mc *moonrakerClient) write(v interface{}) {
+	mc.writeLock.Lock()
+	defer mc.writeLock.Unlock()
+
+	if err := mc.conn.WriteJSON(v); err != nil {
+		log.Println("WS write: ", err)
+	}
+}
+
+// Record a mutating call in the audit log
+func (mc *moonrakerClient) audit(req rpcRequest, err error) {
+	entry := AuditEntry{
+		Time: time.Now(),
+		User: mc.user.Username,
+		ApiKey: mc.user.apiKey,
+		RemoteAddr: mc.remoteAddr,
+		Action: "moonraker." + req.Method,
+		Status: http.StatusOK,
+	}
+
+	if p := getMoonrakerPrinter(); p != nil {
+		entry.Printer = p.UniqueName
+	}
+
+	json.Unmarshal(req.Params, &entry.Params)
+	redactAudit(entry.Params)
+
+	if err != nil {
+		entry.Status = http.StatusBadRequest
+	}
+
+	recordAudit(entry)
+}
+
+func (mc *moonrakerClient) close() {
+	close(mc.done)
+}
+
+func (mc *moonrakerClient) handleMessage(message []byte) {
+	var req rpcRequest
+	if err := json.Unmarshal(message, &req); err != nil || req.JsonRpc != "2.0" {
+		return
+	}
+
+	result, err := moonrakerCall(req.Method, req.Params, mc, mc.user)
+
+	if moonrakerMethodRole(req.Method) >= ROLE_OPERATOR {
+		mc.audit(req, err)
+	}
+
+	// Notifications do not get a response
+	if req.Id == nil {
+		return
+	}
+
+	resp := rpcResponse{ JsonRpc: "2.0", Id: req.Id }
+	if err != nil {
+		var re *rpcError
+		if !errors.As(err, &re) {
+			re = &rpcError{ Code: 400, Message: err.Error() }
+		}
+		resp.Error = re
+	} else {
+		resp.Result = result
+	}
+
+	mc.write(resp)
+}
+
+// Push subscribed printer objects until the client disconnects
+func (mc *moonrakerClient) statusLoop() {
+	for {
+		select {
+			case <-time.After(time.Millisecond * MOONRAKER_STATUS_INTERVAL):
+			case <-mc.done:
+				return
+		}
+
+		mc.subscribeLock.Lock()
+		objects := mc.subscription
+		mc.subscribeLock.Unlock()
+
+		p := getMoonrakerPrinter()
+		if p == nil {
+			continue
+		}
+
+		mc.write(rpcNotification{
+			JsonRpc: "2.0",
+			Method: "notify_status_update",
+			Params: []interface{}{ queryPrinterObjects(p, objects), secondsSinceEpoch() },
+		})
+	}
+}
+
+func secondsSinceEpoch() float64 {
+	return float64(time.Now().UnixNano()) / 1e9
+}
+
+func getMoonrakerPrinter() *Printer {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+
+	if moonrakerSettings.Printer != "" {
+		return printers[moonrakerSettings.Printer]
+	}
+	return printers[defaultPrinter]
+}
+
+func klippyState(p *Printer) string {
+	if p == nil {
+		return "disconnected"
+	}
+
+	switch p.GetState() {
+		case STATE_CONNECTED:
+			return "ready"
+		case STATE_INITIALIZING:
+			return "startup"
+		default:
+			return "shutdown"
+	}
+}
+
+var moonrakerObjects = []string{ "webhooks", "extruder", "heater_bed", "print_stats", "virtual_sdcard", "toolhead" }
+
+// Build status of the requested objects, a nil field list means all fields
+func queryPrinterObjects(p *Printer, objects map[string][]string) map[string]interface{} {
+	temps := p.GetTemperatures()
+	job := p.GetJob()
+	status := make(map[string]interface{})
+
+	for name, fields := range objects {
+		var obj map[string]interface{}
+
+		switch name {
+			case "webhooks":
+				obj = map[string]interface{}{ "state": klippyState(p), "state_message": stateString(p.GetState()) }
+			case "extruder":
+				obj = map[string]interface{}{ "temperature": temps["T"].Current, "target": temps["T"].Target, "power": 0 }
+			case "heater_bed":
+				obj = map[string]interface{}{ "temperature": temps["B"].Current, "target": temps["B"].Target, "power": 0 }
+			case "print_stats":
+				obj = map[string]interface{}{ "state": "standby", "filename": "", "print_duration": 0, "total_duration": 0, "filament_used": 0, "message": "" }
+				if job != nil {
+					obj["state"] = "paused"
+					if job.State == JOB_PRINTING {
+						obj["state"] = "printing"
+					}
+					obj["filename"] = job.File
+					obj["print_duration"] = job.PrintTime
+					obj["total_duration"] = time.Since(job.Started).Seconds()
+				}
+			case "virtual_sdcard":
+				obj = map[string]interface{}{ "progress": 0, "is_active": false, "file_position": 0 }
+				if job != nil {
+					obj["progress"] = job.Progress
+					obj["is_active"] = job.State == JOB_PRINTING
+					if info, err := statFile(job.File); err == nil {
+						obj["file_position"] = int64(job.Progress * float64(info.Size))
+					}
+				}
+			case "toolhead":
+				minX, maxX := p.axisRange(p.PrintArea.Width)
+				minY, maxY := p.axisRange(p.PrintArea.Depth)
+				obj = map[string]interface{}{
+					"homed_axes": "",
+					"position": []float64{ 0, 0, 0, 0 },
+					"axis_minimum": []float64{ minX, minY, 0, 0 },
+					"axis_maximum": []float64{ maxX, maxY, float64(p.PrintArea.Height), 0 },
+				}
+			default:
+				continue
+		}
+
+		if fields != nil {
+			filtered := make(map[string]interface{})
+			for _, f := range fields {
+				if v, ok := obj[f]; ok {
+					filtered[f] = v
+				}
+			}
+			obj = filtered
+		}
+
+		status[name] = obj
+	}
+
+	return status
+}
+
+// Role needed to call a method
+func moonrakerMethodRole(method string) int {
+	if method == "printer.gcode.script" || strings.HasPrefix(method, "printer.print.") {
+		return ROLE_OPERATOR
+	}
+	return ROLE_VIEWER
+}
+
+// Execute a Moonraker method. mc is nil for HTTP requests.
+func moonrakerCall(method string, params json.RawMessage, mc *moonrakerClient, user *User) (interface{}, error) {
+	p := getMoonrakerPrinter()
+
+	if user.role() < moonrakerMethodRole(method) || (p != nil && !user.canAccessPrinter(p.UniqueName)) {
+		return nil, errPermissionDenied
+	}
+
+	switch method {
+		case "server.info":
+			return map[string]interface{}{
+				"klippy_connected": p != nil && p.GetState() == STATE_CONNECTED,
+				"klippy_state": klippyState(p),
+				"components": []string{},
+				"failed_components": []string{},
+				"registered_directories": []string{},
+				"warnings": []string{},
+				"moonraker_version": "v0.0.0-dashprint",
+				"api_version": []int{ 1, 0, 0 },
+				"api_version_string": "1.0.0",
+			}, nil
+
+		case "printer.info":
+			hostname, _ := os.Hostname()
+			rv := map[string]interface{}{
+				"state": klippyState(p),
+				"state_message": "",
+				"hostname": hostname,
+				"software_version": "dashprint",
+			}
+			if p != nil {
+				rv["state_message"] = stateString(p.GetState())
+				if fw, ok := p.getBaseParameters()["FIRMWARE_NAME"]; ok {
+					rv["software_version"] = fw
+				}
+			}
+			return rv, nil
+
+		case "printer.objects.list":
+			return map[string]interface{}{ "objects": moonrakerObjects }, nil
+
+		case "printer.objects.query", "printer.objects.subscribe":
+			var args struct {
+				Objects map[string][]string `json:"objects"`
+			}
+			if err := json.Unmarshal(params, &args); err != nil {
+				return nil, errInvalidParams
+			}
+			if p == nil {
+				return nil, errors.New("Printer is not configured")
+			}
+
+			if method == "printer.objects.subscribe" {
+				if mc == nil {
+					return nil, errInvalidParams
+				}
+
+				mc.subscribeLock.Lock()
+				first := mc.subscription == nil
+				mc.subscription = args.Objects
+				mc.subscribeLock.Unlock()
+
+				if first {
+					go mc.statusLoop()
+				}
+			}
+
+			return map[string]interface{}{
+				"eventtime": secondsSinceEpoch(),
+				"status": queryPrinterObjects(p, args.Objects),
+			}, nil
+
+		case "printer.gcode.script":
+			var args struct {
+				Script string `json:"script"`
+			}
+			if err := json.Unmarshal(params, &args); err != nil || args.Script == "" {
+				return nil, errInvalidParams
+			}
+			if p == nil {
+				return nil, errors.New("Printer is not configured")
+			}
+
+			for _, line := range strings.Split(args.Script, "\n") {
+				line = strings.TrimSpace(line)
+				if line == "" {
+					continue
+				}
+
+				var cmdErr error
+				p.SendCommand(line, func(reply []string, err error) {
+					cmdErr = err
+				})
+				if cmdErr != nil {
+					return nil, cmdErr
+				}
+			}
+			return "ok", nil
+
+		case "printer.print.start":
+			var args struct {
+				Filename string `json:"filename"`
+			}
+			if err := json.Unmarshal(params, &args); err != nil || args.Filename == "" {
+				return nil, errInvalidParams
+			}
+			if p == nil {
+				return nil, errors.New("Printer is not configured")
+			}
+
+			if _, err := p.StartJob(args.Filename, user.Username); err != nil {
+				return nil, err
+			}
+			return "ok", nil
+
+		case "printer.print.pause", "printer.print.resume", "printer.print.cancel":
+			if p == nil {
+				return nil, errors.New("Printer is not configured")
+			}
+
+			var err error
+			switch method {
+				case "printer.print.pause":
+					err = p.PauseJob()
+				case "printer.print.resume":
+					err = p.ResumeJob()
+				default:
+					err = p.CancelJob()
+			}
+			if err != nil {
+				return nil, err
+			}
+			return "ok", nil
+
+		default:
+			return nil, errMethodNotFound
+	}
+}
+
+func SetupRouteMoonraker(router *mux.Router) {
+	router.HandleFunc("/server/info", requireRole(ROLE_VIEWER, handleMoonrakerHttp("server.info"))).Methods("GET")
+	router.HandleFunc("/printer/info", requireRole(ROLE_VIEWER, handleMoonrakerHttp("printer.info"))).Methods("GET")
+	router.HandleFunc("/printer/objects/list", requireRole(ROLE_VIEWER, handleMoonrakerHttp("printer.objects.list"))).Methods("GET")
+	router.HandleFunc("/printer/objects/query", requireRole(ROLE_VIEWER, handleMoonrakerHttp("printer.objects.query"))).Methods("GET", "POST")
+	router.HandleFunc("/printer/gcode/script", audited("moonraker.printer.gcode.script", requireRole(ROLE_OPERATOR, handleMoonrakerHttp("printer.gcode.script")))).Methods("POST")
+	router.HandleFunc("/printer/print/start", audited("moonraker.printer.print.start", requireRole(ROLE_OPERATOR, handleMoonrakerHttp("printer.print.start")))).Methods("POST")
+	router.HandleFunc("/printer/print/pause", audited("moonraker.printer.print.pause", requireRole(ROLE_OPERATOR, handleMoonrakerHttp("printer.print.pause")))).Methods("POST")
+	router.HandleFunc("/printer/print/resume", audited("moonraker.printer.print.resume", requireRole(ROLE_OPERATOR, handleMoonrakerHttp("printer.print.resume")))).Methods("POST")
+	router.HandleFunc("/printer/print/cancel", audited("moonraker.printer.print.cancel", requireRole(ROLE_OPERATOR, handleMoonrakerHttp("printer.print.cancel")))).Methods("POST")
+	router.HandleFunc("/server/files/upload", fileTransfer(audited("moonraker.server.files.upload", requireRole(ROLE_OPERATOR, handleMoonrakerUpload)))).Methods("POST")
+}
+
+// Convert HTTP query arguments to JSON-RPC params, e.g.
+// /printer/objects/query?extruder=target,temperature&webhooks
+func moonrakerHttpParams(method string, r *http.Request) json.RawMessage {
+	query := r.URL.Query()
+	var params interface{}
+
+	switch method {
+		case "printer.objects.query":
+			objects := make(map[string][]string)
+			for name, values := range query {
+				if len(values) == 0 || values[0] == "" {
+					objects[name] = nil
+				} else {
+					objects[name] = strings.Split(values[0], ",")
+				}
+			}
+			params = map[string]interface{}{ "objects": objects }
+		default:
+			args := make(map[string]string)
+			for name, values := range query {
+				args[name] = values[0]
+			}
+			params = args
+	}
+
+	js, _ := json.Marshal(params)
+	return js
+}
+
+func handleMoonrakerHttp(method string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		result, err := moonrakerCall(method, moonrakerHttpParams(method, r), nil, currentUser(r))
+		if err != nil {
+			code := http.StatusBadRequest
+			if err == errMethodNotFound {
+				code = http.StatusNotFound
+			} else if err == errPermissionDenied {
+				code = http.StatusForbidden
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		js, err := json.Marshal(map[string]interface{}{ "result": result })
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
+
+// Store multipart field "file", with print=true a job is started with it
+func handleMoonrakerUpload(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if root := r.FormValue("root"); root != "" && root != "gcodes" {
+		http.Error(w, "Unsupported root " + root, http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	stored, err := storeFile(header.Filename, file)
+	if err == errBadFileName {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err == errFileInUse {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	printFile := r.FormValue("print") == "true"
+	if printFile {
+		p := getMoonrakerPrinter()
+		if p == nil {
+			http.Error(w, "Printer is not configured", http.StatusConflict)
+			return
+		}
+
+		user := currentUser(r)
+		if !user.canAccessPrinter(p.UniqueName) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		if _, err := p.StartJob(stored.Name, user.Username); err != nil {
+			log.Printf("Moonraker API: cannot print %s: %v\n", stored.Name, err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	js, err := json.Marshal(map[string]interface{}{
+		"item": map[string]string{ "path": stored.Name, "root": "gcodes" },
+		"print_started": printFile,
+		"print_queued": false,
+		"action": "create_file",
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Machine state as changed by G-code sent to a printer. Shared by the limit
+// checks (Profiles), filament tracking (Spools) and usage counters (Maintenance).
+//
+// Positions are logical, as used by G-code, i.e. including G92 offsets. Axes
+// count as known once homed or moved to an absolute position; before that the
+// printer may be anywhere and moves are not checked.
+type motionState struct {
+	// G91, relative X, Y and Z
+	relative  bool
+	// M83 or G91, relative E
+	relativeE bool
+	position  [3]float64
+	e         float64
+	// Logical minus machine position, as set by G92
+	offset    [3]float64
+	known     [3]bool
+	// False after G92 on an axis with unknown position
+	offsetKnown [3]bool
+	// Machine position after G28
+	home      [3]float64
+	tool      int
+}
+
+// Effect of a G0-G3 move
+type motionMove struct {
+	// Machine coordinates along the path to check against the print area:
+	// the end point and, for arcs, the points reaching furthest out
+	points    [][3]float64
+	// Whether the position of each axis is known, else points are meaningless there
+	known     [3]bool
+	// Distance travelled along each axis and in space, mm
+	travel    [3]float64
+	length    float64
+	// Filament pushed by the current tool, mm, negative for retractions
+	extruded  float64
+	tool      int
+}
+
+// Parse parameters such as X10.5 into values by upper case letter. Letters
+// without a value (G28 X) are present with value 0.
+func parseMotionParams(params []string) map[string]float64 {
+	values := make(map[string]float64)
+	for _, param := range params {
+		if param == "" {
+			continue
+		}
+		v, _ := strconv.ParseFloat(param[1:], 64)
+		values[strings.ToUpper(param[:1])] = v
+	}
+	return values
+}
+
+// State of a freshly (re)started firmware: absolute mode, T0 and no offsets
+func newMotionState(profile PrinterProfile, area PrintArea) motionState {
+	m := motionState{ offsetKnown: [3]bool{ true, true, true } }
+
+	// Delta printers home to the top
+	if profile.Kinematics == KINEMATICS_DELTA {
+		m.home[2] = float64(area.Height)
+	}
+	return m
+}
+
+// Compute the state after a command and the move it makes, if any, without changing m
+func (m motionState) next(cmd string, params []string) (motionState, *motionMove) {
+	values := parseMotionParams(params)
+
+	switch cmd {
+		case "G90":
+			m.relative = false
+			m.relativeE = false
+		case "G91":
+			m.relative = true
+			m.relativeE = true
+		case "M82":
+			m.relativeE = false
+		case "M83":
+			m.relativeE = true
+		case "G28":
+			homeAll := true
+			for _, name := range []string{ "X", "Y", "Z" } {
+				if _, ok := values[name]; ok {
+					homeAll = false
+				}
+			}
+
+			for axis, name := range []string{ "X", "Y", "Z" } {
+				if _, ok := values[name]; ok || homeAll {
+					m.position[axis] = m.home[axis]
+					m.offset[axis] = 0
+					m.known[axis] = true
+					m.offsetKnown[axis] = true
+				}
+			}
+		case "G92":
+			for axis, name := range []string{ "X", "Y", "Z" } {
+				v, ok := values[name]
+				if !ok {
+					continue
+				}
+				m.offset[axis] += v - m.position[axis]
+				m.offsetKnown[axis] = m.offsetKnown[axis] && m.known[axis]
+				m.position[axis] = v
+			}
+			if v, ok := values["E"]; ok {
+				m.e = v
+			}
+		case "G0", "G1", "G2", "G3":
+			return m.move(cmd, values)
+		default:
+			if tool, err := strconv.Atoi(strings.TrimPrefix(cmd, "T")); err == nil && strings.HasPrefix(cmd, "T") {
+				m.tool = tool
+			}
+	}
+
+	return m, nil
+}
+
+func (m motionState) move(cmd string, values map[string]float64) (motionState, *motionMove) {
+	start := m.position
+	move := &motionMove{ tool: m.tool }
+
+	for axis, name := range []string{ "X", "Y", "Z" } {
+		v, ok := values[name]
+		if !ok {
+			continue
+		}
+
+		if m.relative {
+			m.position[axis] += v
+		} else {
+			m.position[axis] = v
+			m.known[axis] = m.offsetKnown[axis]
+		}
+	}
+	move.known = m.known
+
+	if v, ok := values["E"]; ok {
+		if m.relativeE {
+			move.extruded = v
+			m.e += v
+		} else {
+			move.extruded = v - m.e
+			m.e = v
+		}
+	}
+
+	// Logical positions along the path
+	path := [][3]float64{ start }
+	if cmd == "G2" || cmd == "G3" {
+		var length float64
+		path, length = arcPath(start, m.position, values, cmd == "G2")
+		move.length = length
+	} else {
+		path = append(path, m.position)
+		move.length = math.Sqrt(sq(m.position[0] - start[0]) + sq(m.position[1] - start[1]) + sq(m.position[2] - start[2]))
+	}
+
+	for i, point := range path {
+		if i > 0 {
+			for axis := range point {
+				move.travel[axis] += math.Abs(point[axis] - path[i-1][axis])
+			}
+			var machine [3]float64
+			for axis := range point {
+				machine[axis] = point[axis] - m.offset[axis]
+			}
+			move.points = append(move.points, machine)
+		}
+	}
+
+	return m, move
+}
+
+func sq(v float64) float64 {
+	return v * v
+}
+
+// Points of an arc from start to end, in order: start, the points where X or Y
+// turn around or that are furthest from the origin, and end. X and Y change
+// monotonically between consecutive points. Also returns the length of the arc.
+// The center is given relative to the start by I and J, or by the radius R.
+func arcPath(start, end [3]float64, values map[string]float64, clockwise bool) ([][3]float64, float64) {
+	var cx, cy float64
+
+	if r, ok := values["R"]; ok {
+		// As Marlin does, a negative radius selects the longer arc
+		dx, dy := end[0] - start[0], end[1] - start[1]
+		d := math.Hypot(dx, dy)
+		if d == 0 {
+			return [][3]float64{ start, end }, math.Abs(end[2] - start[2])
+		}
+
+		e := 1.0
+		if clockwise != (r < 0) {
+			e = -1
+		}
+		h := math.Sqrt(math.Max(0, (r - d / 2) * (r + d / 2)))
+		cx = (start[0] + end[0]) / 2 + e * h * -dy / d
+		cy = (start[1] + end[1]) / 2 + e * h * dx / d
+	} else {
+		cx = start[0] + values["I"]
+		cy = start[1] + values["J"]
+	}
+
+	radius := math.Hypot(start[0] - cx, start[1] - cy)
+	a0 := math.Atan2(start[1] - cy, start[0] - cx)
+	a1 := math.Atan2(end[1] - cy, end[0] - cx)
+
+	// Angle travelled from a0, always positive, in the direction of the arc
+	along := func(a float64) float64 {
+		d := a - a0
+		if clockwise {
+			d = -d
+		}
+		return math.Mod(math.Mod(d, 2 * math.Pi) + 2 * math.Pi, 2 * math.Pi)
+	}
+
+	sweep := along(a1)
+	if sweep < 1e-9 {
+		// Same start and end, a full circle
+		sweep = 2 * math.Pi
+	}
+
+	angles := []float64{ 0, math.Pi / 2, math.Pi, -math.Pi / 2 }
+	if cx != 0 || cy != 0 {
+		// Furthest from the origin, for delta printers
+		angles = append(angles, math.Atan2(cy, cx))
+	}
+
+	turns := make([]float64, 0)
+	for _, a := range angles {
+		if d := along(a); d > 0 && d < sweep {
+			turns = append(turns, d)
+		}
+	}
+	sort.Float64s(turns)
+
+	path := [][3]float64{ start }
+	for _, d := range turns {
+		a := a0 + d
+		if clockwise {
+			a = a0 - d
+		}
+		z := start[2] + (end[2] - start[2]) * d / sweep
+		path = append(path, [3]float64{ cx + radius * math.Cos(a), cy + radius * math.Sin(a), z })
+	}
+	path = append(path, end)
+
+	return path, math.Hypot(radius * sweep, end[2] - start[2])
+}
+
+// Reset tracking on (re)connection
+func (p *Printer) resetMotion() {
+	p.motion = newMotionState(p.Profile, p.PrintArea)
+}
+
+// Follow a command sent to the printer, counting filament and travel of moves
+func (p *Printer) trackMotion(cmd string, params []string) {
+	next, move := p.motion.next(cmd, params)
+	p.motion = next
+
+	if move != nil {
+		p.trackExtrusion(move)
+		p.trackUsage(move)
+	}
+}
+
+// What printing a G-code file uses
+type GcodeUsage struct {
+	// mm per extruder
+	Filament []float64  `json:"filament"`
+	// mm along X, Y and Z and in space
+	Travel   [3]float64 `json:"travel"`
+	Length   float64    `json:"length"`
+}
+
+// Usage of a G-code file. Lines must be free of comments.
+func analyzeGcode(lines []string) GcodeUsage {
+	usage := GcodeUsage{ Filament: make([]float64, 0) }
+	m := motionState{ offsetKnown: [3]bool{ true, true, true } }
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var move *motionMove
+		m, move = m.next(strings.ToUpper(fields[0]), fields[1:])
+		if move == nil {
+			continue
+		}
+
+		for axis, d := range move.travel {
+			usage.Travel[axis] += d
+		}
+		usage.Length += move.length
+
+		if move.tool < 0 {
+			continue
+		}
+		for len(usage.Filament) <= move.tool {
+			usage.Filament = append(usage.Filament, 0)
+		}
+		usage.Filament[move.tool] += move.extruded
+	}
+
+	// A file that only retracts uses no filament
+	for i := range usage.Filament {
+		usage.Filament[i] = math.Max(0, usage.Filament[i])
+	}
+	return usage
+}
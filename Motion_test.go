@@ -0,0 +1,291 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run G-code lines through a fresh motion state, returning the state and the last move
+func runMotion(m motionState, gcode string) (motionState, *motionMove) {
+	var move *motionMove
+	for _, line := range strings.Split(gcode, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		m, move = m.next(fields[0], fields[1:])
+	}
+	return m, move
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a - b) < 1e-6
+}
+
+func TestMotionExtrusion(t *testing.T) {
+	tests := []struct {
+		name     string
+		gcode    string
+		extruded float64
+	}{
+		{ "Absolute", "G1 X10 E5\nG1 X20 E7.5", 2.5 },
+		{ "Relative E", "M83\nG1 X10 E5\nG1 X20 E2.5", 2.5 },
+		{ "G91", "G91\nG1 X10 E1.5", 1.5 },
+		{ "G90 after M83", "M83\nG90\nG1 E5\nG1 E7", 2 },
+		{ "G92 reset", "G1 E100\nG92 E0\nG1 E1", 1 },
+		{ "Retraction", "G1 E10\nG1 E9.2", -0.8 },
+		{ "Arc", "G1 X10 Y0 E3\nG3 X0 Y10 I-10 J0 E4.5", 1.5 },
+	}
+
+	for _, test := range tests {
+		_, move := runMotion(motionState{ offsetKnown: [3]bool{ true, true, true } }, test.gcode)
+		if !almostEqual(move.extruded, test.extruded) {
+			t.Errorf("%s: expected %g extruded, got %g", test.name, test.extruded, move.extruded)
+		}
+	}
+
+	m, move := runMotion(motionState{}, "T1\nG1 E5")
+	if m.tool != 1 || move.tool != 1 {
+		t.Errorf("expected moves by tool 1, got %d", move.tool)
+	}
+}
+
+func TestMotionOffsets(t *testing.T) {
+	m := newMotionState(PrinterProfile{}, PrintArea{})
+
+	// Absolute moves are at known positions right away
+	m, move := runMotion(m, "G1 X10 Y20")
+	if !move.known[0] || !move.known[1] || move.known[2] {
+		t.Errorf("unexpected known axes %v", move.known)
+	}
+
+	m, move = runMotion(m, "G28\nG92 X10 Y-5\nG1 X20 Y0 Z1")
+	if p := move.points[0]; p != [3]float64{ 10, 5, 1 } {
+		t.Errorf("expected machine position 10/5/1, got %v", p)
+	}
+	if m.position != [3]float64{ 20, 0, 1 } {
+		t.Errorf("expected logical position 20/0/1, got %v", m.position)
+	}
+
+	// Homing clears the offset of homed axes only
+	m, move = runMotion(m, "G28 X\nG1 X20 Y0")
+	if p := move.points[0]; p[0] != 20 || p[1] != 5 {
+		t.Errorf("expected machine position 20/5, got %v", p)
+	}
+
+	// G92 before homing makes the machine position unknown
+	m, move = runMotion(newMotionState(PrinterProfile{}, PrintArea{}), "G91\nG1 X5\nG90\nG92 X0\nG1 X100")
+	if move.known[0] {
+		t.Error("X should be unknown after G92 at an unknown position")
+	}
+
+	// Delta printers home to the top
+	m = newMotionState(PrinterProfile{ Kinematics: KINEMATICS_DELTA }, PrintArea{ Height: 300 })
+	if m, _ = runMotion(m, "G28"); m.position[2] != 300 {
+		t.Errorf("expected Z300 after homing, got %g", m.position[2])
+	}
+}
+
+func TestMotionArcs(t *testing.T) {
+	tests := []struct {
+		name   string
+		gcode  string
+		travel [3]float64
+		length float64
+		end    [3]float64
+	}{
+		{ "Quarter", "G1 X10 Y0\nG3 X0 Y10 I-10 J0", [3]float64{ 10, 10, 0 }, 5 * math.Pi, [3]float64{ 0, 10, 0 } },
+		{ "Half clockwise", "G1 X0 Y0\nG2 X20 Y0 I10 J0", [3]float64{ 20, 20, 0 }, 10 * math.Pi, [3]float64{ 20, 0, 0 } },
+		{ "Radius", "G1 X0 Y0\nG2 X20 Y0 R10", [3]float64{ 20, 20, 0 }, 10 * math.Pi, [3]float64{ 20, 0, 0 } },
+		{ "Full circle", "G1 X20 Y10\nG2 X20 Y10 I-10 J0", [3]float64{ 40, 40, 0 }, 20 * math.Pi, [3]float64{ 20, 10, 0 } },
+		{ "Helix", "G1 X10 Y0 Z0\nG3 X10 Y0 Z2 I-10 J0", [3]float64{ 40, 40, 2 }, math.Hypot(20 * math.Pi, 2), [3]float64{ 10, 0, 2 } },
+		{ "Relative", "G1 X10 Y0\nG91\nG3 X-10 Y10 I-10 J0", [3]float64{ 10, 10, 0 }, 5 * math.Pi, [3]float64{ 0, 10, 0 } },
+	}
+
+	for _, test := range tests {
+		m, move := runMotion(motionState{ offsetKnown: [3]bool{ true, true, true } }, test.gcode)
+
+		for axis := range test.travel {
+			if !almostEqual(move.travel[axis], test.travel[axis]) {
+				t.Errorf("%s: expected travel %v, got %v", test.name, test.travel, move.travel)
+				break
+			}
+		}
+		if !almostEqual(move.length, test.length) {
+			t.Errorf("%s: expected length %g, got %g", test.name, test.length, move.length)
+		}
+		if m.position != test.end {
+			t.Errorf("%s: expected end %v, got %v", test.name, test.end, m.position)
+		}
+	}
+}
+
+func TestMoveLimits(t *testing.T) {
+	p := LoadPrinter(PrinterSettings{
+		UniqueName: "test",
+		PrintArea: PrintArea{ Width: 100, Depth: 100, Height: 100 },
+		Profile: PrinterProfile{ Kinematics: KINEMATICS_CARTESIAN, Origin: ORIGIN_FRONT_LEFT },
+	})
+
+	tests := []struct {
+		name  string
+		setup string
+		cmd   string
+		ok    bool
+	}{
+		{ "Inside", "", "G1 X50 Y50 Z10", true },
+		{ "Outside", "", "G1 X150", false },
+		{ "Relative before homing", "G91", "G1 X150", true },
+		{ "Relative after homing", "G28\nG91", "G1 X150", false },
+		{ "Relative inside", "G28\nG1 X50\nG91", "G1 X-40", true },
+		{ "G92 offset", "G28\nG92 X-60", "G1 X50", false },
+		{ "G92 offset inside", "G28\nG1 X80\nG92 X0", "G1 X-70", true },
+		{ "Arc inside", "G1 X10 Y90", "G3 X90 Y90 I40 J0", true },
+		{ "Arc bulging out", "G1 X10 Y90", "G2 X90 Y90 I40 J0", false },
+		{ "Arc by radius", "G1 X10 Y50", "G2 X90 Y50 R-40", true },
+	}
+
+	for _, test := range tests {
+		p.resetMotion()
+		for _, line := range strings.Split(test.setup, "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 {
+				p.motion, _ = p.motion.next(fields[0], fields[1:])
+			}
+		}
+
+		fields := strings.Fields(test.cmd)
+		err := p.checkLimits(fields[0], fields[1:])
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestDeltaArcLimits(t *testing.T) {
+	p := LoadPrinter(PrinterSettings{
+		UniqueName: "test",
+		PrintArea: PrintArea{ Width: 200, Depth: 200, Height: 300 },
+		Profile: PrinterProfile{ Kinematics: KINEMATICS_DELTA, DeltaRadius: 100 },
+	})
+	p.resetMotion()
+	p.motion, _ = p.motion.next("G1", []string{ "X60", "Y60" })
+
+	// Both ends are within the radius, the arc around 60/0 is not
+	if err := p.checkLimits("G2", []string{ "X60", "Y-60", "I0", "J-60" }); err == nil {
+		t.Error("expected the arc to leave the printable radius")
+	}
+	if err := p.checkLimits("G3", []string{ "X60", "Y-60", "I0", "J-60" }); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestTemperatureLimits(t *testing.T) {
+	p := LoadPrinter(PrinterSettings{ UniqueName: "test", Profile: printerModels["ender-3"].Profile })
+
+	tests := []struct {
+		cmd string
+		ok  bool
+	}{
+		{ "M104 S210", true },
+		{ "M104 S300", false },
+		{ "M109 S210", true },
+		{ "M109 R300", false },
+		{ "M109 S200 R300", false },
+		{ "M190 S60", true },
+		{ "M190 S150", false },
+	}
+
+	for _, test := range tests {
+		fields := strings.Fields(test.cmd)
+		err := p.checkLimits(fields[0], fields[1:])
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", test.cmd, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: expected an error", test.cmd)
+		}
+	}
+}
+
+func TestTrackAcknowledgedMoves(t *testing.T) {
+	p, written := thermalPrinter(t, "")
+	defer written()
+	p.state = STATE_CONNECTED
+	p.readChannel = make(chan *string, 1)
+	p.resetMotion()
+	p.usage.lastSave = time.Now()
+
+	ok := "ok"
+	p.readChannel <- &ok
+	p.sendCommand("G1 X10 E5", nil, true)
+
+	// The printer does not answer, so the move may not have happened
+	close(p.readChannel)
+	p.sendCommand("G1 X20 E8", nil, true)
+
+	if pending := p.extrusion.pending[0]; pending != 5 {
+		t.Errorf("expected 5 mm pending, got %g", pending)
+	}
+	if p.motion.position[0] != 10 {
+		t.Errorf("expected X10, got %g", p.motion.position[0])
+	}
+}
+
+func TestAnalyzeGcode(t *testing.T) {
+	usage := analyzeGcode([]string{ "G28", "M83", "G1 X10 E5", "G1 E-1", "T1", "G1 X20 E3", "G92 E0", "G1 E1" })
+	if len(usage.Filament) != 2 || usage.Filament[0] != 4 || usage.Filament[1] != 4 {
+		t.Errorf("expected 4 mm on each extruder, got %v", usage.Filament)
+	}
+
+	// A file that only retracts uses no filament
+	if usage = analyzeGcode([]string{ "G28", "G1 E-2" }); len(usage.Filament) != 1 || usage.Filament[0] != 0 {
+		t.Errorf("expected no filament used, got %v", usage.Filament)
+	}
+}
+
+func TestCheckGcode(t *testing.T) {
+	p := LoadPrinter(PrinterSettings{
+		UniqueName: "test",
+		PrintArea: PrintArea{ Width: 100, Depth: 100, Height: 100 },
+		Profile: printerModels["ender-3"].Profile,
+	})
+
+	tests := []struct {
+		name  string
+		gcode string
+		err   string
+	}{
+		{ "Inside", "G28\nM104 S210\nG1 X50 Y50 Z10\nG91\nG1 X40", "" },
+		{ "Relative before homing", "G91\nG1 X150\nG90\nG28", "" },
+		{ "Relative after homing", "G28\nG1 X50\nG91\nG1 X40\nG1 X40", "G1 X40: X130" },
+		{ "Hotend", "G28\nM104 T0 S300", "M104 T0 S300" },
+		{ "Bed", "M190 S150", "M190 S150" },
+	}
+
+	for _, test := range tests {
+		err := p.checkGcode(strings.Split(test.gcode, "\n"))
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected an error about %q, got %v", test.name, test.err, err)
+		}
+	}
+
+	// The printer's own position does not matter
+	p.resetMotion()
+	p.motion, _ = p.motion.next("G28", nil)
+	p.motion, _ = p.motion.next("G91", nil)
+	if err := p.checkGcode([]string{ "G1 X50 Y50" }); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if _, err := p.UploadSdFile("big.gcode", []byte("G28 ; home\nG1 X150 Y10\n")); err == nil {
+		t.Error("uploading a file leaving the print area should be refused")
+	}
+	if upload := p.GetSdUpload(); upload != nil {
+		t.Errorf("no upload should have started, got %+v", upload)
+	}
+}
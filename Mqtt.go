@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	MQTT_PUBLISH_INTERVAL = 5000 // 5 seconds
+	MQTT_QOS = 1
+)
+
+type MqttSettings struct {
+	// Broker URL, e.g. tcp://localhost:1883. The bridge is disabled if empty.
+	Broker          string `json:"broker"`
+	ClientId        string `json:"clientId"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	TopicPrefix     string `json:"topicPrefix"`
+	// Publish Home Assistant MQTT discovery payloads
+	Discovery       bool   `json:"discovery"`
+	DiscoveryPrefix string `json:"discoveryPrefix"`
+}
+
+var mqttSettings MqttSettings
+var mqttClient mqtt.Client
+
+// PrinterListener publishing printer state to MQTT
+type printerMqtt struct {
+	printer *Printer
+}
+
+func startMqtt() {
+	if mqttSettings.Broker == "" {
+		return
+	}
+
+	if mqttSettings.TopicPrefix == "" {
+		mqttSettings.TopicPrefix = "dashprint"
+	}
+	if mqttSettings.DiscoveryPrefix == "" {
+		mqttSettings.DiscoveryPrefix = "homeassistant"
+	}
+	if mqttSettings.ClientId == "" {
+		mqttSettings.ClientId = "dashprint"
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(mqttSettings.Broker).
+		SetClientID(mqttSettings.ClientId).
+		SetUsername(mqttSettings.Username).
+		SetPassword(mqttSettings.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(mqttTopic("status"), "offline", MQTT_QOS, true).
+		SetOnConnectHandler(onMqttConnected).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			log.Println("MQTT connection lost: ", err)
+		})
+
+	mqttClient = mqtt.NewClient(opts)
+	mqttClient.Connect()
+
+	go mqttPublishLoop()
+}
+
+func mqttTopic(parts ...string) string {
+	return mqttSettings.TopicPrefix + "/" + strings.Join(parts, "/")
+}
+
+func mqttPublish(topic string, retained bool, payload interface{}) {
+	if mqttClient == nil || !mqttClient.IsConnected() {
+		return
+	}
+
+	var data []byte
+
+	switch v := payload.(type) {
+		case string:
+			data = []byte(v)
+		default:
+			var err error
+			data, err = json.Marshal(v)
+			if err != nil {
+				log.Printf("MQTT: cannot encode payload for %s: %v\n", topic, err)
+				return
+			}
+	}
+
+	mqttClient.Publish(topic, MQTT_QOS, retained, data)
+}
+
+func onMqttConnected(c mqtt.Client) {
+	log.Println("Connected to MQTT broker ", mqttSettings.Broker)
+
+	mqttPublish(mqttTopic("status"), true, "online")
+
+	printerMutex.RLock()
+	for _, printer := range printers {
+		publishPrinterInfo(printer)
+	}
+	printerMutex.RUnlock()
+
+	c.Subscribe(mqttTopic("+", "command", "#"), MQTT_QOS, onMqttCommand)
+}
+
+// Publish retained state and firmware information of a printer
+func publishPrinterInfo(p *Printer) {
+	mqttPublish(mqttTopic(p.UniqueName, "state"), true, stateString(p.GetState()))
+	publishJob(p)
+
+	if params := p.getBaseParameters(); params != nil {
+		mqttPublish(mqttTopic(p.UniqueName, "firmware"), true, params)
+	}
+
+	if mqttSettings.Discovery {
+		publishDiscovery(p)
+	}
+}
+
+// Publish the retained state and progress of the printer's job
+func publishJob(p *Printer) {
+	state := map[string]interface{}{ "state": "idle", "progress": 0 }
+	if job := p.GetJob(); job != nil {
+		state = map[string]interface{}{
+			"state": job.State,
+			"file": job.File,
+			"progress": job.Progress,
+			"layer": job.Layer,
+			"printTime": job.PrintTime,
+			"started": job.Started,
+		}
+	}
+
+	mqttPublish(mqttTopic(p.UniqueName, "job"), true, state)
+}
+
+// Publish Home Assistant discovery payloads for printer sensors
+func publishDiscovery(p *Printer) {
+	device := map[string]interface{}{
+		"identifiers": []string{ "dashprint_" + p.UniqueName },
+		"name": p.Name,
+		"manufacturer": "dashprint",
+	}
+	if fw, ok := p.getBaseParameters()["FIRMWARE_NAME"]; ok {
+		device["sw_version"] = fw
+	}
+
+	sensors := []struct {
+		id, name, topic, template, unit, class string
+	}{
+		{ "state", "State", "state", "", "", "" },
+		{ "hotend", "Hotend temperature", "temperatures", "{{ value_json.T.current }}", "°C", "temperature" },
+		{ "hotend_target", "Hotend target", "temperatures", "{{ value_json.T.target }}", "°C", "temperature" },
+		{ "bed", "Bed temperature", "temperatures", "{{ value_json.B.current }}", "°C", "temperature" },
+		{ "bed_target", "Bed target", "temperatures", "{{ value_json.B.target }}", "°C", "temperature" },
+		{ "job_state", "Job", "job", "{{ value_json.state }}", "", "" },
+		{ "job_progress", "Job progress", "job", "{{ (value_json.progress * 100) | round(1) }}", "%", "" },
+	}
+
+	for _, s := range sensors {
+		uniqueId := "dashprint_" + p.UniqueName + "_" + s.id
+		config := map[string]interface{}{
+			"name": p.Name + " " + s.name,
+			"unique_id": uniqueId,
+			"state_topic": mqttTopic(p.UniqueName, s.topic),
+			"availability_topic": mqttTopic("status"),
+			"device": device,
+		}
+		if s.template != "" {
+			config["value_template"] = s.template
+		}
+		if s.unit != "" {
+			config["unit_of_measurement"] = s.unit
+		}
+		if s.class != "" {
+			config["device_class"] = s.class
+		}
+
+		mqttPublish(mqttSettings.DiscoveryPrefix + "/sensor/" + uniqueId + "/config", true, config)
+	}
+}
+
+// Handle <prefix>/<printer>/command/gcode, <prefix>/<printer>/command/macro/<name>
+// and <prefix>/<printer>/command/job/<pause|resume|cancel>
+func onMqttCommand(c mqtt.Client, msg mqtt.Message) {
+	parts := strings.Split(strings.TrimPrefix(msg.Topic(), mqttSettings.TopicPrefix + "/"), "/")
+	if len(parts) < 3 {
+		return
+	}
+
+	printerMutex.RLock()
+	printer, ok := printers[parts[0]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		log.Printf("MQTT: command for unknown printer %s\n", parts[0])
+		return
+	}
+
+	recordAudit(AuditEntry{
+		Time: time.Now(),
+		User: "mqtt",
+		RemoteAddr: mqttSettings.Broker,
+		Printer: printer.UniqueName,
+		Action: "mqtt." + strings.Join(parts[2:], "."),
+		Params: map[string]interface{}{ "payload": string(msg.Payload()) },
+	})
+
+	switch parts[2] {
+		case "gcode":
+			go func() {
+				for _, line := range strings.Split(string(msg.Payload()), "\n") {
+					line = strings.TrimSpace(line)
+					if line != "" {
+						printer.SendCommand(line, nil)
+					}
+				}
+			}()
+		case "macro":
+			if len(parts) < 4 {
+				return
+			}
+
+			params := make(map[string]string)
+			if len(msg.Payload()) > 0 {
+				if err := json.Unmarshal(msg.Payload(), &params); err != nil {
+					printer.log().Errorf("MQTT: invalid macro parameters: %v", err)
+					return
+				}
+			}
+
+			printerMutex.RLock()
+			err := printer.RunMacro(parts[3], params)
+			printerMutex.RUnlock()
+
+			if err != nil {
+				printer.log().Errorf("MQTT: cannot run macro %s: %v", parts[3], err)
+			}
+		case "job":
+			if len(parts) < 4 {
+				return
+			}
+
+			var action func() error
+			switch parts[3] {
+				case "pause":
+					action = printer.PauseJob
+				case "resume":
+					action = printer.ResumeJob
+				case "cancel":
+					action = printer.CancelJob
+				default:
+					printer.log().Warnf("MQTT: unknown job command %s", parts[3])
+					return
+			}
+
+			// Cancelling turns off the heaters, don't block the client meanwhile
+			go func() {
+				if err := action(); err != nil {
+					printer.log().Errorf("MQTT: cannot %s job: %v", parts[3], err)
+				}
+			}()
+		default:
+			printer.log().Warnf("MQTT: unknown command %s", parts[2])
+	}
+}
+
+// Temperatures and job progress change all the time, publish them periodically
+func mqttPublishLoop() {
+	for {
+		time.Sleep(time.Millisecond * MQTT_PUBLISH_INTERVAL)
+
+		printerMutex.RLock()
+		for _, printer := range printers {
+			if printer.GetState() == STATE_CONNECTED {
+				mqttPublish(mqttTopic(printer.UniqueName, "temperatures"), true, printer.GetTemperatures())
+				publishJob(printer)
+			}
+		}
+		printerMutex.RUnlock()
+	}
+}
+
+func (m *printerMqtt) onPrinterStateChanged(oldState int, newState int) {
+	publishPrinterInfo(m.printer)
+}
+
+func (m *printerMqtt) onPrinterEvent(event PrinterEvent) {
+	mqttPublish(mqttTopic(m.printer.UniqueName, "event"), false, event)
+
+	if strings.HasPrefix(event.Name, "job_") {
+		publishJob(m.printer)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Objects of a plate as labelled by slicers, so that a single failed object
+// can be cancelled while the rest keeps printing. Labels are "; printing
+// object" comments, Klipper's EXCLUDE_OBJECT_* commands and Marlin's M486.
+// The job stream handles them itself and doesn't send them.
+
+const (
+	LABEL_START  = iota
+	LABEL_END
+	// EXCLUDE_OBJECT_DEFINE
+	LABEL_DEFINE
+	// M486 A, naming the current object
+	LABEL_NAME
+	// Other M486 and EXCLUDE_OBJECT commands
+	LABEL_OTHER
+)
+
+// Hull extrusion points per object once there are more
+const MAX_OBJECT_POINTS = 4096
+
+type JobObject struct {
+	Id        string       `json:"id"`
+	Name      string       `json:"name"`
+	// Outline on the bed, from the slicer or else the convex hull of the extrusions
+	Polygon   [][2]float64 `json:"polygon"`
+	Cancelled bool         `json:"cancelled"`
+}
+
+type objectLabel struct {
+	kind    int
+	id      string
+	name    string
+	polygon [][2]float64
+}
+
+var errNoSuchObject = errors.New("The job has no such object")
+
+var objectParamRegexp = regexp.MustCompile(`\b([A-Za-z_]+)=(\S+)`)
+
+// Parse a line of a file as an object label
+func parseObjectLabel(raw string) (objectLabel, bool) {
+	line := strings.TrimSpace(raw)
+
+	if strings.HasPrefix(line, ";") {
+		comment := strings.TrimSpace(line[1:])
+		lower := strings.ToLower(comment)
+
+		if strings.HasPrefix(lower, "printing object ") {
+			name := strings.TrimSpace(comment[len("printing object "):])
+			return objectLabel{ kind: LABEL_START, id: name, name: name }, name != ""
+		} else if strings.HasPrefix(lower, "stop printing object") {
+			return objectLabel{ kind: LABEL_END }, true
+		}
+		return objectLabel{}, false
+	}
+
+	command := stripGcodeComment(line)
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return objectLabel{}, false
+	}
+
+	switch cmd := strings.ToUpper(fields[0]); cmd {
+		case "EXCLUDE_OBJECT_DEFINE", "EXCLUDE_OBJECT_START", "EXCLUDE_OBJECT_END", "EXCLUDE_OBJECT":
+			label := objectLabel{ kind: LABEL_OTHER }
+			switch cmd {
+				case "EXCLUDE_OBJECT_DEFINE":
+					label.kind = LABEL_DEFINE
+				case "EXCLUDE_OBJECT_START":
+					label.kind = LABEL_START
+				case "EXCLUDE_OBJECT_END":
+					label.kind = LABEL_END
+			}
+
+			for _, m := range objectParamRegexp.FindAllStringSubmatch(command, -1) {
+				switch strings.ToUpper(m[1]) {
+					case "NAME":
+						label.id = m[2]
+						label.name = m[2]
+					case "POLYGON":
+						json.Unmarshal([]byte(m[2]), &label.polygon)
+				}
+			}
+
+			if (label.kind == LABEL_START || label.kind == LABEL_DEFINE) && label.id == "" {
+				label.kind = LABEL_OTHER
+			}
+			return label, true
+		case "M486":
+			// The name is the rest of the line after A
+			rest := strings.TrimSpace(command[len(fields[0]):])
+			name := ""
+			if i := strings.IndexAny(rest, "Aa"); i >= 0 {
+				name = strings.Trim(strings.TrimSpace(rest[i+1:]), "\"")
+				rest = rest[:i]
+			}
+
+			values := parseGcodeParams(strings.Fields(rest))
+			if s, ok := values["S"]; ok {
+				if s < 0 {
+					return objectLabel{ kind: LABEL_END }, true
+				}
+				return objectLabel{ kind: LABEL_START, id: strconv.Itoa(int(s)), name: name }, true
+			} else if name != "" {
+				return objectLabel{ kind: LABEL_NAME, name: name }, true
+			}
+			return objectLabel{ kind: LABEL_OTHER }, true
+	}
+
+	return objectLabel{}, false
+}
+
+func isMoveCommand(command string) bool {
+	cmd := strings.ToUpper(strings.SplitN(command, " ", 2)[0])
+	return cmd == "G0" || cmd == "G1" || cmd == "G2" || cmd == "G3"
+}
+
+// Objects of a file in order of appearance
+func analyzeObjects(r io.Reader) ([]JobObject, error) {
+	reader := bufio.NewReader(r)
+	objects := make([]JobObject, 0)
+	index := make(map[string]int)
+	points := make(map[string][][2]float64)
+	defined := make(map[string]bool)
+
+	object := func(id string) *JobObject {
+		i, ok := index[id]
+		if !ok {
+			i = len(objects)
+			index[id] = i
+			objects = append(objects, JobObject{ Id: id, Name: id })
+		}
+		return &objects[i]
+	}
+
+	var position jobPosition
+	for {
+		raw, err := reader.ReadString('\n')
+		if err == io.EOF && raw == "" {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if label, ok := parseObjectLabel(raw); ok {
+			switch label.kind {
+				case LABEL_DEFINE:
+					o := object(label.id)
+					if len(label.polygon) > 0 {
+						o.Polygon = label.polygon
+						defined[label.id] = true
+					}
+				case LABEL_START:
+					if o := object(label.id); label.name != "" {
+						o.Name = label.name
+					}
+				case LABEL_NAME:
+					if id := position.State.Object; id != "" {
+						object(id).Name = label.name
+					}
+			}
+		}
+
+		next, _, _ := position.advance(raw)
+
+		from, to := position.State, next.State
+		if id := from.Object; id != "" && !defined[id] && to.E > from.E && (to.X != from.X || to.Y != from.Y) {
+			p := append(points[id], [2]float64{ from.X, from.Y }, [2]float64{ to.X, to.Y })
+			if len(p) > MAX_OBJECT_POINTS {
+				p = convexHull(p)
+			}
+			points[id] = p
+		}
+
+		position = next
+	}
+
+	for i := range objects {
+		if !defined[objects[i].Id] {
+			objects[i].Polygon = convexHull(points[objects[i].Id])
+		}
+	}
+
+	return objects, nil
+}
+
+// Convex hull, counter-clockwise (Andrew's monotone chain)
+func convexHull(points [][2]float64) [][2]float64 {
+	if len(points) < 3 {
+		return append([][2]float64{}, points...)
+	}
+
+	sorted := append([][2]float64{}, points...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i][0] != sorted[j][0] {
+			return sorted[i][0] < sorted[j][0]
+		}
+		return sorted[i][1] < sorted[j][1]
+	})
+
+	cross := func(o, a, b [2]float64) float64 {
+		return (a[0] - o[0]) * (b[1] - o[1]) - (a[1] - o[1]) * (b[0] - o[0])
+	}
+
+	hull := make([][2]float64, 0, len(sorted) + 1)
+	for pass := 0; pass < 2; pass++ {
+		start := len(hull)
+		for _, p := range sorted {
+			for len(hull) >= start + 2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+				hull = hull[:len(hull)-1]
+			}
+			hull = append(hull, p)
+		}
+		// The last point is the first of the other half
+		hull = hull[:len(hull)-1]
+
+		for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+			sorted[i], sorted[j] = sorted[j], sorted[i]
+		}
+	}
+
+	return hull
+}
+
+// Lines moving the printer to where the file expects it after moves of a
+// cancelled object were dropped, and making E match
+func resyncGcode(s printState) []string {
+	lines := make([]string, 0)
+
+	if s.RelativeMoves {
+		lines = append(lines, "G90")
+	}
+	lines = append(lines, fmt.Sprintf("G0 X%g Y%g Z%g F%d", s.X, s.Y, s.Z, RESUME_XY_FEEDRATE))
+	if s.RelativeMoves {
+		lines = append(lines, "G91")
+	}
+
+	// G90 and G91 set the E mode as well
+	if s.RelativeE {
+		lines = append(lines, "M83")
+	} else {
+		lines = append(lines, "M82", fmt.Sprintf("G92 E%g", s.E))
+	}
+	if s.Feedrate > 0 {
+		lines = append(lines, fmt.Sprintf("G1 F%g", s.Feedrate))
+	}
+
+	return lines
+}
+
+// Objects of the current job, nil if there is none
+func (p *Printer) GetJobObjects() []JobObject {
+	p.jobLock.Lock()
+	defer p.jobLock.Unlock()
+
+	if p.job == nil {
+		return nil
+	}
+
+	objects := make([]JobObject, len(p.objects))
+	for i, o := range p.objects {
+		objects[i] = o
+		objects[i].Cancelled = p.job.objectCancelled(o.Id)
+	}
+	return objects
+}
+
+// Stop printing an object of the current job. The rest of the plate keeps printing.
+func (p *Printer) CancelObject(id string) error {
+	p.jobLock.Lock()
+	defer p.jobLock.Unlock()
+
+	if p.job == nil {
+		return errNoJob
+	}
+
+	remaining := 0
+	found := false
+	for _, o := range p.objects {
+		if o.Id == id {
+			found = true
+		} else if !p.job.objectCancelled(o.Id) {
+			remaining++
+		}
+	}
+
+	if !found {
+		return errNoSuchObject
+	}
+	if remaining == 0 {
+		return errors.New("No other object would be printed, cancel the job instead")
+	}
+
+	if !p.job.objectCancelled(id) {
+		p.job.CancelledObjects = append(p.job.CancelledObjects, id)
+		p.log().Infof("Object %s of job %s cancelled", id, p.job.Id)
+	}
+	return nil
+}
+
+func (j *Job) objectCancelled(id string) bool {
+	for _, cancelled := range j.CancelledObjects {
+		if cancelled == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether an object of a streamed job is cancelled
+func (p *Printer) streamObjectCancelled(s *jobStream, id string) bool {
+	if id == "" {
+		return false
+	}
+
+	p.jobLock.Lock()
+	defer p.jobLock.Unlock()
+
+	return s.job.objectCancelled(id)
+}
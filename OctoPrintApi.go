@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Subset of the OctoPrint REST API, so that slicers and mobile apps
+// can talk to the default printer. Uploaded files go to the file store
+// and are printed from there as dashprint jobs.
+
+type OctoPrintSettings struct {
+	Enabled bool   `json:"enabled"`
+	// Shared key, in addition to API keys of operators
+	ApiKey  string `json:"apiKey"`
+}
+
+var octoPrintSettings OctoPrintSettings
+
+// File selected for printing by an upload, OctoPrint's "start" prints it
+var octoSelectedFile string
+var octoSelectedMutex sync.Mutex
+
+func SetupRouteOctoPrint(router *mux.Router) {
+	router.HandleFunc("/version", octoPrintAuth(handleOctoVersion)).Methods("GET")
+	router.HandleFunc("/connection", octoPrintAuth(handleOctoGetConnection)).Methods("GET")
+	router.HandleFunc("/connection", audited("octoprint.connection", octoPrintAuth(handleOctoConnection))).Methods("POST")
+	router.HandleFunc("/printer", octoPrintAuth(handleOctoGetPrinter)).Methods("GET")
+	router.HandleFunc("/printer/command", audited("octoprint.command", octoPrintAuth(handleOctoPrinterCommand))).Methods("POST")
+	router.HandleFunc("/job", octoPrintAuth(handleOctoGetJob)).Methods("GET")
+	router.HandleFunc("/job", audited("octoprint.job", octoPrintAuth(handleOctoJobCommand))).Methods("POST")
+	router.HandleFunc("/files/local", fileTransfer(audited("octoprint.upload", octoPrintAuth(handleOctoUpload)))).Methods("POST")
+}
+
+// Like requireRole, also accepting the shared OctoPrint API key
+func octoPrintAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Api-Key")
+		if key == "" {
+			key = r.URL.Query().Get("apikey")
+		}
+
+		user := authenticate(r)
+		if user != nil {
+			setAuditAuth(w, user)
+			if user.role() < ROLE_OPERATOR || !user.canAccessPrinter(defaultPrinter) {
+				http.Error(w, "Permission denied", http.StatusForbidden)
+				return
+			}
+		} else if octoPrintSettings.ApiKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(octoPrintSettings.ApiKey)) != 1 {
+			http.Error(w, "Invalid API key", http.StatusForbidden)
+			return
+		} else {
+			user = &User{ Username: "octoprint", Role: "operator", apiKey: "octoprint" }
+			setAuditAuth(w, user)
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	}
+}
+
+// User starting jobs, requests with the shared key count as "octoprint"
+func octoUsername(r *http.Request) string {
+	if user := authenticate(r); user != nil {
+		return user.Username
+	}
+	return "octoprint"
+}
+
+func writeOctoJson(w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func getOctoPrinter() *Printer {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+
+	return printers[defaultPrinter]
+}
+
+func octoStateText(p *Printer) string {
+	switch p.GetState() {
+		case STATE_CONNECTED:
+			if job := p.GetJob(); job != nil && job.State == JOB_PRINTING {
+				return "Printing"
+			} else if job != nil {
+				return "Paused"
+			}
+			return "Operational"
+		case STATE_INITIALIZING:
+			return "Connecting"
+		default:
+			return "Offline"
+	}
+}
+
+func handleOctoVersion(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	writeOctoJson(w, map[string]string{
+		"api": "0.1",
+		"server": "1.3.10",
+		"text": "OctoPrint 1.3.10 (dashprint)",
+	})
+}
+
+func handleOctoGetConnection(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	current := map[string]interface{}{
+		"state": "Closed",
+		"port": nil,
+		"baudrate": nil,
+		"printerProfile": "_default",
+	}
+	ports := make([]string, 0)
+	baudrates := []uint{ 250000, 230400, 115200, 57600, 38400, 19200, 9600 }
+
+	if p := getOctoPrinter(); p != nil {
+		current["state"] = octoStateText(p)
+		current["port"] = p.DevicePath
+		current["baudrate"] = p.BaudRate
+		ports = append(ports, p.DevicePath)
+	}
+
+	writeOctoJson(w, map[string]interface{}{
+		"current": current,
+		"options": map[string]interface{}{
+			"ports": ports,
+			"baudrates": baudrates,
+			"printerProfiles": []map[string]string{ { "id": "_default", "name": "Default" } },
+			"portPreference": nil,
+			"baudratePreference": nil,
+			"printerProfilePreference": "_default",
+			"autoconnect": true,
+		},
+	})
+}
+
+func handleOctoConnection(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var req struct {
+		Command string `json:"command"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p := getOctoPrinter()
+	if p == nil {
+		http.Error(w, "No printer configured", http.StatusConflict)
+		return
+	}
+
+	switch req.Command {
+		case "connect":
+			p.Start()
+		case "disconnect":
+			p.Stop()
+		default:
+			http.Error(w, "Unsupported command", http.StatusBadRequest)
+			return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Map dashprint heater names to OctoPrint ones
+func octoHeaterName(heater string) string {
+	switch {
+		case heater == "T":
+			return "tool0"
+		case strings.HasPrefix(heater, "T"):
+			return "tool" + heater[1:]
+		case heater == "B":
+			return "bed"
+		case heater == "C":
+			return "chamber"
+		default:
+			return heater
+	}
+}
+
+func handleOctoGetPrinter(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	p := getOctoPrinter()
+	if p == nil || p.GetState() != STATE_CONNECTED {
+		http.Error(w, "Printer is not operational", http.StatusConflict)
+		return
+	}
+
+	temperature := make(map[string]interface{})
+	for heater, temp := range p.GetTemperatures() {
+		temperature[octoHeaterName(heater)] = map[string]interface{}{
+			"actual": temp.Current,
+			"target": temp.Target,
+			"offset": 0,
+		}
+	}
+
+	job := p.GetJob()
+
+	writeOctoJson(w, map[string]interface{}{
+		"temperature": temperature,
+		"state": map[string]interface{}{
+			"text": octoStateText(p),
+			"flags": map[string]bool{
+				"operational": true,
+				"printing": job != nil && job.State == JOB_PRINTING,
+				"cancelling": false,
+				"pausing": false,
+				"paused": job != nil && job.State != JOB_PRINTING,
+				"ready": job == nil,
+				"error": false,
+				"closedOrError": false,
+				"sdReady": false,
+			},
+		},
+	})
+}
+
+func handleOctoPrinterCommand(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var req struct {
+		Command  string   `json:"command"`
+		Commands []string `json:"commands"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p := getOctoPrinter()
+	if p == nil || p.GetState() != STATE_CONNECTED {
+		http.Error(w, "Printer is not operational", http.StatusConflict)
+		return
+	}
+
+	commands := req.Commands
+	if req.Command != "" {
+		commands = append([]string{ req.Command }, commands...)
+	}
+
+	go func() {
+		for _, command := range commands {
+			p.SendCommand(command, nil)
+		}
+	}()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleOctoGetJob(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	state := "Offline"
+	file := map[string]interface{}{ "name": nil, "origin": nil, "size": nil, "date": nil }
+	progress := map[string]interface{}{
+		"completion": nil,
+		"filepos": nil,
+		"printTime": nil,
+		"printTimeLeft": nil,
+	}
+
+	if p := getOctoPrinter(); p != nil {
+		state = octoStateText(p)
+
+		octoSelectedMutex.Lock()
+		name := octoSelectedFile
+		octoSelectedMutex.Unlock()
+
+		job := p.GetJob()
+		if job != nil {
+			name = job.File
+		}
+
+		if name != "" {
+			file["name"] = name
+			file["origin"] = "local"
+			if info, err := statFile(name); err == nil {
+				file["size"] = info.Size
+				file["date"] = info.Modified.Unix()
+			}
+		}
+
+		if job != nil {
+			progress["completion"] = job.Progress * 100
+			if size, ok := file["size"].(int64); ok {
+				progress["filepos"] = int64(job.Progress * float64(size))
+			}
+			progress["printTime"] = int(job.PrintTime)
+			if job.Progress > 0 {
+				progress["printTimeLeft"] = int(job.PrintTime / job.Progress * (1 - job.Progress))
+			}
+		}
+	}
+
+	writeOctoJson(w, map[string]interface{}{
+		"job": map[string]interface{}{
+			"file": file,
+			"estimatedPrintTime": nil,
+			"filament": nil,
+		},
+		"progress": progress,
+		"state": state,
+	})
+}
+
+func handleOctoJobCommand(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var req struct {
+		Command string `json:"command"`
+		// pause, resume or toggle
+		Action  string `json:"action"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p := getOctoPrinter()
+	if p == nil || p.GetState() != STATE_CONNECTED {
+		http.Error(w, "Printer is not operational", http.StatusConflict)
+		return
+	}
+
+	var err error
+
+	switch req.Command {
+		case "start":
+			octoSelectedMutex.Lock()
+			file := octoSelectedFile
+			octoSelectedMutex.Unlock()
+
+			if file == "" {
+				http.Error(w, "No file selected", http.StatusConflict)
+				return
+			}
+			_, err = p.StartJob(file, octoUsername(r))
+		case "pause":
+			job := p.GetJob()
+			if job == nil {
+				err = errNoJob
+			} else if req.Action == "resume" || (req.Action == "toggle" && job.State != JOB_PRINTING) {
+				err = p.ResumeJob()
+			} else if req.Action == "pause" || req.Action == "" || req.Action == "toggle" {
+				err = p.PauseJob()
+			} else {
+				http.Error(w, "Unsupported action", http.StatusBadRequest)
+				return
+			}
+		case "cancel":
+			err = p.CancelJob()
+		default:
+			http.Error(w, "Unsupported command", http.StatusBadRequest)
+			return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Store an uploaded file. With select or print set, it becomes the
+// selected file and print starts a job with it.
+func handleOctoUpload(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	stored, err := storeFile(header.Filename, file)
+	if err == errBadFileName {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err == errFileInUse {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	printFile := r.FormValue("print") == "true"
+	if printFile || r.FormValue("select") == "true" {
+		octoSelectedMutex.Lock()
+		octoSelectedFile = stored.Name
+		octoSelectedMutex.Unlock()
+	}
+
+	if printFile {
+		p := getOctoPrinter()
+		if p == nil {
+			http.Error(w, "No printer configured", http.StatusConflict)
+			return
+		}
+		if _, err := p.StartJob(stored.Name, octoUsername(r)); err != nil {
+			log.Printf("OctoPrint API: cannot print %s: %v\n", stored.Name, err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	location := "/api/files/local/" + stored.Name
+	js, err := json.Marshal(map[string]interface{}{
+		"files": map[string]interface{}{
+			"local": map[string]interface{}{
+				"name": stored.Name,
+				"display": stored.Name,
+				"origin": "local",
+				"refs": map[string]string{ "resource": location },
+			},
+		},
+		"done": true,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
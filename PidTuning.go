@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EVENT_PID_AUTOTUNE_STARTED  = "pid_autotune_started"
+	EVENT_PID_AUTOTUNE_PROGRESS = "pid_autotune_progress"
+	EVENT_PID_AUTOTUNE_FINISHED = "pid_autotune_finished"
+	EVENT_PID_AUTOTUNE_FAILED   = "pid_autotune_failed"
+)
+
+const (
+	MAX_PID_HISTORY = 20
+)
+
+type PidResult struct {
+	Time    string  `json:"time"`
+	// Extruder index, -1 for the bed
+	Heater  int     `json:"heater"`
+	Target  float64 `json:"target"`
+	Cycles  int     `json:"cycles"`
+	Kp      float64 `json:"kp"`
+	Ki      float64 `json:"ki"`
+	Kd      float64 `json:"kd"`
+	Applied bool    `json:"applied"`
+}
+
+// Autotune in progress or last finished
+type PidTuneState struct {
+	Running  bool       `json:"running"`
+	Heater   int        `json:"heater"`
+	Target   float64    `json:"target"`
+	Cycles   int        `json:"cycles"`
+	// Cycle reports such as "bias: 92 d: 92 min: 196.56 max: 203.75"
+	Progress []string   `json:"progress"`
+	Result   *PidResult `json:"result"`
+	Error    string     `json:"error"`
+}
+
+// "Kp: 22.55 Ki: 2.15 Kd: 59.19" (Marlin) or "pid_Kp=22.865 pid_Ki=1.292 pid_Kd=101.178" (Klipper)
+var pidConstantsRegexp = regexp.MustCompile(`Kp[:=]\s*(-?[\d.]+)\s+\w*Ki[:=]\s*(-?[\d.]+)\s+\w*Kd[:=]\s*(-?[\d.]+)`)
+var pidDefineRegexp = regexp.MustCompile(`#define\s+DEFAULT_(?:bed|chamber)?K([pid])\s+(-?[\d.]+)`)
+
+// Parse final PID constants from M303 output
+func parsePidResult(lines []string) (kp, ki, kd float64, err error) {
+	found := false
+
+	for _, line := range lines {
+		if strings.Contains(line, "PID Autotune failed") || strings.HasPrefix(line, "!!") {
+			return 0, 0, 0, errors.New(strings.TrimSpace(line))
+		}
+
+		if m := pidConstantsRegexp.FindStringSubmatch(line); m != nil {
+			kp, _ = strconv.ParseFloat(m[1], 64)
+			ki, _ = strconv.ParseFloat(m[2], 64)
+			kd, _ = strconv.ParseFloat(m[3], 64)
+			found = true
+		} else if m := pidDefineRegexp.FindStringSubmatch(line); m != nil {
+			v, _ := strconv.ParseFloat(m[2], 64)
+			switch m[1] {
+				case "p":
+					kp = v
+				case "i":
+					ki = v
+				case "d":
+					kd = v
+			}
+			found = true
+		}
+	}
+
+	if !found {
+		return 0, 0, 0, errors.New("No PID constants in autotune output")
+	}
+	return
+}
+
+// Start M303 autotune in the background
+func (p *Printer) StartPidAutotune(heater int, target float64, cycles int) error {
+	if heater < -1 || target <= 0 || cycles < 3 {
+		return errors.New("Invalid autotune parameters")
+	}
+
+	if err := p.checkLimits("M303", []string{ "E" + strconv.Itoa(heater), fmt.Sprintf("S%g", target) }); err != nil {
+		return err
+	}
+	// Autotuning heats and cools the heater in cycles
+	if err := p.checkNotPrinting("autotune"); err != nil {
+		return err
+	}
+
+	p.pidLock.Lock()
+	defer p.pidLock.Unlock()
+
+	if p.pidTune != nil && p.pidTune.Running {
+		return errors.New("Autotune is already running")
+	}
+
+	p.pidTune = &PidTuneState{ Running: true, Heater: heater, Target: target, Cycles: cycles, Progress: make([]string, 0) }
+
+	go p.runPidAutotune(heater, target, cycles)
+	return nil
+}
+
+func (p *Printer) runPidAutotune(heater int, target float64, cycles int) {
+	params := map[string]string{ "heater": strconv.Itoa(heater), "target": fmt.Sprintf("%.0f", target) }
+	p.emitEvent(EVENT_PID_AUTOTUNE_STARTED, params)
+
+	command := fmt.Sprintf("M303 E%d S%.0f C%d", heater, target, cycles)
+
+	var reply []string
+	var cmdErr error
+
+	p.sendCommandWithProgress(command, func(line string) {
+		if !strings.Contains(line, "bias:") {
+			return
+		}
+
+		p.pidLock.Lock()
+		p.pidTune.Progress = append(p.pidTune.Progress, strings.TrimSpace(line))
+		cycle := len(p.pidTune.Progress)
+		p.pidLock.Unlock()
+
+		p.emitEvent(EVENT_PID_AUTOTUNE_PROGRESS, map[string]string{
+			"heater": strconv.Itoa(heater),
+			"cycle": strconv.Itoa(cycle),
+			"report": strings.TrimSpace(line),
+		})
+	}, func(r []string, err error) {
+		reply = r
+		cmdErr = err
+	}, true)
+
+	var result PidResult
+	if cmdErr == nil {
+		result.Kp, result.Ki, result.Kd, cmdErr = parsePidResult(reply)
+	}
+
+	p.pidLock.Lock()
+	p.pidTune.Running = false
+
+	if cmdErr != nil {
+		p.pidTune.Error = cmdErr.Error()
+		p.pidLock.Unlock()
+
+		p.log().Errorf("PID autotune failed: %v", cmdErr)
+		params["error"] = cmdErr.Error()
+		p.emitEvent(EVENT_PID_AUTOTUNE_FAILED, params)
+		return
+	}
+
+	result.Time = time.Now().Format(time.RFC3339)
+	result.Heater = heater
+	result.Target = target
+	result.Cycles = cycles
+	p.pidTune.Result = &result
+
+	p.PidHistory = append(p.PidHistory, result)
+	if len(p.PidHistory) > MAX_PID_HISTORY {
+		p.PidHistory = p.PidHistory[len(p.PidHistory)-MAX_PID_HISTORY:]
+	}
+	p.pidLock.Unlock()
+
+	saveConfig()
+
+	p.log().Infof("PID autotune finished: Kp %.2f Ki %.2f Kd %.2f", result.Kp, result.Ki, result.Kd)
+	params["kp"] = fmt.Sprintf("%.2f", result.Kp)
+	params["ki"] = fmt.Sprintf("%.2f", result.Ki)
+	params["kd"] = fmt.Sprintf("%.2f", result.Kd)
+	p.emitEvent(EVENT_PID_AUTOTUNE_FINISHED, params)
+}
+
+// Get a copy of the autotune state and history
+func (p *Printer) GetPidTuning() (*PidTuneState, []PidResult) {
+	p.pidLock.Lock()
+	defer p.pidLock.Unlock()
+
+	history := make([]PidResult, len(p.PidHistory))
+	copy(history, p.PidHistory)
+
+	if p.pidTune == nil {
+		return nil, history
+	}
+
+	state := *p.pidTune
+	state.Progress = append([]string{}, p.pidTune.Progress...)
+	return &state, history
+}
+
+// Send a result from history to the printer, optionally saving it to EEPROM
+func (p *Printer) ApplyPidResult(index int, save bool) error {
+	p.pidLock.Lock()
+	if index < 0 || index >= len(p.PidHistory) {
+		p.pidLock.Unlock()
+		return errors.New("No such autotune result")
+	}
+	result := p.PidHistory[index]
+	p.pidLock.Unlock()
+
+	var command string
+	if result.Heater == -1 {
+		command = fmt.Sprintf("M304 P%.2f I%.2f D%.2f", result.Kp, result.Ki, result.Kd)
+	} else {
+		command = fmt.Sprintf("M301 E%d P%.2f I%.2f D%.2f", result.Heater, result.Kp, result.Ki, result.Kd)
+	}
+
+	commands := []string{ command }
+	if save {
+		commands = append(commands, "M500")
+	}
+
+	for _, c := range commands {
+		var cmdErr error
+		p.SendCommand(c, func(reply []string, err error) {
+			cmdErr = err
+		})
+		if cmdErr != nil {
+			return cmdErr
+		}
+	}
+
+	p.pidLock.Lock()
+	if index < len(p.PidHistory) {
+		p.PidHistory[index].Applied = true
+	}
+	p.pidLock.Unlock()
+
+	saveConfig()
+	return nil
+}
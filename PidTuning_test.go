@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePidResult(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		kp, ki, kd float64
+		err    string
+	}{
+		{
+			name: "Marlin 2 hotend",
+			output: `PID Autotune start
+ bias: 92 d: 92 min: 196.56 max: 203.75
+ bias: 93 d: 93 min: 197.25 max: 203.44 Ku: 37.58 Tu: 21.00
+ Classic PID
+ Kp: 22.55 Ki: 2.15 Kd: 59.19
+ bias: 94 d: 94 min: 197.03 max: 203.44 Ku: 37.31 Tu: 20.97
+ Classic PID
+ Kp: 22.39 Ki: 2.14 Kd: 58.69
+PID Autotune finished! Put the last Kp, Ki and Kd constants from below into Configuration.h
+#define DEFAULT_Kp 22.39
+#define DEFAULT_Ki 2.14
+#define DEFAULT_Kd 58.69`,
+			kp: 22.39, ki: 2.14, kd: 58.69,
+		},
+		{
+			name: "Marlin 1.1 bed",
+			output: `PID Autotune start
+ bias: 127 d: 127 min: 59.53 max: 60.47
+ bias: 120 d: 120 min: 59.69 max: 60.34 Ku: 470.16 Tu: 54.59
+ Classic PID
+ Kp: 282.10 Ki: 10.33 Kd: 1925.07
+PID Autotune finished! Put the last Kp, Ki and Kd constants from below into Configuration.h
+#define  DEFAULT_bedKp 282.10
+#define  DEFAULT_bedKi 10.33
+#define  DEFAULT_bedKd 1925.07`,
+			kp: 282.10, ki: 10.33, kd: 1925.07,
+		},
+		{
+			name: "Marlin chamber",
+			output: `PID Autotune finished! Put the last Kp, Ki and Kd constants from below into Configuration.h
+#define DEFAULT_chamberKp 37.04
+#define DEFAULT_chamberKi 1.40
+#define DEFAULT_chamberKd 655.17`,
+			kp: 37.04, ki: 1.40, kd: 655.17,
+		},
+		{
+			name: "Marlin cycle constants only",
+			output: ` bias: 93 d: 93 min: 197.25 max: 203.44 Ku: 37.58 Tu: 21.00
+ Classic PID
+ Kp: 22.55 Ki: 2.15 Kd: 59.19`,
+			kp: 22.55, ki: 2.15, kd: 59.19,
+		},
+		{
+			name: "Klipper",
+			output: `// PID parameters: pid_Kp=22.865 pid_Ki=1.292 pid_Kd=101.178
+// The SAVE_CONFIG command will update the printer config file
+// with these parameters and restart the printer.`,
+			kp: 22.865, ki: 1.292, kd: 101.178,
+		},
+		{
+			name: "Marlin too hot",
+			output: `PID Autotune start
+ bias: 127 d: 127 min: 246.09 max: 253.13
+PID Autotune failed! Temperature too high`,
+			err: "PID Autotune failed! Temperature too high",
+		},
+		{
+			name: "Marlin timeout",
+			output: `PID Autotune start
+PID Autotune failed! timeout`,
+			err: "PID Autotune failed! timeout",
+		},
+		{
+			name: "Klipper error",
+			output: `!! Heater extruder not heating at expected rate`,
+			err: "!! Heater extruder not heating at expected rate",
+		},
+		{
+			name: "No result",
+			output: `PID Autotune start
+ bias: 92 d: 92 min: 196.56 max: 203.75`,
+			err: "No PID constants in autotune output",
+		},
+	}
+
+	for _, test := range tests {
+		kp, ki, kd, err := parsePidResult(strings.Split(test.output, "\n"))
+
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if kp != test.kp || ki != test.ki || kd != test.kd {
+			t.Errorf("%s: expected %g/%g/%g, got %g/%g/%g", test.name, test.kp, test.ki, test.kd, kp, ki, kd)
+		}
+	}
+}
+
+func TestAutotuneLimits(t *testing.T) {
+	p := LoadPrinter(PrinterSettings{ UniqueName: "test", Profile: printerModels["ender-3"].Profile })
+
+	tests := []struct {
+		params []string
+		ok     bool
+	}{
+		{ []string{ "E0", "S210", "C8" }, true },
+		{ []string{ "S210" }, true },
+		{ []string{ "E0", "S500", "C8" }, false },
+		{ []string{ "E-1", "S100" }, true },
+		{ []string{ "E-1", "S150" }, false },
+		{ []string{ "E-2", "S60" }, false },
+	}
+
+	for _, test := range tests {
+		err := p.checkLimits("M303", test.params)
+		if test.ok && err != nil {
+			t.Errorf("M303 %v: unexpected error %v", test.params, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("M303 %v: expected an error", test.params)
+		}
+	}
+
+	if err := p.StartPidAutotune(0, 500, 8); err == nil {
+		t.Error("autotune above the maximum hotend temperature should be refused")
+	}
+}
+
+func TestAutotuneWhilePrinting(t *testing.T) {
+	p := LoadPrinter(PrinterSettings{ UniqueName: "test" })
+
+	p.job = &Job{ Id: "abc", State: JOB_PRINTING }
+	if err := p.StartPidAutotune(0, 200, 8); err == nil || !strings.Contains(err.Error(), "job") {
+		t.Errorf("autotune during a job should be refused, got %v", err)
+	}
+	p.job = nil
+
+	p.sd.status.Printing = true
+	if err := p.StartPidAutotune(-1, 60, 8); err == nil || !strings.Contains(err.Error(), "SD card") {
+		t.Errorf("autotune during an SD print should be refused, got %v", err)
+	}
+
+	if state, _ := p.GetPidTuning(); state != nil {
+		t.Error("no autotune should have started")
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	"os"
 	"sync"
 	"syscall"
@@ -13,8 +12,11 @@ import (
 	"fmt"
 	"strconv"
 	"unicode"
+	"regexp"
+	"sync/atomic"
 
 	"github.com/jacobsa/go-serial/serial"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -24,11 +26,23 @@ const (
 	STATE_CONNECTED    = iota
 )
 
+const (
+	EVENT_CONNECTED           = "connected"
+	EVENT_DISCONNECTED        = "disconnected"
+	EVENT_TEMPERATURE_REACHED = "temperature_reached"
+	EVENT_JOB_STARTED         = "job_started"
+	EVENT_JOB_PAUSED          = "job_paused"
+	EVENT_JOB_RESUMED         = "job_resumed"
+	EVENT_JOB_INTERRUPTED     = "job_interrupted"
+	EVENT_JOB_FINISHED        = "job_finished"
+)
+
 const (
 	MAX_LINENO = 10000
 	DATA_TIMEOUT = 5000 // 5 seconds
 	RECONNECT_TIMEOUT = 1000 // 1 second
 	MAX_TEMPERATURE_HISTORY = 30 // 30 mintues
+	TEMPERATURE_POLL_INTERVAL = 2000 // 2 seconds
 )
 
 const (
@@ -48,6 +62,21 @@ type PrinterSettings struct {
 	BaudRate   uint      `json:"baudRate"`
 	Stopped    bool      `json:"stopped"`
 	PrintArea  PrintArea `json:"printArea"`
+	Profile    PrinterProfile `json:"profile"`
+	Cost       PrinterCostSettings `json:"cost"`
+	Maintenance MaintenanceSettings `json:"maintenance"`
+	Macros     []Macro   `json:"macros"`
+	Hooks      []Hook    `json:"hooks"`
+	// Log all serial traffic, use SetSerialTrace() to change it at runtime
+	SerialTrace bool     `json:"serialTrace"`
+	Thermal    ThermalSettings `json:"thermal"`
+	PidHistory []PidResult `json:"pidHistory"`
+	BedMeshes  []BedMesh `json:"bedMeshes"`
+	FirmwareSnapshots []FirmwareSnapshot `json:"firmwareSnapshots"`
+	// Mount point of the board's SD card for flashing firmware.bin
+	FirmwareVolume string `json:"firmwareVolume"`
+	// Files uploaded to the SD card by name, for booking what SD prints use
+	SdUsage    map[string]GcodeUsage `json:"sdUsage"`
 }
 
 type AbstractPrinter interface {
@@ -74,11 +103,70 @@ type Printer struct {
 	readChannel   chan *string
 	
 	port          *os.File
+	baseParametersLock sync.RWMutex
+	// Firmware information reported by M115
 	baseParameters map[string]string
+
+	jobLock       sync.Mutex
+	job           *Job
+	// Streaming the job, nil unless printing or paused
+	stream        *jobStream
+	// Last checkpoint of the job
+	checkpoint    *JobCheckpoint
+	// Labelled objects of the job
+	objects       []JobObject
+	macroLock     sync.Mutex
+	runningMacro  *MacroExecution
+
+	temperaturesLock sync.RWMutex
+	// Heater temperatures as reported by the printer, indexed by T, T0, B etc.
+	temperatures  map[string]Temperature
+	temperaturesUpdated time.Time
+	// Polling (re)started, no readings are expected before
+	pollingResumed time.Time
+	pollingTemperatures int32
+	checkingThermal int32
+
+	healthLock    sync.Mutex
+	lastReply     time.Time
+	consecutiveTimeouts int
+
+	thermalLock   sync.Mutex
+	heaterWatches map[string]*heaterWatch
+	faultLock     sync.Mutex
+	fault         string
+
+	pidLock       sync.Mutex
+	pidTune       *PidTuneState
+
+	meshLock      sync.Mutex
+	firmwareSettingsLock sync.Mutex
+	flash         printerFlash
+	sd            printerSd
+	// Modes and position as last sent to the printer
+	motion        motionState
+	extrusion     extrusionState
+	maintenanceLock sync.Mutex
+	usage         usageState
+	// SerialTrace as read by the serial loop
+	serialTrace   int32
 }
 
 type PrinterListener interface {
 	onPrinterStateChanged(oldState int, newState int)
+	onPrinterEvent(event PrinterEvent)
+}
+
+type PrinterEvent struct {
+	Name    string            `json:"event"`
+	Printer string            `json:"printer"`
+	Time    time.Time         `json:"time"`
+	Data    map[string]string `json:"data"`
+}
+
+type Temperature struct {
+	Current float64 `json:"current"`
+	Target  float64 `json:"target"`
 }
 
 type PrintArea struct {
@@ -89,15 +177,72 @@ func LoadPrinter(settings PrinterSettings) *Printer {
 	p := &Printer{}
 	p.PrinterSettings = settings
 	p.listeners = make(map[PrinterListener]bool)
+	p.temperatures = make(map[string]Temperature)
+	p.heaterWatches = make(map[string]*heaterWatch)
+	p.SetSerialTrace(settings.SerialTrace)
+	p.AddListener(&printerHooks{ printer: p })
+	p.AddListener(&printerWebhooks{ printer: p })
+	p.AddListener(&printerMqtt{ printer: p })
 	return p
 }
 
+// Copy of the settings for saving. Parts changed at runtime are copied under
+// the lock guarding them, the rest under printerMutex, which must be held.
+// New settings must be added here to be saved.
+func (p *Printer) settingsSnapshot() PrinterSettings {
+	s := PrinterSettings{
+		Name: p.Name,
+		DevicePath: p.DevicePath,
+		UniqueName: p.UniqueName,
+		BaudRate: p.BaudRate,
+		Stopped: p.Stopped,
+		PrintArea: p.PrintArea,
+		Profile: p.Profile,
+		Cost: p.Cost,
+		Macros: p.Macros,
+		Hooks: p.Hooks,
+		SerialTrace: p.isTracingSerial(),
+		Thermal: p.Thermal,
+		FirmwareVolume: p.FirmwareVolume,
+	}
+
+	p.maintenanceLock.Lock()
+	s.Maintenance = MaintenanceSettings{
+		Counters: p.Maintenance.Counters,
+		Tasks: append([]MaintenanceTask{}, p.Maintenance.Tasks...),
+		Log: append([]MaintenanceLogEntry{}, p.Maintenance.Log...),
+	}
+	p.maintenanceLock.Unlock()
+
+	p.pidLock.Lock()
+	s.PidHistory = append([]PidResult{}, p.PidHistory...)
+	p.pidLock.Unlock()
+
+	p.meshLock.Lock()
+	s.BedMeshes = append([]BedMesh{}, p.BedMeshes...)
+	p.meshLock.Unlock()
+
+	p.firmwareSettingsLock.Lock()
+	s.FirmwareSnapshots = append([]FirmwareSnapshot{}, p.FirmwareSnapshots...)
+	p.firmwareSettingsLock.Unlock()
+
+	// Entries are replaced, not changed
+	p.sd.lock.Lock()
+	s.SdUsage = make(map[string]GcodeUsage, len(p.SdUsage))
+	for name, usage := range p.SdUsage {
+		s.SdUsage[name] = usage
+	}
+	p.sd.lock.Unlock()
+
+	return s
+}
+
 func (p *Printer) Start() {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 	
 	if p.state != STATE_STOPPED {
-		log.Printf("Printer %s is not stopped, but Start() was called\n", p.UniqueName)
+		p.log().Warn("Printer is not stopped, but Start() was called")
 		return
 	}
 
@@ -119,6 +264,11 @@ func (p *Printer) Stop() {
 	if p.state != STATE_STOPPED {
 		close(p.channel)
 		p.state = STATE_STOPPED
+
+		// Release the serial port so that it can be used for flashing etc.
+		if p.port != nil {
+			p.port.Close()
+		}
 	}
 }
 
@@ -145,12 +295,37 @@ func (p *Printer) setState(state int) {
 	oldState := p.state
 	p.state = state
 	
-	log.Printf("[%s] State %s -> %s\n", p.UniqueName, stateString(oldState), stateString(state))
+	p.log().Infof("State %s -> %s", stateString(oldState), stateString(state))
 	
 	listeners := p.getListeners()
 	for cb, _ := range listeners {
 		go cb.onPrinterStateChanged(oldState, state)
 	}
+
+	if state == STATE_CONNECTED && oldState != STATE_CONNECTED {
+		p.emitEvent(EVENT_CONNECTED, nil)
+	} else if state == STATE_DISCONNECTED && oldState == STATE_CONNECTED {
+		p.emitEvent(EVENT_DISCONNECTED, nil)
+	}
+
+	// Less than SPOOL_FLUSH_LENGTH per extruder would be lost otherwise
+	if oldState == STATE_CONNECTED && state != STATE_CONNECTED && p.flushFilament(-1) {
+		go saveConfig()
+	}
+}
+
+// Notify listeners about an event
+func (p *Printer) emitEvent(name string, data map[string]string) {
+	if data == nil {
+		data = make(map[string]string)
+	}
+
+	event := PrinterEvent{ Name: name, Printer: p.UniqueName, Time: time.Now(), Data: data }
+
+	listeners := p.getListeners()
+	for cb, _ := range listeners {
+		go cb.onPrinterEvent(event)
+	}
 }
 
 // Get a copy of registered listeners
@@ -212,7 +387,7 @@ func (p *Printer) mainLoop() {
 
 		setNoResetOnReopen(p.port)
 
-		log.Printf("[%s] Successfully opened serial port\n", p.UniqueName)
+		p.log().Info("Successfully opened serial port")
 		p.setState(STATE_INITIALIZING)
 
 		time.Sleep(1000)
@@ -225,23 +400,54 @@ func (p *Printer) mainLoop() {
 		// Send initial commands
 		p.sendCommand("M110 N0", nil, false)
 		p.nextLineNo = 1
+		p.resetMotion()
 
 		// Get printer information
 		p.sendCommand("M115", func(reply []string, err error) {
 			if err == nil {
-				if len(reply) >= 2 {
-					p.baseParameters = kvParse(reply[len(reply) - 2])
-					log.Printf("[%s] Base printer params: %v\n", p.UniqueName, p.baseParameters)
+				if params := firmwareInfo(reply); params != nil {
+					p.setBaseParameters(params)
+					p.log().Infof("Base printer params: %v", params)
 				}
 
 				p.setState(STATE_CONNECTED)
-				// TODO: query temperature
+				go p.temperatureLoop()
+				go p.thermalStaleLoop()
 			}
 		}, false)
 		break
 	}
 }
 
+// Key:value pairs of the FIRMWARE_NAME line of an M115 reply, nil if there is none
+func firmwareInfo(reply []string) map[string]string {
+	for _, line := range reply {
+		if strings.Contains(line, "FIRMWARE_NAME:") {
+			return kvParse(line)
+		}
+	}
+	return nil
+}
+
+func (p *Printer) setBaseParameters(params map[string]string) {
+	p.baseParametersLock.Lock()
+	defer p.baseParametersLock.Unlock()
+
+	p.baseParameters = params
+}
+
+// Firmware information, nil until the printer has replied to M115
+func (p *Printer) getBaseParameters() map[string]string {
+	p.baseParametersLock.RLock()
+	defer p.baseParametersLock.RUnlock()
+
+	return p.baseParameters
+}
+
+func (p *Printer) firmwareName() string {
+	return p.getBaseParameters()["FIRMWARE_NAME"]
+}
+
 // Correctly parse key:value pairs returned by 3D printers
 func kvParse(line string) map[string]string {
 	kv := make(map[string]string)
@@ -293,7 +499,12 @@ func (p *Printer) readRoutine(port *os.File) {
 		line, err := reader.ReadString('\n')
 
 		if err != nil {
-			log.Printf("[%s] Error reading from serial port: %v\n", p.UniqueName, err)
+			if p.GetState() == STATE_STOPPED {
+				// Port closed by Stop()
+				break
+			}
+
+			p.log().Errorf("Error reading from serial port: %v", err)
 			p.setState(STATE_DISCONNECTED)
 			p.readChannel <- nil
 
@@ -306,10 +517,10 @@ func (p *Printer) readRoutine(port *os.File) {
 		// Remove NL
 		line = line[:len(line)-1]
 
-		log.Printf("[%s] Read line: %s\n", p.UniqueName, line)
+		p.traceSerial("recv", line)
 
 		if line == "start" {
-			log.Printf("[%s] Printer restart detected\n")
+			p.log().Warn("Printer restart detected")
 			p.readChannel = nil
 		} else {
 			p.readChannel <- &line
@@ -318,6 +529,8 @@ func (p *Printer) readRoutine(port *os.File) {
 }
 
 func (p *Printer) scheduleReconnection() {
+	metricReconnects.WithLabelValues(p.UniqueName).Inc()
+
 	go func() {
 		if (p.waitBeforeReconnect()) {
 			p.start()
@@ -336,11 +549,12 @@ func gcodeChecksum(line string) uint {
 }
 
 func (p *Printer) writeCommand(command string) {
-	log.Printf("[%s] Sending: %s", p.UniqueName, command)
-	_, err := p.port.WriteString(command)
+	p.traceSerial("send", strings.TrimSpace(command))
+	n, err := p.port.WriteString(command)
+	metricBytesWritten.WithLabelValues(p.UniqueName).Add(float64(n))
 
 	if err != nil {
-		log.Printf("[%s] Error sending data: %s\n", p.UniqueName, err)
+		p.log().Errorf("Error sending data: %s", err)
 		p.port.Close()
 	}
 }
@@ -357,20 +571,35 @@ func (p *Printer) readLineWithTimeout(timeout time.Duration) (string, error) {
 		case line = <-p.readChannel:
 			break
 		case <-time.After(time.Millisecond * timeout):
-			log.Printf("[%s] Comm timeout\n", p.UniqueName)
+			p.log().Warn("Comm timeout")
+			metricCommTimeouts.WithLabelValues(p.UniqueName).Inc()
 	}
 
 	if line == nil {
+		p.healthLock.Lock()
+		p.consecutiveTimeouts++
+		p.healthLock.Unlock()
+
 		p.port.Close()
 		line = <-p.readChannel
 		return "", errors.New("Comm timeout")
 	} else {
+		p.healthLock.Lock()
+		p.lastReply = time.Now()
+		p.consecutiveTimeouts = 0
+		p.healthLock.Unlock()
+
 		return *line, nil
 	}
 
 }
 
 func (p *Printer) sendCommand(command string, callback func(reply []string, err error), checkState bool) {
+	p.sendCommandWithProgress(command, nil, callback, checkState)
+}
+
+// Send a command, passing each reply line other than "ok" to progress as it arrives
+func (p *Printer) sendCommandWithProgress(command string, progress func(line string), callback func(reply []string, err error), checkState bool) {
 	// We can only be executing a single command - semaphore:
 	p.sendWaitChan <- 0
 	defer func() { <-p.sendWaitChan }()
@@ -386,9 +615,25 @@ func (p *Printer) sendCommand(command string, callback func(reply []string, err
 		}
 	}
 
+	if fault := p.GetFault(); fault != "" && checkState {
+		if callback != nil {
+			callback(nil, errors.New(fault))
+		}
+		return
+	}
+
+	// Lines written to SD during an upload are stored, not executed
+	writingSd := p.isWritingSd()
+	if writingSd && checkState {
+		if callback != nil {
+			callback(nil, errors.New("Printer is receiving a file to SD card"))
+		}
+		return
+	}
+
 	// Line number overflow handling
 	if p.nextLineNo >= MAX_LINENO {
-		log.Printf("[%s] Resetting line counter", p.UniqueName)
+		p.log().Debug("Resetting line counter")
 
 		// Reset the line counter
 		p.writeCommand("M110 N0\n")
@@ -406,6 +651,19 @@ func (p *Printer) sendCommand(command string, callback func(reply []string, err
 
 	// Do sending
 	cmd := strings.SplitN(command, " ", 2)[0]
+	params := make([]string, 0)
+	if fields := strings.Fields(command); len(fields) > 1 {
+		params = fields[1:]
+	}
+
+	if !writingSd {
+		if err := p.checkLimits(cmd, params); err != nil && checkState {
+			if callback != nil {
+				callback(nil, err)
+			}
+			return
+		}
+	}
 
 	useLineNumber := cmd != "M110"
 
@@ -417,6 +675,9 @@ func (p *Printer) sendCommand(command string, callback func(reply []string, err
 		command = command + "\n"
 	}
 
+	metricCommandsSent.WithLabelValues(p.UniqueName).Inc()
+	start := time.Now()
+
 Resend:
 	if p.state != STATE_CONNECTED {
 		// Report error
@@ -445,10 +706,12 @@ Resend:
 			// Handle resend
 			lineNo, _ := strconv.ParseInt(strings.TrimSpace(line[7:]), 10, 0)
 
+			metricResends.WithLabelValues(p.UniqueName).Inc()
+
 			if int(lineNo) == (p.nextLineNo-1) {
 				resend = true
 			} else {
-				log.Printf("[%s] Cannot handle resend of line %d\n", p.UniqueName, int(lineNo))
+				p.log().WithField("line", int(lineNo)).Error("Cannot handle resend of line")
 				p.port.Close()
 
 				if callback != nil {
@@ -463,25 +726,162 @@ Resend:
 				if resend {
 					goto Resend
 				}
+				if cmd == "M105" {
+					p.parseTemperatures(cmd, line)
+				}
+				if !writingSd {
+					// Only commands the firmware accepted moved the printer
+					p.trackMotion(cmd, params)
+				}
+				observeCommandLatency(p.UniqueName, start)
+
 				if callback != nil {
 					callback(replyLines, nil)
 				}
-				log.Println("Command done, rcvd OK")
+				p.log().WithFields(logrus.Fields{
+					"line": p.nextLineNo - 1,
+					"latency": time.Since(start).Seconds() * 1000,
+				}).Debugf("Command %s done, rcvd OK", cmd)
+
+				if (cmd == "M190" || cmd == "M109") && !writingSd {
+					p.emitTemperatureReached(cmd, params)
+				}
 				break
 			} else {
-				if cmd == "M190" || cmd == "M109" {
+				if progress != nil {
+					progress(line)
+				}
+
+				p.parseSdStatus(line)
+
+				if (cmd == "M190" || cmd == "M109" || cmd == "M105" || cmd == "M303") && !writingSd {
 					p.parseTemperatures(cmd, line)
 				}
+				if strings.HasPrefix(line, "Error:") && (strings.Contains(line, "checksum") || strings.Contains(line, "Line Number")) {
+					metricChecksumErrors.WithLabelValues(p.UniqueName).Inc()
+				}
 			}
 		}
 	}
 }
 
+var temperatureRegexp = regexp.MustCompile(`\b([TBC]\d*):\s*(-?\d+\.?\d*)(?:\s*/\s*(-?\d+\.?\d*))?`)
+
+// Parse temperature reports such as "ok T:210.0 /210.0 B:60.1 /60.0 @:0 B@:0"
 func (p *Printer) parseTemperatures(cmd string, line string) {
+	matches := temperatureRegexp.FindAllStringSubmatch(line, -1)
+	if len(matches) == 0 {
+		return
+	}
+
+	p.temperaturesLock.Lock()
+
+	p.temperaturesUpdated = time.Now()
+	reported := make(map[string]Temperature)
+
+	for _, m := range matches {
+		temp := p.temperatures[m[1]]
+		temp.Current, _ = strconv.ParseFloat(m[2], 64)
+
+		// M109/M190 progress lines do not include the target
+		if m[3] != "" {
+			temp.Target, _ = strconv.ParseFloat(m[3], 64)
+		}
+
+		p.temperatures[m[1]] = temp
+		reported[m[1]] = temp
+	}
+
+	p.temperaturesLock.Unlock()
+
+	p.checkThermal(reported)
+}
+
+// Get a copy of last reported temperatures
+func (p *Printer) GetTemperatures() map[string]Temperature {
+	p.temperaturesLock.RLock()
+	defer p.temperaturesLock.RUnlock()
+
+	rv := make(map[string]Temperature)
+	for k, v := range p.temperatures {
+		rv[k] = v
+	}
+	return rv
+}
+
+// Time of the last temperature report, or of polling resuming if that was later
+func (p *Printer) temperaturesLastUpdated() time.Time {
+	p.temperaturesLock.RLock()
+	defer p.temperaturesLock.RUnlock()
+
+	if p.pollingResumed.After(p.temperaturesUpdated) {
+		return p.pollingResumed
+	}
+	return p.temperaturesUpdated
+}
+
+func (p *Printer) resumeTemperaturePolling() {
+	p.temperaturesLock.Lock()
+	p.pollingResumed = time.Now()
+	p.temperaturesLock.Unlock()
+}
+
+// Periodically query temperatures while connected
+func (p *Printer) temperatureLoop() {
+	// A loop from the previous connection may still be running
+	if !atomic.CompareAndSwapInt32(&p.pollingTemperatures, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&p.pollingTemperatures, 0)
+
+	p.resumeTemperaturePolling()
+
+	// No polling while uploading to SD
+	wasWritingSd := false
+
+	for {
+		select {
+			case <-time.After(time.Millisecond * TEMPERATURE_POLL_INTERVAL):
+			case <-p.channel:
+				return
+		}
+
+		if p.state != STATE_CONNECTED {
+			return
+		}
+
+		if p.isWritingSd() {
+			wasWritingSd = true
+			continue
+		} else if wasWritingSd {
+			p.resumeTemperaturePolling()
+			wasWritingSd = false
+		}
+
+		p.SendCommand("M105", nil)
+	}
+}
+
+// M109/M190 only reply with "ok" once the target temperature is reached
+func (p *Printer) emitTemperatureReached(cmd string, params []string) {
+	heater := "extruder"
+	if cmd == "M190" {
+		heater = "bed"
+	}
+
+	data := map[string]string{ "heater": heater }
+
+	for _, param := range params {
+		if param[0] == 'S' || param[0] == 'R' {
+			data["target"] = param[1:]
+		}
+	}
+
+	p.emitEvent(EVENT_TEMPERATURE_REACHED, data)
 }
 
 func (p *Printer) doConnect() *os.File {
-	log.Printf("[%s] Trying to open %s\n", p.UniqueName, p.DevicePath)
+	p.log().Debugf("Trying to open %s", p.DevicePath)
 	options := serial.OpenOptions{
 		PortName: p.DevicePath,
 		BaudRate: p.BaudRate,
@@ -493,7 +893,7 @@ func (p *Printer) doConnect() *os.File {
 
 	port, err := serial.Open(options)
 	if err != nil {
-		log.Printf("[%s] Opening failed: %s\n", p.UniqueName, err)
+		p.log().Debugf("Opening failed: %s", err)
 		return nil
 	}
 
@@ -16,6 +16,7 @@ func loadPrinters(config Configuration) {
 	for _, ps := range config.Printers {
 		printer := LoadPrinter(ps)
 		printers[printer.UniqueName] = printer
+		printer.loadCheckpoint()
 
 		if defaultPrinter == "" {
 			defaultPrinter = printer.UniqueName
@@ -68,3 +69,12 @@ func addPrinter(ps PrinterSettings) string {
 	return printer.UniqueName
 }
 
+func stopPrinters() {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+
+	for _, printer := range printers {
+		printer.Stop()
+	}
+}
+
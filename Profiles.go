@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	KINEMATICS_CARTESIAN = "cartesian"
+	KINEMATICS_COREXY    = "corexy"
+	KINEMATICS_DELTA     = "delta"
+)
+
+const (
+	ORIGIN_FRONT_LEFT = "front_left"
+	ORIGIN_CENTER     = "center"
+)
+
+const (
+	// Moves may go slightly past the print area, e.g. Prusa's purge line at Y-3
+	PRINT_AREA_MARGIN = 5
+)
+
+// Per-axis limits in mm/s or mm/s²
+type AxisLimits struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+	E float64 `json:"e"`
+}
+
+type ExtruderProfile struct {
+	NozzleDiameter float64 `json:"nozzleDiameter"`
+	MaxTemp        float64 `json:"maxTemp"`
+}
+
+// Hardware description of a printer. Zero values mean unknown and are not checked.
+type PrinterProfile struct {
+	Kinematics      string            `json:"kinematics"`
+	// Printable radius of delta printers
+	DeltaRadius     float64           `json:"deltaRadius"`
+	Origin          string            `json:"origin"`
+	HeatedBed       bool              `json:"heatedBed"`
+	HeatedChamber   bool              `json:"heatedChamber"`
+	Extruders       []ExtruderProfile `json:"extruders"`
+	MaxBedTemp      float64           `json:"maxBedTemp"`
+	MaxChamberTemp  float64           `json:"maxChamberTemp"`
+	MaxFeedrate     AxisLimits        `json:"maxFeedrate"`
+	MaxAcceleration AxisLimits        `json:"maxAcceleration"`
+}
+
+// Entry of the built-in profile library
+type PrinterModel struct {
+	Id        string         `json:"id"`
+	Name      string         `json:"name"`
+	PrintArea PrintArea      `json:"printArea"`
+	Profile   PrinterProfile `json:"profile"`
+}
+
+var printerModels = map[string]PrinterModel{
+	"prusa-mk3s": {
+		Name: "Prusa i3 MK3S",
+		PrintArea: PrintArea{ Width: 250, Depth: 210, Height: 210 },
+		Profile: PrinterProfile{
+			Kinematics: KINEMATICS_CARTESIAN,
+			Origin: ORIGIN_FRONT_LEFT,
+			HeatedBed: true,
+			Extruders: []ExtruderProfile{ { NozzleDiameter: 0.4, MaxTemp: 300 } },
+			MaxBedTemp: 120,
+			MaxFeedrate: AxisLimits{ X: 200, Y: 200, Z: 12, E: 120 },
+			MaxAcceleration: AxisLimits{ X: 1000, Y: 1000, Z: 200, E: 5000 },
+		},
+	},
+	"prusa-mini": {
+		Name: "Prusa MINI",
+		PrintArea: PrintArea{ Width: 180, Depth: 180, Height: 180 },
+		Profile: PrinterProfile{
+			Kinematics: KINEMATICS_CARTESIAN,
+			Origin: ORIGIN_FRONT_LEFT,
+			HeatedBed: true,
+			Extruders: []ExtruderProfile{ { NozzleDiameter: 0.4, MaxTemp: 280 } },
+			MaxBedTemp: 100,
+			MaxFeedrate: AxisLimits{ X: 180, Y: 180, Z: 12, E: 80 },
+			MaxAcceleration: AxisLimits{ X: 1250, Y: 1250, Z: 400, E: 4000 },
+		},
+	},
+	"ender-3": {
+		Name: "Creality Ender 3",
+		PrintArea: PrintArea{ Width: 220, Depth: 220, Height: 250 },
+		Profile: PrinterProfile{
+			Kinematics: KINEMATICS_CARTESIAN,
+			Origin: ORIGIN_FRONT_LEFT,
+			HeatedBed: true,
+			Extruders: []ExtruderProfile{ { NozzleDiameter: 0.4, MaxTemp: 260 } },
+			MaxBedTemp: 110,
+			MaxFeedrate: AxisLimits{ X: 500, Y: 500, Z: 5, E: 25 },
+			MaxAcceleration: AxisLimits{ X: 500, Y: 500, Z: 100, E: 5000 },
+		},
+	},
+	"cr-10": {
+		Name: "Creality CR-10",
+		PrintArea: PrintArea{ Width: 300, Depth: 300, Height: 400 },
+		Profile: PrinterProfile{
+			Kinematics: KINEMATICS_CARTESIAN,
+			Origin: ORIGIN_FRONT_LEFT,
+			HeatedBed: true,
+			Extruders: []ExtruderProfile{ { NozzleDiameter: 0.4, MaxTemp: 260 } },
+			MaxBedTemp: 110,
+			MaxFeedrate: AxisLimits{ X: 500, Y: 500, Z: 5, E: 25 },
+			MaxAcceleration: AxisLimits{ X: 500, Y: 500, Z: 100, E: 5000 },
+		},
+	},
+	"voron-2.4-350": {
+		Name: "Voron 2.4 350",
+		PrintArea: PrintArea{ Width: 350, Depth: 350, Height: 340 },
+		Profile: PrinterProfile{
+			Kinematics: KINEMATICS_COREXY,
+			Origin: ORIGIN_FRONT_LEFT,
+			HeatedBed: true,
+			Extruders: []ExtruderProfile{ { NozzleDiameter: 0.4, MaxTemp: 300 } },
+			MaxBedTemp: 120,
+			MaxFeedrate: AxisLimits{ X: 300, Y: 300, Z: 15, E: 120 },
+			MaxAcceleration: AxisLimits{ X: 3000, Y: 3000, Z: 350, E: 3000 },
+		},
+	},
+	"voron-trident-300": {
+		Name: "Voron Trident 300",
+		PrintArea: PrintArea{ Width: 300, Depth: 300, Height: 250 },
+		Profile: PrinterProfile{
+			Kinematics: KINEMATICS_COREXY,
+			Origin: ORIGIN_FRONT_LEFT,
+			HeatedBed: true,
+			Extruders: []ExtruderProfile{ { NozzleDiameter: 0.4, MaxTemp: 300 } },
+			MaxBedTemp: 120,
+			MaxFeedrate: AxisLimits{ X: 300, Y: 300, Z: 15, E: 120 },
+			MaxAcceleration: AxisLimits{ X: 3000, Y: 3000, Z: 350, E: 3000 },
+		},
+	},
+	"kossel": {
+		Name: "Anycubic Kossel",
+		PrintArea: PrintArea{ Width: 230, Depth: 230, Height: 300 },
+		Profile: PrinterProfile{
+			Kinematics: KINEMATICS_DELTA,
+			DeltaRadius: 115,
+			Origin: ORIGIN_CENTER,
+			HeatedBed: true,
+			Extruders: []ExtruderProfile{ { NozzleDiameter: 0.4, MaxTemp: 260 } },
+			MaxBedTemp: 110,
+			MaxFeedrate: AxisLimits{ X: 200, Y: 200, Z: 200, E: 70 },
+			MaxAcceleration: AxisLimits{ X: 3000, Y: 3000, Z: 3000, E: 3000 },
+		},
+	},
+}
+
+// Built-in profiles sorted by id
+func getPrinterModels() []PrinterModel {
+	rv := make([]PrinterModel, 0, len(printerModels))
+	for id, model := range printerModels {
+		model.Id = id
+		rv = append(rv, model)
+	}
+
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Id < rv[j].Id
+	})
+	return rv
+}
+
+func findPrinterModel(id string) (PrinterModel, bool) {
+	model, ok := printerModels[id]
+	model.Id = id
+	return model, ok
+}
+
+func (pp *PrinterProfile) validate() error {
+	switch pp.Kinematics {
+		case "", KINEMATICS_CARTESIAN, KINEMATICS_COREXY:
+		case KINEMATICS_DELTA:
+			if pp.DeltaRadius <= 0 {
+				return errors.New("Delta printers need a radius")
+			}
+		default:
+			return fmt.Errorf("Unknown kinematics %s", pp.Kinematics)
+	}
+
+	switch pp.Origin {
+		case "", ORIGIN_FRONT_LEFT, ORIGIN_CENTER:
+		default:
+			return fmt.Errorf("Unknown origin %s", pp.Origin)
+	}
+
+	return nil
+}
+
+// Axis range along the given dimension
+func (p *Printer) axisRange(size uint) (float64, float64) {
+	if p.Profile.Origin == ORIGIN_CENTER || p.Profile.Kinematics == KINEMATICS_DELTA {
+		return -float64(size) / 2, float64(size) / 2
+	}
+	return 0, float64(size)
+}
+
+// Check a command against the printer profile. Moves are checked along
+// their path, arcs included, where the position is known (see motionState).
+func (p *Printer) checkLimits(cmd string, params []string) error {
+	return p.checkCommand(p.motion, cmd, params)
+}
+
+// Check a file before it is stored on the SD card, as its commands won't pass
+// checkLimits when printed from there. Lines must be free of comments.
+func (p *Printer) checkGcode(lines []string) error {
+	m := newMotionState(p.Profile, p.PrintArea)
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		cmd := strings.ToUpper(fields[0])
+		if err := p.checkCommand(m, cmd, fields[1:]); err != nil {
+			return fmt.Errorf("%s: %v", line, err)
+		}
+		m, _ = m.next(cmd, fields[1:])
+	}
+	return nil
+}
+
+// Check a command given the machine state before it
+func (p *Printer) checkCommand(m motionState, cmd string, params []string) error {
+	values := make(map[string]float64)
+	for _, param := range params {
+		if len(param) > 1 {
+			if v, err := strconv.ParseFloat(param[1:], 64); err == nil {
+				values[strings.ToUpper(param[:1])] = v
+			}
+		}
+	}
+
+	switch cmd {
+		case "G0", "G1", "G2", "G3":
+			_, move := m.next(cmd, params)
+			return p.checkMove(move)
+		case "M104", "M109":
+			tool := m.tool
+			if t, ok := values["T"]; ok {
+				tool = int(t)
+			}
+
+			// M109 R waits for cooling down as well as heating up
+			for _, param := range []string{ "S", "R" } {
+				if target, ok := values[param]; ok {
+					if err := p.checkHotendTarget(tool, target); err != nil {
+						return err
+					}
+				}
+			}
+		case "M140", "M190":
+			return p.checkBedTarget(values["S"])
+		case "M141", "M191":
+			return p.checkChamberTarget(values["S"])
+		case "M303":
+			// Autotune heater: E-1 is the bed, E-2 the chamber
+			heater := int(values["E"])
+			switch {
+				case heater == -1:
+					return p.checkBedTarget(values["S"])
+				case heater == -2:
+					return p.checkChamberTarget(values["S"])
+				default:
+					return p.checkHotendTarget(heater, values["S"])
+			}
+	}
+
+	return nil
+}
+
+func (p *Printer) checkMove(move *motionMove) error {
+	area := p.PrintArea
+	limits := []struct{ axis string; size uint }{ { "X", area.Width }, { "Y", area.Depth }, { "Z", area.Height } }
+	delta := p.Profile.Kinematics == KINEMATICS_DELTA
+
+	for _, point := range move.points {
+		for i, l := range limits {
+			if !move.known[i] || l.size == 0 || (i != 2 && delta) {
+				continue
+			}
+
+			min, max := p.axisRange(l.size)
+			if i == 2 {
+				min, max = 0, float64(l.size)
+			}
+			if v := point[i]; v < min - PRINT_AREA_MARGIN || v > max + PRINT_AREA_MARGIN {
+				return fmt.Errorf("%s%g is outside of the print area", l.axis, math.Round(v * 1000) / 1000)
+			}
+		}
+
+		if delta && move.known[0] && move.known[1] && math.Hypot(point[0], point[1]) > p.Profile.DeltaRadius + PRINT_AREA_MARGIN {
+			return errors.New("Move is outside of the printable radius")
+		}
+	}
+
+	return nil
+}
+
+func (p *Printer) checkHotendTarget(tool int, target float64) error {
+	if tool >= 0 && tool < len(p.Profile.Extruders) && p.Profile.Extruders[tool].MaxTemp > 0 && target > p.Profile.Extruders[tool].MaxTemp {
+		return fmt.Errorf("Target %g exceeds the maximum hotend temperature", target)
+	}
+	return nil
+}
+
+func (p *Printer) checkBedTarget(target float64) error {
+	if p.Profile.Kinematics != "" && !p.Profile.HeatedBed && target > 0 {
+		return errors.New("Printer has no heated bed")
+	}
+	if p.Profile.MaxBedTemp > 0 && target > p.Profile.MaxBedTemp {
+		return fmt.Errorf("Target %g exceeds the maximum bed temperature", target)
+	}
+	return nil
+}
+
+func (p *Printer) checkChamberTarget(target float64) error {
+	if p.Profile.Kinematics != "" && !p.Profile.HeatedChamber && target > 0 {
+		return errors.New("Printer has no heated chamber")
+	}
+	if p.Profile.MaxChamberTemp > 0 && target > p.Profile.MaxChamberTemp {
+		return fmt.Errorf("Target %g exceeds the maximum chamber temperature", target)
+	}
+	return nil
+}
@@ -3,28 +3,115 @@ package main
 import (
 	"net/http"
 	"log"
+	"time"
+	"strconv"
 	"encoding/json"
+	"os"
+	"io/ioutil"
 	"github.com/gorilla/mux"
 )
 
 func SetupRouteApiV1(router *mux.Router) {
-	router.HandleFunc("/printers/discover", discoverPrinters)
-	router.HandleFunc("/printers", handleGetPrinters).Methods("GET")
-	router.HandleFunc("/printers", handleAddPrinter).Methods("POST")
+	router.HandleFunc("/login", audited("login", handleLogin)).Methods("POST")
+	router.HandleFunc("/logout", audited("logout", handleLogout)).Methods("POST")
+	router.HandleFunc("/me", requireRole(ROLE_VIEWER, handleGetMe)).Methods("GET")
 
-	router.HandleFunc("/printers/{printerId}", handleGetPrinter).Methods("GET")
-	router.HandleFunc("/printers/{printerId}", handleSetupPrinter).Methods("PUT")
+	router.HandleFunc("/users", requireRole(ROLE_ADMIN, handleGetUsers)).Methods("GET")
+	router.HandleFunc("/users", audited("user.add", requireRole(ROLE_ADMIN, handleAddUser))).Methods("POST")
+	router.HandleFunc("/users/{username}", audited("user.modify", requireRole(ROLE_ADMIN, handleModifyUser))).Methods("PUT")
+	router.HandleFunc("/users/{username}", audited("user.delete", requireRole(ROLE_ADMIN, handleDeleteUser))).Methods("DELETE")
+	router.HandleFunc("/users/{username}/apikeys", audited("apikey.add", requireRole(ROLE_ADMIN, handleAddApiKey))).Methods("POST")
+	router.HandleFunc("/users/{username}/apikeys/{name}", audited("apikey.delete", requireRole(ROLE_ADMIN, handleDeleteApiKey))).Methods("DELETE")
 
-	router.HandleFunc("/printers/{printerId}/job", handleSubmitJob).Methods("POST")
-	router.HandleFunc("/printers/{printerId}/job", handleModifyJob).Methods("PUT")
-	router.HandleFunc("/printers/{printerId}/job", handleGetJob).Methods("GET")
+	router.HandleFunc("/printers/discover", requireRole(ROLE_ADMIN, discoverPrinters))
+	router.HandleFunc("/printers", requireRole(ROLE_VIEWER, handleGetPrinters)).Methods("GET")
+	router.HandleFunc("/printers", audited("printer.add", requireRole(ROLE_ADMIN, handleAddPrinter))).Methods("POST")
 
-	router.HandleFunc("/printers/{printerId}/temperatures", handleGetPrinterTemperatures).Methods("GET")
-	router.HandleFunc("/printers/{printerId}/temperatures", handleSetPrinterTemperatures).Methods("SET")
+	router.HandleFunc("/printers/{printerId}", requireRole(ROLE_VIEWER, handleGetPrinter)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}", audited("printer.setup", requireRole(ROLE_ADMIN, handleSetupPrinter))).Methods("PUT")
+	router.HandleFunc("/printers/{printerId}/profile", audited("printer.profile", requireRole(ROLE_ADMIN, handleSetPrinterProfile))).Methods("PUT")
+	router.HandleFunc("/profiles", requireRole(ROLE_VIEWER, handleGetPrinterModels)).Methods("GET")
 
-	router.HandleFunc("/files", handleListFiles).Methods("GET")
-	router.HandleFunc("/files/{file}", handleDownloadFile).Methods("GET")
-	router.HandleFunc("/files/{file}", handleUploadFile).Methods("PUT")
+	router.HandleFunc("/printers/{printerId}/job", audited("job.submit", requireRole(ROLE_OPERATOR, handleSubmitJob))).Methods("POST")
+	router.HandleFunc("/printers/{printerId}/job", audited("job.modify", requireRole(ROLE_OPERATOR, handleModifyJob))).Methods("PUT")
+	router.HandleFunc("/printers/{printerId}/job", requireRole(ROLE_VIEWER, handleGetJob)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/jobs", requireRole(ROLE_VIEWER, handleGetJobHistory)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/job/objects", requireRole(ROLE_VIEWER, handleGetJobObjects)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/job/objects/{objectId}/cancel", audited("job.cancelObject", requireRole(ROLE_OPERATOR, handleCancelJobObject))).Methods("POST")
+
+	router.HandleFunc("/printers/{printerId}/temperatures", requireRole(ROLE_VIEWER, handleGetPrinterTemperatures)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/temperatures", audited("temperatures.set", requireRole(ROLE_OPERATOR, handleSetPrinterTemperatures))).Methods("SET")
+
+	router.HandleFunc("/printers/{printerId}/pid", requireRole(ROLE_VIEWER, handleGetPidTuning)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/pid", audited("pid.autotune", requireRole(ROLE_OPERATOR, handleStartPidAutotune))).Methods("POST")
+	router.HandleFunc("/printers/{printerId}/pid/apply", audited("pid.apply", requireRole(ROLE_OPERATOR, handleApplyPid))).Methods("POST")
+	router.HandleFunc("/printers/{printerId}/meshes", requireRole(ROLE_VIEWER, handleGetBedMeshes)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/meshes", audited("mesh.capture", requireRole(ROLE_OPERATOR, handleCaptureBedMesh))).Methods("POST")
+	router.HandleFunc("/printers/{printerId}/meshes/{index:[0-9]+}", requireRole(ROLE_VIEWER, handleGetBedMesh)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/meshes/{index:[0-9]+}", audited("mesh.delete", requireRole(ROLE_OPERATOR, handleDeleteBedMesh))).Methods("DELETE")
+	router.HandleFunc("/printers/{printerId}/meshes/{index:[0-9]+}/diff/{other:[0-9]+}", requireRole(ROLE_VIEWER, handleDiffBedMeshes)).Methods("GET")
+
+	router.HandleFunc("/printers/{printerId}/eeprom", requireRole(ROLE_VIEWER, handleGetFirmwareSnapshots)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/eeprom", audited("eeprom.capture", requireRole(ROLE_OPERATOR, handleCaptureFirmwareSettings))).Methods("POST")
+	router.HandleFunc("/printers/{printerId}/eeprom/{version:[0-9]+}", requireRole(ROLE_VIEWER, handleGetFirmwareSnapshot)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/eeprom/{version:[0-9]+}", audited("eeprom.delete", requireRole(ROLE_OPERATOR, handleDeleteFirmwareSnapshot))).Methods("DELETE")
+	router.HandleFunc("/printers/{printerId}/eeprom/{version:[0-9]+}/diff/{other:[0-9]+}", requireRole(ROLE_VIEWER, handleDiffFirmwareSnapshots)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/eeprom/{version:[0-9]+}/restore", audited("eeprom.restore", requireRole(ROLE_ADMIN, handleRestoreFirmwareSnapshot))).Methods("POST")
+
+	router.HandleFunc("/printers/{printerId}/sd/files", requireRole(ROLE_VIEWER, handleGetSdFiles)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/sd/files", fileTransfer(audited("sd.upload", requireRole(ROLE_OPERATOR, handleUploadSdFile)))).Methods("POST")
+	router.HandleFunc("/printers/{printerId}/sd/files/{name}", audited("sd.delete", requireRole(ROLE_OPERATOR, handleDeleteSdFile))).Methods("DELETE")
+	router.HandleFunc("/printers/{printerId}/sd/upload", requireRole(ROLE_VIEWER, handleGetSdUpload)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/sd/upload", audited("sd.cancelUpload", requireRole(ROLE_OPERATOR, handleCancelSdUpload))).Methods("DELETE")
+	router.HandleFunc("/printers/{printerId}/sd/print", requireRole(ROLE_VIEWER, handleGetSdStatus)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/sd/print", audited("sd.print", requireRole(ROLE_OPERATOR, handleStartSdPrint))).Methods("POST")
+	router.HandleFunc("/printers/{printerId}/sd/print", audited("sd.modify", requireRole(ROLE_OPERATOR, handleModifySdPrint))).Methods("PUT")
+
+	router.HandleFunc("/printers/{printerId}/firmware", requireRole(ROLE_VIEWER, handleGetFlashState)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/firmware", fileTransfer(audited("firmware.flash", requireRole(ROLE_ADMIN, handleFlashFirmware)))).Methods("POST")
+
+	router.HandleFunc("/printers/{printerId}/fault", audited("printer.clearFault", requireRole(ROLE_OPERATOR, handleClearFault))).Methods("DELETE")
+	router.HandleFunc("/printers/{printerId}/health", requireRole(ROLE_VIEWER, handleGetPrinterHealth)).Methods("GET")
+
+	router.HandleFunc("/printers/{printerId}/logs", requireRole(ROLE_VIEWER, handleGetPrinterLogs)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/logs/trace", audited("printer.trace", requireRole(ROLE_OPERATOR, handleSetSerialTrace))).Methods("PUT")
+
+	router.HandleFunc("/printers/{printerId}/macros", requireRole(ROLE_VIEWER, handleGetMacros)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/macros/{name}", audited("macro.run", requireRole(ROLE_OPERATOR, handleRunMacro))).Methods("POST")
+	router.HandleFunc("/printers/{printerId}/macros/{name}", audited("macro.abort", requireRole(ROLE_OPERATOR, handleAbortMacro))).Methods("DELETE")
+
+	router.HandleFunc("/printers/{printerId}/maintenance", requireRole(ROLE_VIEWER, handleGetMaintenance)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/maintenance/tasks", audited("maintenance.addTask", requireRole(ROLE_ADMIN, handleAddMaintenanceTask))).Methods("POST")
+	router.HandleFunc("/printers/{printerId}/maintenance/tasks/{name}", audited("maintenance.deleteTask", requireRole(ROLE_ADMIN, handleDeleteMaintenanceTask))).Methods("DELETE")
+	router.HandleFunc("/printers/{printerId}/maintenance/tasks/{name}/done", audited("maintenance.done", requireRole(ROLE_OPERATOR, handleCompleteMaintenanceTask))).Methods("POST")
+
+	router.HandleFunc("/printers/{printerId}/cost", requireRole(ROLE_VIEWER, handleEstimateCost)).Methods("POST")
+	router.HandleFunc("/printers/{printerId}/costs", audited("cost.record", requireRole(ROLE_ADMIN, handleRecordCost))).Methods("POST")
+
+	router.HandleFunc("/printers/{printerId}/spools", requireRole(ROLE_VIEWER, handleGetLoadedSpools)).Methods("GET")
+	router.HandleFunc("/printers/{printerId}/spools/check", requireRole(ROLE_VIEWER, handleCheckFilament)).Methods("POST")
+	router.HandleFunc("/printers/{printerId}/spools/{extruder:[0-9]+}", audited("spool.load", requireRole(ROLE_OPERATOR, handleLoadSpool))).Methods("PUT")
+	router.HandleFunc("/printers/{printerId}/spools/{extruder:[0-9]+}", audited("spool.unload", requireRole(ROLE_OPERATOR, handleUnloadSpool))).Methods("DELETE")
+
+	router.HandleFunc("/spools", requireRole(ROLE_VIEWER, handleGetSpools)).Methods("GET")
+	router.HandleFunc("/spools", audited("spool.add", requireRole(ROLE_OPERATOR, handleAddSpool))).Methods("POST")
+	router.HandleFunc("/spools/{spoolId:[0-9]+}", requireRole(ROLE_VIEWER, handleGetSpool)).Methods("GET")
+	router.HandleFunc("/spools/{spoolId:[0-9]+}", audited("spool.modify", requireRole(ROLE_OPERATOR, handleModifySpool))).Methods("PUT")
+	router.HandleFunc("/spools/{spoolId:[0-9]+}", audited("spool.delete", requireRole(ROLE_OPERATOR, handleDeleteSpool))).Methods("DELETE")
+
+	router.HandleFunc("/webhooks", requireRole(ROLE_ADMIN, handleGetWebhooks)).Methods("GET")
+	router.HandleFunc("/webhooks/{name}/test", audited("webhook.test", requireRole(ROLE_ADMIN, handleTestWebhook))).Methods("POST")
+
+	router.HandleFunc("/audit", requireRole(ROLE_ADMIN, handleGetAudit)).Methods("GET")
+	router.HandleFunc("/costs", requireRole(ROLE_ADMIN, handleGetCosts)).Methods("GET")
+	router.HandleFunc("/costs/{costId}", audited("cost.modify", requireRole(ROLE_ADMIN, handleModifyCost))).Methods("PUT")
+	router.HandleFunc("/costs/{costId}", audited("cost.delete", requireRole(ROLE_ADMIN, handleDeleteCost))).Methods("DELETE")
+
+	router.HandleFunc("/files", requireRole(ROLE_VIEWER, handleListFiles)).Methods("GET")
+	router.HandleFunc("/files/{file}", fileTransfer(requireRole(ROLE_VIEWER, handleDownloadFile))).Methods("GET")
+	router.HandleFunc("/files/{file}", fileTransfer(audited("file.upload", requireRole(ROLE_OPERATOR, handleUploadFile)))).Methods("PUT")
+	router.HandleFunc("/files/{file}", audited("file.delete", requireRole(ROLE_OPERATOR, handleDeleteFile))).Methods("DELETE")
+	router.HandleFunc("/files/{file}/layers", requireRole(ROLE_VIEWER, handleGetFileLayers)).Methods("GET")
 }
 
 func discoverPrinters(w http.ResponseWriter, r *http.Request) {
@@ -53,6 +140,11 @@ type RestPrinterSettings struct {
 	Depth uint `json:"depth"`
 	Stopped bool `json:"stopped"`
 	Connected bool `json:"connected"`
+	Fault string `json:"fault"`
+	// Built-in profile to start from, see /profiles
+	Model string `json:"model,omitempty"`
+	Profile *PrinterProfile `json:"profile"`
+	Cost PrinterCostSettings `json:"cost"`
 }
 
 func handleGetPrinters(w http.ResponseWriter, r *http.Request) {
@@ -61,8 +153,13 @@ func handleGetPrinters(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	jsonData := make(map[string]RestPrinterSettings)
+	user := currentUser(r)
 
 	for uniqueName, printer := range printers {
+		if !user.canAccessPrinter(uniqueName) {
+			continue
+		}
+
 		var ps RestPrinterSettings
 		printerSettingsToRest(&ps, printer)
 		jsonData[uniqueName] = ps
@@ -115,6 +212,17 @@ func printerSettingsFromRest(t RestPrinterSettings, p *PrinterSettings) {
 	p.PrintArea.Height = t.Height
 	p.PrintArea.Depth = t.Depth
 	p.Stopped = t.Stopped
+
+	if model, ok := findPrinterModel(t.Model); ok {
+		p.Profile = model.Profile
+		if t.Width == 0 && t.Height == 0 && t.Depth == 0 {
+			p.PrintArea = model.PrintArea
+		}
+	}
+	if t.Profile != nil {
+		p.Profile = *t.Profile
+	}
+	p.Cost = t.Cost
 }
 
 func printerSettingsToRest(t* RestPrinterSettings, p *Printer) {
@@ -127,6 +235,10 @@ func printerSettingsToRest(t* RestPrinterSettings, p *Printer) {
 	t.Stopped = p.Stopped
 	t.Default = defaultPrinter == p.UniqueName
 	t.Connected = p.GetState() == STATE_CONNECTED
+	t.Fault = p.GetFault()
+	profile := p.Profile
+	t.Profile = &profile
+	t.Cost = p.Cost
 }
 
 func handleAddPrinter(w http.ResponseWriter, r *http.Request) {
@@ -148,6 +260,17 @@ func handleAddPrinter(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, ok := findPrinterModel(t.Model); t.Model != "" && !ok {
+		http.Error(w, "Unknown printer model", http.StatusBadRequest)
+		return
+	}
+	if t.Profile != nil {
+		if err := t.Profile.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Send HTTP Location
 	var p PrinterSettings
 	printerSettingsFromRest(t, &p)
@@ -156,39 +279,254 @@ func handleAddPrinter(w http.ResponseWriter, r *http.Request) {
 
 	saveConfig()
 
-	w.Header().Set("Location", "http://" + r.Header.Get("Host") + "/api/v1/printers/" + printerName)
+	w.Header().Set("Location", externalURL(r, "/api/v1/printers/" + printerName))
 	w.WriteHeader(http.StatusCreated)
 }
 
+type RestJob struct {
+	// Stored file to print
+	File string `json:"file"`
+	// Start from this layer, or from the first layer at this height, instead of the beginning
+	StartLayer int `json:"startLayer"`
+	StartZ float64 `json:"startZ"`
+}
+
 func handleSubmitJob(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	// TODO
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var t RestJob
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil || t.File == "" {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+
+	if t.StartLayer < 0 || t.StartZ < 0 {
+		http.Error(w, "Bad start layer", http.StatusBadRequest)
+		return
+	}
+
+	job, err := printer.StartJobFromLayer(t.File, t.StartLayer, t.StartZ, currentUser(r).Username)
+	if os.IsNotExist(err) {
+		http.Error(w, "No such file", http.StatusNotFound)
+		return
+	} else if err == errBadFileName || err == errNoSuchLayer {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	js, err := json.Marshal(job)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+type RestJobModify struct {
+	// pause, resume or cancel. Resuming an interrupted job continues from its checkpoint.
+	Action string `json:"action"`
 }
 
 func handleModifyJob(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	// TODO
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var t RestJobModify
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var err error
+
+	switch t.Action {
+		case "pause":
+			err = printer.PauseJob()
+		case "resume":
+			err = printer.ResumeJob()
+		case "cancel":
+			err = printer.CancelJob()
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func handleGetJob(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	// TODO
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	job := printer.GetJob()
+	if job == nil {
+		http.Error(w, "No job is running", http.StatusNotFound)
+		return
+	}
+
+	js, err := json.Marshal(job)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// Labelled objects of the job with their outlines
+func handleGetJobObjects(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	objects := printer.GetJobObjects()
+	if objects == nil {
+		http.Error(w, "No job is running", http.StatusNotFound)
+		return
+	}
+
+	js, err := json.Marshal(objects)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func handleCancelJobObject(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := printer.CancelObject(vars["objectId"])
+	if err == errNoSuchObject {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /printers/{printerId}/jobs?limit=N, finished jobs newest first
+func handleGetJobHistory(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	_, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	limit := MAX_JOB_HISTORY
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	jobs, err := queryJobs(vars["printerId"], limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(jobs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
 }
 
 func handleGetPrinterTemperatures(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
 	defer r.Body.Close()
-	// TODO
+
 	vars := mux.Vars(r)
 
 	if printer, ok := printers[vars["printerId"]]; ok {
-		js := []byte("[]")
-		_ = printer
-
-		// js, err := json.Marshal(rps)
-		// if err != nil {
-		//	http.Error(w, err.Error(), http.StatusInternalServerError)
-		//	return
-		// }
+		// TODO: history
+		js, err := json.Marshal(printer.GetTemperatures())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(js)
@@ -202,18 +540,1815 @@ func handleSetPrinterTemperatures(w http.ResponseWriter, r *http.Request) {
 	// TODO
 }
 
+func handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	err := deleteStoredFile(vars["file"])
+	if err == errBadFileName {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err == errFileInUse {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Layers of a stored file and the lines and heights they start at
+func handleGetFileLayers(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	f, err := openStoredFile(vars["file"])
+	if err == errBadFileName {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	layers, err := analyzeLayers(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(layers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
 func handleListFiles(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	// TODO
+
+	files, err := listFiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(files)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
 }
 
 func handleDownloadFile(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	// TODO
+
+	vars := mux.Vars(r)
+
+	f, err := openStoredFile(vars["file"])
+	if err == errBadFileName {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x.gcode")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
 }
 
+// PUT /files/{file} with the file as the request body
 func handleUploadFile(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	// TODO
-}
 
+	vars := mux.Vars(r)
+
+	file, err := storeFile(vars["file"], r.Body)
+	if err == errBadFileName {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err == errFileInUse {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+type RestMacros struct {
+	Macros []Macro `json:"macros"`
+	Running string `json:"running"`
+}
+
+func handleGetMacros(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		rm := RestMacros{ Macros: printer.GetMacros(), Running: printer.GetRunningMacro() }
+
+		js, err := json.Marshal(rm)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func handleRunMacro(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printer, ok := printers[vars["printerId"]]
+	if !ok || printer.FindMacro(vars["name"]) == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Macro parameters are optional
+	params := make(map[string]string)
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&params); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := printer.RunMacro(vars["name"], params); err == ErrMacroRunning {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handleAbortMacro(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		if printer.GetRunningMacro() != vars["name"] || !printer.AbortMacro() {
+			http.Error(w, "Macro is not running", http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func handleGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// Do not leak secrets
+	list := getWebhooks()
+	for i := range list {
+		if list[i].Secret != "" {
+			list[i].Secret = "********"
+		}
+	}
+
+	js, err := json.Marshal(list)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func handleTestWebhook(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	wh := findWebhook(vars["name"])
+	if wh == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := wh.test(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type RestLogin struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type RestUser struct {
+	Username string   `json:"username"`
+	Password string   `json:"password,omitempty"`
+	Role     string   `json:"role"`
+	Printers []string `json:"printers"`
+	ApiKeys  []string `json:"apiKeys"`
+	Department string `json:"department"`
+}
+
+func userToRest(t *RestUser, u *User) {
+	t.Username = u.Username
+	t.Role = u.Role
+	t.Printers = u.Printers
+	t.Department = u.Department
+	t.ApiKeys = make([]string, len(u.ApiKeys))
+	for i, k := range u.ApiKeys {
+		t.ApiKeys[i] = k.Name
+	}
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var t RestLogin
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user := checkPassword(t.Username, t.Password)
+	if user == nil {
+		log.Printf("Failed login for user %s from %s\n", t.Username, remoteAddr(r))
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	setAuditUser(w, user.Username)
+
+	http.SetCookie(w, &http.Cookie{
+		Name: SESSION_COOKIE,
+		Value: createSession(user.Username),
+		Path: getBasePath() + "/",
+		MaxAge: int(SESSION_LIFETIME.Seconds()),
+		HttpOnly: true,
+		Secure: requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if cookie, err := r.Cookie(SESSION_COOKIE); err == nil {
+		destroySession(cookie.Value)
+	}
+
+	http.SetCookie(w, &http.Cookie{ Name: SESSION_COOKIE, Path: getBasePath() + "/", MaxAge: -1 })
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetMe(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var t RestUser
+	userToRest(&t, currentUser(r))
+
+	js, err := json.Marshal(t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	defer r.Body.Close()
+
+	list := make([]RestUser, len(users))
+	for i := range users {
+		userToRest(&list[i], &users[i])
+	}
+
+	js, err := json.Marshal(list)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func handleAddUser(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var t RestUser
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if t.Username == "" || roleFromString(t.Role) == ROLE_NONE {
+		http.Error(w, "Bad user parameters", http.StatusBadRequest)
+		return
+	}
+
+	u := User{ Username: t.Username, Role: t.Role, Printers: t.Printers, Department: t.Department }
+	if err := u.setPassword(t.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	usersMutex.Lock()
+	if findUser(t.Username) != nil {
+		usersMutex.Unlock()
+		http.Error(w, "User already exists", http.StatusConflict)
+		return
+	}
+	users = append(users, u)
+	usersMutex.Unlock()
+
+	saveConfig()
+
+	w.Header().Set("Location", externalURL(r, "/api/v1/users/" + u.Username))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleModifyUser(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	var t RestUser
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if roleFromString(t.Role) == ROLE_NONE {
+		http.Error(w, "Bad user parameters", http.StatusBadRequest)
+		return
+	}
+
+	usersMutex.Lock()
+	u := findUser(vars["username"])
+	if u == nil {
+		usersMutex.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+
+	u.Role = t.Role
+	u.Printers = t.Printers
+	u.Department = t.Department
+
+	if t.Password != "" {
+		if err := u.setPassword(t.Password); err != nil {
+			usersMutex.Unlock()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	usersMutex.Unlock()
+
+	saveConfig()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if vars["username"] == currentUser(r).Username {
+		http.Error(w, "Cannot delete yourself", http.StatusConflict)
+		return
+	}
+
+	usersMutex.Lock()
+	found := false
+	for i := range users {
+		if users[i].Username == vars["username"] {
+			users = append(users[:i], users[i+1:]...)
+			found = true
+			break
+		}
+	}
+	usersMutex.Unlock()
+
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	destroyUserSessions(vars["username"])
+	saveConfig()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type RestApiKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// Create an API key, the key is only returned in this response
+func handleAddApiKey(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	var t RestApiKey
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil || t.Name == "" {
+		http.Error(w, "Bad API key parameters", http.StatusBadRequest)
+		return
+	}
+
+	t.Key = randomToken()
+
+	usersMutex.Lock()
+	u := findUser(vars["username"])
+	if u == nil {
+		usersMutex.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+
+	for _, k := range u.ApiKeys {
+		if k.Name == t.Name {
+			usersMutex.Unlock()
+			http.Error(w, "API key already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	u.ApiKeys = append(u.ApiKeys, ApiKey{ Name: t.Name, Hash: hashApiKey(t.Key), Created: time.Now().Format(time.RFC3339) })
+	usersMutex.Unlock()
+
+	saveConfig()
+
+	js, err := json.Marshal(t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+func handleDeleteApiKey(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	usersMutex.Lock()
+	found := false
+	if u := findUser(vars["username"]); u != nil {
+		for i, k := range u.ApiKeys {
+			if k.Name == vars["name"] {
+				u.ApiKeys = append(u.ApiKeys[:i], u.ApiKeys[i+1:]...)
+				found = true
+				break
+			}
+		}
+	}
+	usersMutex.Unlock()
+
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	saveConfig()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /printers/{printerId}/logs?limit=N
+func handleGetPrinterLogs(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if _, ok := printers[vars["printerId"]]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	js, err := json.Marshal(printerLogs.get(vars["printerId"], limit))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+type RestSerialTrace struct {
+	Enabled bool `json:"enabled"`
+}
+
+func handleSetSerialTrace(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	var t RestSerialTrace
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	if ok {
+		printer.SetSerialTrace(t.Enabled)
+	}
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	saveConfig()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleClearFault(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		printer.ClearFault()
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+type RestPidTuning struct {
+	Current *PidTuneState `json:"current"`
+	History []PidResult   `json:"history"`
+}
+
+func handleGetPidTuning(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		var t RestPidTuning
+		t.Current, t.History = printer.GetPidTuning()
+
+		js, err := json.Marshal(t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+type RestPidAutotune struct {
+	Heater int     `json:"heater"`
+	Target float64 `json:"target"`
+	Cycles int     `json:"cycles"`
+}
+
+func handleStartPidAutotune(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printer, ok := printers[vars["printerId"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	t := RestPidAutotune{ Cycles: 8 }
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := printer.StartPidAutotune(t.Heater, t.Target, t.Cycles); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type RestPidApply struct {
+	// Index into history, the latest result if omitted
+	Index *int `json:"index"`
+	Save  bool `json:"save"`
+}
+
+func handleApplyPid(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var t RestPidApply
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, history := printer.GetPidTuning()
+	index := len(history) - 1
+	if t.Index != nil {
+		index = *t.Index
+	}
+
+	if err := printer.ApplyPidResult(index, t.Save); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetBedMeshes(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		js, err := json.Marshal(printer.GetBedMeshes())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func handleGetBedMesh(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		meshes := printer.GetBedMeshes()
+		index, _ := strconv.Atoi(vars["index"])
+
+		if index >= len(meshes) {
+			http.NotFound(w, r)
+			return
+		}
+
+		js, err := json.Marshal(meshes[index])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func handleDiffBedMeshes(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		meshes := printer.GetBedMeshes()
+		index, _ := strconv.Atoi(vars["index"])
+		other, _ := strconv.Atoi(vars["other"])
+
+		if index >= len(meshes) || other >= len(meshes) {
+			http.NotFound(w, r)
+			return
+		}
+
+		diff, err := diffBedMeshes(&meshes[index], &meshes[other])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		js, err := json.Marshal(diff)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+type RestBedMeshCapture struct {
+	// Probe the bed before reading the mesh
+	Probe   bool   `json:"probe"`
+	// Override the firmware specific report command, e.g. G29 T for UBL
+	Command string `json:"command"`
+}
+
+func handleCaptureBedMesh(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var t RestBedMeshCapture
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mesh, err := printer.CaptureBedMesh(t.Probe, t.Command)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	js, err := json.Marshal(mesh)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+func handleDeleteBedMesh(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	index, _ := strconv.Atoi(vars["index"])
+	if !printer.DeleteBedMesh(index) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetFirmwareSnapshots(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		js, err := json.Marshal(printer.GetFirmwareSnapshots())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func handleGetFirmwareSnapshot(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		version, _ := strconv.Atoi(vars["version"])
+		snapshot := printer.GetFirmwareSnapshot(version)
+
+		if snapshot == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		js, err := json.Marshal(snapshot)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func handleDiffFirmwareSnapshots(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		version, _ := strconv.Atoi(vars["version"])
+		other, _ := strconv.Atoi(vars["other"])
+
+		a := printer.GetFirmwareSnapshot(version)
+		b := printer.GetFirmwareSnapshot(other)
+
+		if a == nil || b == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		js, err := json.Marshal(diffFirmwareSnapshots(a, b))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+type RestFirmwareCapture struct {
+	Label string `json:"label"`
+}
+
+func handleCaptureFirmwareSettings(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var t RestFirmwareCapture
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	snapshot, err := printer.CaptureFirmwareSettings(t.Label)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	js, err := json.Marshal(snapshot)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+func handleDeleteFirmwareSnapshot(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	version, _ := strconv.Atoi(vars["version"])
+	if !printer.DeleteFirmwareSnapshot(version) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleRestoreFirmwareSnapshot(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	version, _ := strconv.Atoi(vars["version"])
+	if printer.GetFirmwareSnapshot(version) == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := printer.RestoreFirmwareSnapshot(version); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetFlashState(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		js, err := json.Marshal(printer.GetFlashState())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// Upload a .hex or .bin firmware image as multipart field "file"
+func handleFlashFirmware(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_FIRMWARE_SIZE)
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := printer.FlashFirmware(header.Filename, data); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handleGetSdFiles(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	files, err := printer.ListSdFiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	js, err := json.Marshal(files)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+type RestSdUpload struct {
+	Name string `json:"name"`
+}
+
+// Upload G-code as multipart field "file", replies with the 8.3 name on the card
+func handleUploadSdFile(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, err := printer.UploadSdFile(header.Filename, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	js, err := json.Marshal(RestSdUpload{ Name: name })
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(js)
+}
+
+func handleDeleteSdFile(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := printer.DeleteSdFile(vars["name"]); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetSdUpload(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		js, err := json.Marshal(printer.GetSdUpload())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func handleCancelSdUpload(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		if !printer.CancelSdUpload() {
+			http.Error(w, "No upload in progress", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func handleGetSdStatus(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	js, err := json.Marshal(printer.GetSdStatus())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+type RestSdPrint struct {
+	File string `json:"file"`
+}
+
+func handleStartSdPrint(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var t RestSdPrint
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil || t.File == "" {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+
+	if err := printer.StartSdPrint(t.File); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type RestSdPrintModify struct {
+	// pause or resume
+	Action string `json:"action"`
+}
+
+func handleModifySdPrint(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var t RestSdPrintModify
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var err error
+
+	switch t.Action {
+		case "pause":
+			err = printer.PauseSdPrint()
+		case "resume":
+			err = printer.ResumeSdPrint()
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetPrinterModels(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	js, err := json.Marshal(getPrinterModels())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+type RestPrinterProfile struct {
+	// Built-in profile replacing the current one, including the print area
+	Model   string          `json:"model"`
+	Profile *PrinterProfile `json:"profile"`
+}
+
+func handleSetPrinterProfile(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	var t RestPrinterProfile
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	model, ok := findPrinterModel(t.Model)
+	if t.Model != "" && !ok {
+		http.Error(w, "Unknown printer model", http.StatusBadRequest)
+		return
+	}
+	if t.Profile != nil {
+		if err := t.Profile.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	printerMutex.Lock()
+	printer, ok := printers[vars["printerId"]]
+
+	if !ok {
+		printerMutex.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+
+	if t.Model != "" {
+		printer.Profile = model.Profile
+		printer.PrintArea = model.PrintArea
+	}
+	if t.Profile != nil {
+		printer.Profile = *t.Profile
+	}
+	printerMutex.Unlock()
+
+	saveConfig()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetSpools(w http.ResponseWriter, r *http.Request) {
+	spoolsMutex.RLock()
+	defer spoolsMutex.RUnlock()
+	defer r.Body.Close()
+
+	list := spools
+	if list == nil {
+		list = make([]Spool, 0)
+	}
+
+	js, err := json.Marshal(list)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func handleGetSpool(w http.ResponseWriter, r *http.Request) {
+	spoolsMutex.RLock()
+	defer spoolsMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["spoolId"])
+
+	s := findSpool(id)
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	js, err := json.Marshal(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func handleAddSpool(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var t Spool
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if t.Material == "" || t.InitialWeight <= 0 {
+		http.Error(w, "Bad spool parameters", http.StatusBadRequest)
+		return
+	}
+
+	if t.RemainingWeight <= 0 {
+		t.RemainingWeight = t.InitialWeight
+	}
+	t.Printer = ""
+	t.Extruder = 0
+	t.History = nil
+	t.normalize()
+
+	spoolsMutex.Lock()
+	t.Id = nextSpoolId()
+	spools = append(spools, t)
+	spoolsMutex.Unlock()
+
+	saveConfig()
+
+	w.Header().Set("Location", externalURL(r, "/api/v1/spools/" + strconv.Itoa(t.Id)))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Replace spool properties, keeping its assignment and history
+func handleModifySpool(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["spoolId"])
+
+	var t Spool
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if t.Material == "" || t.InitialWeight <= 0 || t.RemainingWeight < 0 {
+		http.Error(w, "Bad spool parameters", http.StatusBadRequest)
+		return
+	}
+
+	spoolsMutex.Lock()
+	s := findSpool(id)
+	if s == nil {
+		spoolsMutex.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+
+	t.Id = s.Id
+	t.Printer = s.Printer
+	t.Extruder = s.Extruder
+	t.History = s.History
+	t.normalize()
+	*s = t
+	spoolsMutex.Unlock()
+
+	saveConfig()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleDeleteSpool(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["spoolId"])
+
+	spoolsMutex.Lock()
+	found := false
+	for i := range spools {
+		if spools[i].Id == id {
+			spools = append(spools[:i], spools[i+1:]...)
+			found = true
+			break
+		}
+	}
+	spoolsMutex.Unlock()
+
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	saveConfig()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetLoadedSpools(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		js, err := json.Marshal(printer.GetLoadedSpools())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+type RestSpoolLoad struct {
+	Spool int `json:"spool"`
+}
+
+func handleLoadSpool(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var t RestSpoolLoad
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	extruder, _ := strconv.Atoi(vars["extruder"])
+
+	// Filament used so far belongs to the spool being replaced
+	printer.flushFilament(extruder)
+
+	if !loadSpool(t.Spool, vars["printerId"], extruder) {
+		http.Error(w, "No such spool", http.StatusBadRequest)
+		return
+	}
+
+	saveConfig()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleUnloadSpool(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+	extruder, _ := strconv.Atoi(vars["extruder"])
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if ok {
+		printer.flushFilament(extruder)
+	}
+
+	if !unloadSpool(vars["printerId"], extruder) {
+		http.NotFound(w, r)
+		return
+	}
+
+	saveConfig()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type RestFilamentCheck struct {
+	// mm of filament needed per extruder
+	Filament []float64 `json:"filament"`
+}
+
+func handleCheckFilament(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printer, ok := printers[vars["printerId"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var t RestFilamentCheck
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	js, err := json.Marshal(printer.CheckFilament(t.Filament))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func handleGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	printerMutex.RLock()
+	defer printerMutex.RUnlock()
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	if printer, ok := printers[vars["printerId"]]; ok {
+		js, err := json.Marshal(printer.GetMaintenance())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func handleAddMaintenanceTask(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var t MaintenanceTask
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := printer.AddMaintenanceTask(t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleDeleteMaintenanceTask(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok || !printer.DeleteMaintenanceTask(vars["name"]) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type RestMaintenanceDone struct {
+	Note string `json:"note"`
+}
+
+func handleCompleteMaintenanceTask(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	printerMutex.RLock()
+	printer, ok := printers[vars["printerId"]]
+	printerMutex.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var t RestMaintenanceDone
+
+	// The note is optional
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	username := ""
+	if u := currentUser(r); u != nil {
+		username = u.Username
+	}
+
+	if !printer.CompleteMaintenanceTask(vars["name"], username, t.Note) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
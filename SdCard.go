@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EVENT_SD_UPLOAD_FINISHED = "sd_upload_finished"
+	EVENT_SD_UPLOAD_FAILED   = "sd_upload_failed"
+	EVENT_SD_PRINT_DONE      = "sd_print_done"
+)
+
+const (
+	// How often the firmware should report SD progress (M27 S)
+	SD_STATUS_INTERVAL = 2
+	// Poll with M27 if no report arrived for this long
+	SD_STATUS_MAX_AGE  = 5000 // 5 seconds
+)
+
+type SdFile struct {
+	Name     string `json:"name"`
+	LongName string `json:"longName"`
+	Size     int64  `json:"size"`
+}
+
+type SdStatus struct {
+	Printing bool    `json:"printing"`
+	File     string  `json:"file"`
+	Position int64   `json:"position"`
+	Size     int64   `json:"size"`
+	Progress float64 `json:"progress"`
+	Updated  string  `json:"updated"`
+}
+
+type SdUploadState struct {
+	Running    bool   `json:"running"`
+	File       string `json:"file"`
+	Lines      int    `json:"lines"`
+	TotalLines int    `json:"totalLines"`
+	Error      string `json:"error"`
+}
+
+type printerSd struct {
+	lock     sync.Mutex
+	status   SdStatus
+	updated  time.Time
+	upload   *SdUploadState
+	cancel   chan int
+	// Set while the firmware writes received lines to a file (M28)
+	writing  int32
+	// Progress of the SD print up to which its usage was counted
+	counted  float64
+}
+
+var sdProgressRegexp = regexp.MustCompile(`SD printing byte (\d+)/(\d+)`)
+var sdFileOpenedRegexp = regexp.MustCompile(`File opened:\s*(\S+)\s+Size:\s*(\d+)`)
+var sdShortNameRegexp = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// 8.3 file name the firmware can create, e.g. "Benchy v2.gcode" -> BENCHYV2.GCO
+func sdShortName(name string) string {
+	if i := strings.LastIndex(name, "/"); i != -1 {
+		name = name[i+1:]
+	}
+	if i := strings.LastIndex(name, "."); i != -1 {
+		name = name[:i]
+	}
+
+	name = sdShortNameRegexp.ReplaceAllString(strings.ToUpper(name), "")
+	if len(name) > 8 {
+		name = name[:8]
+	}
+	if name == "" {
+		name = "UPLOAD"
+	}
+
+	return name + ".GCO"
+}
+
+func (p *Printer) isWritingSd() bool {
+	return atomic.LoadInt32(&p.sd.writing) != 0
+}
+
+// A job streamed from the host can't share the printer with an SD print or upload
+func (p *Printer) checkSdIdle() error {
+	p.sd.lock.Lock()
+	defer p.sd.lock.Unlock()
+
+	if p.sd.upload != nil && p.sd.upload.Running {
+		return errors.New("Upload to SD card in progress")
+	}
+	if p.sd.status.Printing {
+		return errors.New("Printer is printing from SD card")
+	}
+	return nil
+}
+
+// Track SD status from M27 replies, auto-reports and print completion messages
+func (p *Printer) parseSdStatus(line string) {
+	if m := sdProgressRegexp.FindStringSubmatch(line); m != nil {
+		pos, _ := strconv.ParseInt(m[1], 10, 64)
+		size, _ := strconv.ParseInt(m[2], 10, 64)
+
+		p.sd.lock.Lock()
+		advanced := p.sd.status.Printing && pos != p.sd.status.Position
+		p.sd.status.Printing = true
+		p.sd.status.Position = pos
+		p.sd.status.Size = size
+		if size > 0 {
+			p.sd.status.Progress = float64(pos) / float64(size)
+		}
+		p.sd.updated = time.Now()
+		used := p.sdPrintUsed()
+		p.sd.lock.Unlock()
+
+		p.trackSdPrintTime(advanced)
+		p.countSdPrintUsage(used)
+	} else if m := sdFileOpenedRegexp.FindStringSubmatch(line); m != nil {
+		size, _ := strconv.ParseInt(m[2], 10, 64)
+
+		p.sd.lock.Lock()
+		p.sd.status = SdStatus{ File: m[1], Size: size }
+		p.sd.updated = time.Now()
+		p.sd.counted = 0
+		p.sd.lock.Unlock()
+	} else if strings.HasPrefix(line, "Not SD printing") {
+		p.sd.lock.Lock()
+		p.sd.status.Printing = false
+		p.sd.updated = time.Now()
+		p.sd.lock.Unlock()
+	} else if strings.HasPrefix(line, "Done printing file") {
+		p.sd.lock.Lock()
+		wasPrinting := p.sd.status.Printing
+		p.sd.status.Printing = false
+		p.sd.status.Position = p.sd.status.Size
+		p.sd.status.Progress = 1
+		p.sd.updated = time.Now()
+		file := p.sd.status.File
+		used := p.sdPrintUsed()
+		p.sd.lock.Unlock()
+
+		p.countSdPrintUsage(used)
+		// Book the rest of the print now
+		go p.flushFilament(-1)
+
+		if wasPrinting {
+			p.emitEvent(EVENT_SD_PRINT_DONE, map[string]string{ "file": file })
+		}
+	}
+}
+
+// Usage of the SD print since it was last counted, going by the progress
+// through the file. Nothing is known of files not uploaded by dashprint.
+// Must be called with sd.lock held.
+func (p *Printer) sdPrintUsed() GcodeUsage {
+	usage, ok := p.SdUsage[p.sd.status.File]
+	delta := p.sd.status.Progress - p.sd.counted
+	if !ok || delta <= 0 {
+		return GcodeUsage{}
+	}
+	p.sd.counted = p.sd.status.Progress
+
+	used := GcodeUsage{ Filament: make([]float64, len(usage.Filament)), Length: usage.Length * delta }
+	for tool, length := range usage.Filament {
+		used.Filament[tool] = length * delta
+	}
+	for axis, d := range usage.Travel {
+		used.Travel[axis] = d * delta
+	}
+	return used
+}
+
+// Count usage of an SD print towards spools and maintenance counters
+func (p *Printer) countSdPrintUsage(used GcodeUsage) {
+	if used.Length == 0 && len(used.Filament) == 0 {
+		return
+	}
+
+	for tool, length := range used.Filament {
+		if length > 0 {
+			p.countExtruded(length)
+			p.addFilament(tool, length)
+		}
+	}
+	p.countTravel(used.Travel, used.Length)
+	p.usageUpdated()
+}
+
+// List files on the SD card with long names (M20 L)
+func (p *Printer) ListSdFiles() ([]SdFile, error) {
+	var reply []string
+	var cmdErr error
+
+	p.SendCommand("M20 L", func(r []string, err error) {
+		reply = r
+		cmdErr = err
+	})
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+
+	return parseSdFileList(reply, p.isKlipper()), nil
+}
+
+// Parse a file listing such as "BENCHY~1.GCO 1234567 3DBenchy v2.gcode". Size and
+// long name are optional. Klipper lists full names, which may contain spaces.
+func parseSdFileList(lines []string, klipper bool) []SdFile {
+	files := make([]SdFile, 0)
+	listing := false
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+
+		if line == "Begin file list" {
+			listing = true
+			continue
+		} else if line == "End file list" {
+			break
+		} else if !listing || line == "" {
+			continue
+		}
+
+		if klipper {
+			// name size
+			file := SdFile{ Name: line }
+			if i := strings.LastIndex(line, " "); i != -1 {
+				if size, err := strconv.ParseInt(line[i+1:], 10, 64); err == nil {
+					file.Name = strings.TrimSpace(line[:i])
+					file.Size = size
+				}
+			}
+
+			files = append(files, file)
+			continue
+		}
+
+		// SHORTNAME.GCO [size] [long name]
+		fields := strings.SplitN(line, " ", 3)
+		file := SdFile{ Name: fields[0] }
+
+		if len(fields) > 1 {
+			if size, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				file.Size = size
+				if len(fields) > 2 {
+					file.LongName = strings.TrimSpace(fields[2])
+				}
+			} else {
+				file.LongName = strings.TrimSpace(line[len(fields[0]):])
+			}
+		}
+
+		files = append(files, file)
+	}
+
+	return files
+}
+
+func (p *Printer) DeleteSdFile(name string) error {
+	var cmdErr error
+
+	p.SendCommand("M30 " + name, func(reply []string, err error) {
+		cmdErr = err
+		for _, line := range reply {
+			if strings.HasPrefix(line, "Deletion failed") {
+				cmdErr = errors.New(line)
+			}
+		}
+	})
+
+	if cmdErr == nil {
+		p.sd.lock.Lock()
+		delete(p.SdUsage, name)
+		p.sd.lock.Unlock()
+	}
+
+	return cmdErr
+}
+
+func (p *Printer) GetSdUpload() *SdUploadState {
+	p.sd.lock.Lock()
+	defer p.sd.lock.Unlock()
+
+	if p.sd.upload == nil {
+		return nil
+	}
+
+	upload := *p.sd.upload
+	return &upload
+}
+
+// Start writing G-code to the SD card in the background. Returns the 8.3 name used.
+func (p *Printer) UploadSdFile(name string, data []byte) (string, error) {
+	lines := make([]string, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, ";"); i != -1 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	// Printed from the card, the file's commands bypass checkLimits
+	if err := p.checkGcode(lines); err != nil {
+		return "", err
+	}
+
+	shortName := sdShortName(name)
+
+	if job := p.GetJob(); job != nil && job.State != JOB_INTERRUPTED {
+		return "", errors.New("A job is running")
+	}
+	if p.isFlashing() {
+		return "", errors.New("Firmware is being flashed")
+	}
+
+	p.sd.lock.Lock()
+	if p.sd.upload != nil && p.sd.upload.Running {
+		p.sd.lock.Unlock()
+		return "", errors.New("Upload already in progress")
+	}
+	if p.sd.status.Printing {
+		p.sd.lock.Unlock()
+		return "", errors.New("Printer is printing from SD card")
+	}
+
+	p.sd.upload = &SdUploadState{ Running: true, File: shortName, TotalLines: len(lines) }
+	p.sd.cancel = make(chan int)
+	cancel := p.sd.cancel
+	p.sd.lock.Unlock()
+
+	go p.uploadSdFile(shortName, lines, cancel)
+
+	return shortName, nil
+}
+
+func (p *Printer) CancelSdUpload() bool {
+	p.sd.lock.Lock()
+	defer p.sd.lock.Unlock()
+
+	if p.sd.upload == nil || !p.sd.upload.Running {
+		return false
+	}
+
+	close(p.sd.cancel)
+	p.sd.upload.Running = false
+	p.sd.upload.Error = "Cancelled"
+	return true
+}
+
+func (p *Printer) uploadSdFile(name string, lines []string, cancel chan int) {
+	var cmdErr error
+
+	p.SendCommand("M28 " + name, func(reply []string, err error) {
+		cmdErr = err
+		for _, line := range reply {
+			if strings.HasPrefix(line, "open failed") {
+				cmdErr = errors.New(line)
+			}
+		}
+	})
+
+	if cmdErr == nil {
+		// Everything sent from now on ends up in the file, so only
+		// the upload may talk to the printer
+		atomic.StoreInt32(&p.sd.writing, 1)
+
+	Lines:
+		for i, line := range lines {
+			select {
+				case <-cancel:
+					break Lines
+				default:
+			}
+
+			p.sendCommand(line, func(reply []string, err error) {
+				cmdErr = err
+			}, false)
+
+			if cmdErr != nil {
+				break
+			}
+
+			p.sd.lock.Lock()
+			p.sd.upload.Lines = i + 1
+			p.sd.lock.Unlock()
+		}
+
+		// Close the file even if the upload failed
+		p.sendCommand("M29", nil, false)
+		atomic.StoreInt32(&p.sd.writing, 0)
+	}
+
+	p.sd.lock.Lock()
+	if p.sd.upload.Running {
+		p.sd.upload.Running = false
+		if cmdErr != nil {
+			p.sd.upload.Error = cmdErr.Error()
+		}
+	}
+	upload := *p.sd.upload
+	if upload.Error == "" {
+		if p.SdUsage == nil {
+			p.SdUsage = make(map[string]GcodeUsage)
+		}
+		p.SdUsage[name] = analyzeGcode(lines)
+	}
+	p.sd.lock.Unlock()
+
+	if upload.Error != "" {
+		p.log().Errorf("Uploading %s to SD card failed: %s", name, upload.Error)
+		p.emitEvent(EVENT_SD_UPLOAD_FAILED, map[string]string{ "file": name, "error": upload.Error })
+	} else {
+		p.log().Infof("Uploaded %s to SD card (%d lines)", name, upload.Lines)
+		p.emitEvent(EVENT_SD_UPLOAD_FINISHED, map[string]string{ "file": name })
+	}
+}
+
+// Select a file and start printing it (M23, M24)
+func (p *Printer) StartSdPrint(name string) error {
+	if p.isWritingSd() {
+		return errors.New("Upload to SD card in progress")
+	}
+	if p.GetJob() != nil {
+		return errors.New("A job is running or must be resumed or cancelled first")
+	}
+	if p.isFlashing() {
+		return errors.New("Firmware is being flashed")
+	}
+
+	var cmdErr error
+
+	p.SendCommand("M23 " + name, func(reply []string, err error) {
+		cmdErr = err
+		for _, line := range reply {
+			if strings.HasPrefix(line, "open failed") {
+				cmdErr = errors.New(line)
+			}
+		}
+	})
+	if cmdErr != nil {
+		return cmdErr
+	}
+
+	p.SendCommand("M24", func(reply []string, err error) {
+		cmdErr = err
+	})
+	if cmdErr != nil {
+		return cmdErr
+	}
+
+	p.sd.lock.Lock()
+	p.sd.counted = 0
+	p.sd.status.Printing = true
+	p.sd.status.File = name
+	p.sd.lock.Unlock()
+
+	// Ask for progress auto-reports, firmware without support is polled with M27
+	p.SendCommand("M27 S" + strconv.Itoa(SD_STATUS_INTERVAL), nil)
+	return nil
+}
+
+func (p *Printer) PauseSdPrint() error {
+	var cmdErr error
+	p.SendCommand("M25", func(reply []string, err error) {
+		cmdErr = err
+	})
+	return cmdErr
+}
+
+func (p *Printer) ResumeSdPrint() error {
+	var cmdErr error
+	p.SendCommand("M24", func(reply []string, err error) {
+		cmdErr = err
+	})
+	return cmdErr
+}
+
+// Get SD print progress, querying the printer if there was no recent report
+func (p *Printer) GetSdStatus() SdStatus {
+	p.sd.lock.Lock()
+	stale := time.Since(p.sd.updated) > time.Millisecond * SD_STATUS_MAX_AGE
+	p.sd.lock.Unlock()
+
+	if stale && p.GetState() == STATE_CONNECTED && !p.isWritingSd() {
+		p.SendCommand("M27", nil)
+	}
+
+	p.sd.lock.Lock()
+	defer p.sd.lock.Unlock()
+
+	status := p.sd.status
+	if !p.sd.updated.IsZero() {
+		status.Updated = p.sd.updated.Format(time.RFC3339)
+	}
+	return status
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSdFileList(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		klipper bool
+		files   []SdFile
+	}{
+		{
+			name: "Marlin long names",
+			output: `echo:Now fresh file: BENCHY~1.GCO
+Begin file list
+BENCHY~1.GCO 1234567 3DBenchy v2.gcode
+CALIBR~1.GCO 45678 calibration cube 20mm.gcode
+PARTS/BRACKE~1.GCO 2345 bracket.gcode
+End file list
+ok`,
+			files: []SdFile{
+				{ Name: "BENCHY~1.GCO", LongName: "3DBenchy v2.gcode", Size: 1234567 },
+				{ Name: "CALIBR~1.GCO", LongName: "calibration cube 20mm.gcode", Size: 45678 },
+				{ Name: "PARTS/BRACKE~1.GCO", LongName: "bracket.gcode", Size: 2345 },
+			},
+		},
+		{
+			name: "Marlin without long names",
+			output: `Begin file list
+BENCHY.GCO 1234567
+CUBE.GCO 45678
+End file list`,
+			files: []SdFile{
+				{ Name: "BENCHY.GCO", Size: 1234567 },
+				{ Name: "CUBE.GCO", Size: 45678 },
+			},
+		},
+		{
+			name: "Without size",
+			output: `Begin file list
+BENCHY.GCO
+CALIBR~1.GCO calibration cube.gcode
+
+End file list`,
+			files: []SdFile{
+				{ Name: "BENCHY.GCO" },
+				{ Name: "CALIBR~1.GCO", LongName: "calibration cube.gcode" },
+			},
+		},
+		{
+			name: "Long name ending in a number",
+			output: `Begin file list
+PART2~1.GCO 512 part 2
+End file list`,
+			files: []SdFile{
+				{ Name: "PART2~1.GCO", LongName: "part 2", Size: 512 },
+			},
+		},
+		{
+			name: "Empty card",
+			output: `Begin file list
+End file list
+ok`,
+			files: []SdFile{},
+		},
+		{
+			name: "No listing",
+			output: `echo:No SD card
+ok`,
+			files: []SdFile{},
+		},
+		{
+			name: "Klipper",
+			output: `Begin file list
+benchy.gcode 1234567
+my parts/bracket v2.gcode 2345
+noname
+End file list`,
+			klipper: true,
+			files: []SdFile{
+				{ Name: "benchy.gcode", Size: 1234567 },
+				{ Name: "my parts/bracket v2.gcode", Size: 2345 },
+				{ Name: "noname" },
+			},
+		},
+	}
+
+	for _, test := range tests {
+		files := parseSdFileList(strings.Split(test.output, "\n"), test.klipper)
+		if !reflect.DeepEqual(files, test.files) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.files, files)
+		}
+	}
+}
+
+func TestSdShortName(t *testing.T) {
+	tests := map[string]string{
+		"benchy.gcode": "BENCHY.GCO",
+		"Benchy v2.gcode": "BENCHYV2.GCO",
+		"parts/calibration-cube.gcode": "CALIBRAT.GCO",
+	}
+
+	for name, expected := range tests {
+		if short := sdShortName(name); short != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, short)
+		}
+	}
+}
+
+func TestSdPrintTime(t *testing.T) {
+	p := LoadPrinter(PrinterSettings{ UniqueName: "test" })
+	p.usage.lastSave = time.Now()
+
+	report := func(pos int) float64 {
+		time.Sleep(10 * time.Millisecond)
+		p.parseSdStatus(fmt.Sprintf("SD printing byte %d/1000", pos))
+		return p.GetMaintenance().Counters.PrintHours
+	}
+
+	if hours := report(100); hours != 0 {
+		t.Errorf("the first report should not count, got %g h", hours)
+	}
+
+	hours := report(200)
+	if hours <= 0 {
+		t.Fatal("expected printing time once the print advanced")
+	}
+
+	// Paused, the firmware keeps reporting the same position
+	if paused := report(200); paused != hours {
+		t.Errorf("time paused should not count, got %g h instead of %g h", paused, hours)
+	}
+}
+
+func TestSdPrintFilament(t *testing.T) {
+	withDataDir(t)
+	s := Spool{ Id: 1, Material: "PLA", InitialWeight: 1000, RemainingWeight: 1000, Printer: "test", Extruder: 0 }
+	s.normalize()
+	withSpools(t, []Spool{ s })
+
+	p := LoadPrinter(PrinterSettings{ UniqueName: "test" })
+	p.usage.lastSave = time.Now()
+	p.SdUsage = map[string]GcodeUsage{ "BENCHY.GCO": analyzeGcode([]string{ "G28", "G1 X10 E600", "G1 X20 E1000" }) }
+
+	booked := func() float64 {
+		spoolsMutex.RLock()
+		defer spoolsMutex.RUnlock()
+		total := 0.0
+		for _, u := range findSpool(1).History {
+			total += u.Length
+		}
+		return total
+	}
+
+	p.parseSdStatus("File opened: BENCHY.GCO Size: 1000")
+	p.parseSdStatus("SD printing byte 0/1000")
+	p.parseSdStatus("SD printing byte 250/1000")
+	if pending := p.extrusion.pending[0]; pending != 250 {
+		t.Errorf("expected 250 mm pending after a quarter, got %g", pending)
+	}
+
+	p.parseSdStatus("Done printing file")
+	waitFor(t, "the filament to be booked", func() bool { return booked() > 0 })
+	if total := booked(); total != 1000 {
+		t.Errorf("expected 1000 mm booked, got %g", total)
+	}
+
+	// Printing the file again counts again
+	p.parseSdStatus("File opened: BENCHY.GCO Size: 1000")
+	p.parseSdStatus("SD printing byte 500/1000")
+	if pending := p.extrusion.pending[0]; pending != 500 {
+		t.Errorf("expected 500 mm pending, got %g", pending)
+	}
+
+	// Files not uploaded by dashprint are unknown
+	p.parseSdStatus("File opened: OTHER.GCO Size: 1000")
+	p.parseSdStatus("SD printing byte 500/1000")
+	if pending := p.extrusion.pending[0]; pending != 500 {
+		t.Errorf("expected nothing booked for an unknown file, got %g mm pending", pending)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var tlsCert = flag.String("tls-cert", "", "TLS certificate file, enables HTTPS")
+var tlsKey = flag.String("tls-key", "", "TLS private key file")
+var tlsSelfSigned = flag.Bool("tls-self-signed", false, "Serve HTTPS with a generated self-signed certificate")
+var basePath = flag.String("base-path", "", "URL prefix when running behind a reverse proxy, e.g. /printing")
+var trustProxy = flag.Bool("trust-proxy", false, "Honor X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-For")
+var readTimeout = flag.Duration("read-timeout", 30 * time.Second, "HTTP request read timeout, uploads are limited by -transfer-timeout instead")
+var readHeaderTimeout = flag.Duration("read-header-timeout", 10 * time.Second, "HTTP request header read timeout")
+var writeTimeout = flag.Duration("write-timeout", 60 * time.Second, "HTTP response write timeout, downloads are limited by -transfer-timeout instead")
+var transferTimeout = flag.Duration("transfer-timeout", time.Hour, "Time limit of file uploads and downloads, 0 for none")
+var idleTimeout = flag.Duration("idle-timeout", 120 * time.Second, "HTTP keep-alive idle timeout")
+
+const (
+	SHUTDOWN_TIMEOUT = 10 // seconds
+)
+
+// Normalized URL prefix, "" or "/something"
+func getBasePath() string {
+	return strings.TrimSuffix(*basePath, "/")
+}
+
+// URL scheme as seen by the client
+func requestScheme(r *http.Request) string {
+	if *trustProxy {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			return proto
+		}
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Absolute URL of a path as seen by the client
+func externalURL(r *http.Request, path string) string {
+	host := r.Host
+
+	if *trustProxy {
+		if fwdHost := r.Header.Get("X-Forwarded-Host"); fwdHost != "" {
+			host = fwdHost
+		}
+	}
+
+	return requestScheme(r) + "://" + host + getBasePath() + path
+}
+
+// Address of the client, looking through the reverse proxy if trusted.
+// The proxy appends the address it saw, anything before it comes from the client.
+func remoteAddr(r *http.Request) string {
+	if *trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			hops := strings.Split(fwd, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Replace the server's read and write timeouts with -transfer-timeout for a
+// handler receiving or sending whole files
+func fileTransfer(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		if *transferTimeout > 0 {
+			deadline = time.Now().Add(*transferTimeout)
+		}
+
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(deadline); err != nil {
+			log.Println("Cannot set read deadline: ", err)
+		}
+		if err := rc.SetWriteDeadline(deadline); err != nil {
+			log.Println("Cannot set write deadline: ", err)
+		}
+
+		handler(w, r)
+	}
+}
+
+// Generate a self-signed certificate unless one was generated before
+func selfSignedCertificate() (string, string) {
+	user, err := user.Current()
+	if err != nil {
+		log.Fatal("Cannot determine home directory: ", err)
+	}
+
+	certFile := user.HomeDir + "/.local/share/dashprint-cert.pem"
+	keyFile := user.HomeDir + "/.local/share/dashprint-key.pem"
+
+	if _, err := os.Stat(certFile); err == nil {
+		return certFile, keyFile
+	}
+
+	log.Println("Generating self-signed certificate...")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal("Cannot generate key: ", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		log.Fatal("Cannot generate serial number: ", err)
+	}
+
+	hostname, _ := os.Hostname()
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{ Organization: []string{ "dashprint" }, CommonName: hostname },
+		NotBefore: time.Now(),
+		NotAfter: time.Now().AddDate(10, 0, 0),
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{ x509.ExtKeyUsageServerAuth },
+		BasicConstraintsValid: true,
+		DNSNames: []string{ hostname, "localhost" },
+		IPAddresses: []net.IP{ net.ParseIP("127.0.0.1"), net.ParseIP("::1") },
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		log.Fatal("Cannot create certificate: ", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		log.Fatal("Cannot encode key: ", err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: der })
+	keyPem := pem.EncodeToMemory(&pem.Block{ Type: "EC PRIVATE KEY", Bytes: keyDer })
+
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		log.Fatal("Cannot save key: ", err)
+	}
+	if err := ioutil.WriteFile(certFile, certPem, 0644); err != nil {
+		log.Fatal("Cannot save certificate: ", err)
+	}
+
+	return certFile, keyFile
+}
+
+// Serve HTTP(S) until SIGTERM or SIGINT, then shut down gracefully
+func runServer(handler http.Handler) {
+	if prefix := getBasePath(); prefix != "" {
+		handler = http.StripPrefix(prefix, handler)
+	}
+
+	server := &http.Server{
+		Addr: *httpAddr,
+		Handler: handler,
+		ReadTimeout: *readTimeout,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout: *idleTimeout,
+	}
+
+	certFile, keyFile := *tlsCert, *tlsKey
+	if certFile == "" && *tlsSelfSigned {
+		certFile, keyFile = selfSignedCertificate()
+	}
+
+	done := make(chan int)
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+		sig := <-signals
+		log.Printf("Received %v, shutting down...\n", sig)
+		sdNotify("STOPPING=1")
+
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT * time.Second)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("HTTP shutdown: ", err)
+		}
+
+		stopPrinters()
+		// Usage counters are only saved periodically while running
+		saveConfig()
+		close(done)
+	}()
+
+	listener, err := net.Listen("tcp", *httpAddr)
+	if err != nil {
+		log.Fatal("HTTP error: ", err)
+	}
+
+	startSystemdNotify()
+
+	if certFile != "" {
+		log.Printf("Listening on %s (HTTPS)\n", *httpAddr)
+		err = server.ServeTLS(listener, certFile, keyFile)
+	} else {
+		log.Printf("Listening on %s\n", *httpAddr)
+		err = server.Serve(listener)
+	}
+
+	if err != http.ErrServerClosed {
+		log.Fatal("HTTP error: ", err)
+	}
+
+	<-done
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Upload a body in two parts with a pause longer than the server's read timeout
+func slowUpload(t *testing.T, url string) (int, error) {
+	r, w := io.Pipe()
+	go func() {
+		w.Write([]byte("G28\n"))
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("G1 X10\n"))
+		w.Close()
+	}()
+
+	resp, err := http.Post(url, "text/plain", r)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestFileTransferDeadline(t *testing.T) {
+	old := *transferTimeout
+	*transferTimeout = 5 * time.Second
+	defer func() { *transferTimeout = old }()
+
+	upload := func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/limited", upload)
+	mux.HandleFunc("/transfer", fileTransfer(audited("test.upload", upload)))
+
+	server := httptest.NewUnstartedServer(mux)
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	if status, err := slowUpload(t, server.URL + "/limited"); err == nil && status == http.StatusOK {
+		t.Error("a slow upload should exceed the read timeout")
+	}
+
+	if status, err := slowUpload(t, server.URL + "/transfer"); err != nil || status != http.StatusOK {
+		t.Errorf("a slow file transfer should not time out, got %d, %v", status, err)
+	}
+}
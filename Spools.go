@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_SPOOL_LOW = "spool_low"
+	EVENT_FILAMENT_INSUFFICIENT = "filament_insufficient"
+)
+
+const (
+	// Used filament is booked to spools in chunks of this many mm
+	SPOOL_FLUSH_LENGTH = 1000
+	// How often booked filament is written to the configuration
+	SPOOL_SAVE_INTERVAL = 300000 // 5 minutes
+	MAX_SPOOL_HISTORY  = 365
+	DEFAULT_FILAMENT_DIAMETER = 1.75
+	DEFAULT_LOW_WEIGHT = 50
+)
+
+// Filament consumed from a spool by a printer on one day
+type SpoolUsage struct {
+	Date    string  `json:"date"`
+	Printer string  `json:"printer"`
+	// mm of filament
+	Length  float64 `json:"length"`
+	// Grams of filament
+	Weight  float64 `json:"weight"`
+}
+
+type Spool struct {
+	Id              int          `json:"id"`
+	Material        string       `json:"material"`
+	Brand           string       `json:"brand"`
+	Color           string       `json:"color"`
+	// mm
+	Diameter        float64      `json:"diameter"`
+	// g/cm³, defaults by material
+	Density         float64      `json:"density"`
+	// Grams of filament without the empty spool
+	InitialWeight   float64      `json:"initialWeight"`
+	RemainingWeight float64      `json:"remainingWeight"`
+	PricePerKg      float64      `json:"pricePerKg"`
+	// Warn when less than this many grams remain
+	LowWeight       float64      `json:"lowWeight"`
+	Location        string       `json:"location"`
+	// Printer and extruder the spool is loaded on, if any
+	Printer         string       `json:"printer"`
+	Extruder        int          `json:"extruder"`
+	History         []SpoolUsage `json:"history"`
+}
+
+var materialDensities = map[string]float64{
+	"PLA": 1.24,
+	"PETG": 1.27,
+	"ABS": 1.04,
+	"ASA": 1.07,
+	"TPU": 1.21,
+	"PA": 1.14,
+	"NYLON": 1.14,
+	"PC": 1.20,
+	"PVA": 1.23,
+	"HIPS": 1.04,
+}
+
+var spools []Spool
+var spoolsMutex sync.RWMutex
+var spoolsSaved time.Time
+
+// Filament used by G-code sent to a printer
+type extrusionState struct {
+	lock     sync.Mutex
+	// Used mm per extruder not yet booked to a spool
+	pending  map[int]float64
+}
+
+// Fill in defaults for missing values
+func (s *Spool) normalize() {
+	s.Material = strings.ToUpper(strings.TrimSpace(s.Material))
+
+	if s.Diameter <= 0 {
+		s.Diameter = DEFAULT_FILAMENT_DIAMETER
+	}
+	if s.Density <= 0 {
+		if d, ok := materialDensities[s.Material]; ok {
+			s.Density = d
+		} else {
+			s.Density = materialDensities["PLA"]
+		}
+	}
+	if s.LowWeight <= 0 {
+		s.LowWeight = DEFAULT_LOW_WEIGHT
+	}
+	if s.History == nil {
+		s.History = make([]SpoolUsage, 0)
+	}
+}
+
+// Weight of the given length of filament in grams
+func (s *Spool) weightOf(length float64) float64 {
+	r := s.Diameter / 2
+	return math.Pi * r * r * length / 1000 * s.Density
+}
+
+// Length of filament left in mm
+func (s *Spool) remainingLength() float64 {
+	return s.RemainingWeight / s.weightOf(1)
+}
+
+// Deep copy of all spools. Must be called with spoolsMutex held.
+func copySpools() []Spool {
+	rv := make([]Spool, len(spools))
+	for i, s := range spools {
+		rv[i] = s
+		rv[i].History = append([]SpoolUsage{}, s.History...)
+	}
+	return rv
+}
+
+// Must be called with spoolsMutex held
+func findSpool(id int) *Spool {
+	for i := range spools {
+		if spools[i].Id == id {
+			return &spools[i]
+		}
+	}
+	return nil
+}
+
+// Must be called with spoolsMutex held
+func findLoadedSpool(printer string, extruder int) *Spool {
+	for i := range spools {
+		if spools[i].Printer == printer && spools[i].Extruder == extruder {
+			return &spools[i]
+		}
+	}
+	return nil
+}
+
+// Must be called with spoolsMutex held
+func nextSpoolId() int {
+	id := 1
+	for i := range spools {
+		if spools[i].Id >= id {
+			id = spools[i].Id + 1
+		}
+	}
+	return id
+}
+
+// Load a spool on an extruder, replacing whatever was loaded there
+func loadSpool(id int, printer string, extruder int) bool {
+	spoolsMutex.Lock()
+	defer spoolsMutex.Unlock()
+
+	s := findSpool(id)
+	if s == nil {
+		return false
+	}
+
+	if old := findLoadedSpool(printer, extruder); old != nil {
+		old.Printer = ""
+		old.Extruder = 0
+	}
+
+	s.Printer = printer
+	s.Extruder = extruder
+	return true
+}
+
+func unloadSpool(printer string, extruder int) bool {
+	spoolsMutex.Lock()
+	defer spoolsMutex.Unlock()
+
+	s := findLoadedSpool(printer, extruder)
+	if s == nil {
+		return false
+	}
+
+	s.Printer = ""
+	s.Extruder = 0
+	return true
+}
+
+// Count filament used by a move
+func (p *Printer) trackExtrusion(move *motionMove) {
+	if move.extruded == 0 {
+		return
+	}
+
+	p.countExtruded(move.extruded)
+	p.addFilament(move.tool, move.extruded)
+}
+
+// Add filament used on an extruder, booking it to the spool once there is enough
+func (p *Printer) addFilament(extruder int, length float64) {
+	e := &p.extrusion
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.pending == nil {
+		e.pending = make(map[int]float64)
+	}
+	e.pending[extruder] += length
+
+	if e.pending[extruder] >= SPOOL_FLUSH_LENGTH {
+		go p.consumeFilament(extruder, e.pending[extruder])
+		e.pending[extruder] = 0
+	}
+}
+
+// Book filament used but not booked yet, on an extruder or all of them if extruder
+// is -1. Returns whether there was any.
+func (p *Printer) flushFilament(extruder int) bool {
+	e := &p.extrusion
+	pending := make(map[int]float64)
+
+	e.lock.Lock()
+	for tool, length := range e.pending {
+		if (extruder == -1 || tool == extruder) && length > 0 {
+			pending[tool] = length
+			e.pending[tool] = 0
+		}
+	}
+	e.lock.Unlock()
+
+	for tool, length := range pending {
+		p.consumeFilament(tool, length)
+	}
+	return len(pending) > 0
+}
+
+// Book used filament to the spool loaded on the extruder
+func (p *Printer) consumeFilament(extruder int, length float64) {
+	spoolsMutex.Lock()
+
+	s := findLoadedSpool(p.UniqueName, extruder)
+	if s == nil {
+		spoolsMutex.Unlock()
+		return
+	}
+
+	weight := s.weightOf(length)
+	wasLow := s.RemainingWeight < s.LowWeight
+
+	s.RemainingWeight = math.Max(0, s.RemainingWeight - weight)
+
+	date := time.Now().Format("2006-01-02")
+	if n := len(s.History); n > 0 && s.History[n-1].Date == date && s.History[n-1].Printer == p.UniqueName {
+		s.History[n-1].Length += length
+		s.History[n-1].Weight += weight
+	} else {
+		s.History = append(s.History, SpoolUsage{ Date: date, Printer: p.UniqueName, Length: length, Weight: weight })
+		if len(s.History) > MAX_SPOOL_HISTORY {
+			s.History = s.History[len(s.History)-MAX_SPOOL_HISTORY:]
+		}
+	}
+
+	low := !wasLow && s.RemainingWeight < s.LowWeight
+	id := s.Id
+	remaining := s.RemainingWeight
+
+	save := low || time.Since(spoolsSaved) > time.Millisecond * SPOOL_SAVE_INTERVAL
+	if save {
+		spoolsSaved = time.Now()
+	}
+	spoolsMutex.Unlock()
+
+	if save {
+		saveConfig()
+	}
+
+	if low {
+		p.log().Warnf("Spool %d on extruder %d is running low (%.0f g left)", id, extruder, remaining)
+		p.emitEvent(EVENT_SPOOL_LOW, map[string]string{
+			"spool": strconv.Itoa(id),
+			"extruder": strconv.Itoa(extruder),
+			"remaining": strconv.FormatFloat(remaining, 'f', 0, 64),
+		})
+	}
+}
+
+type FilamentCheck struct {
+	Extruder  int     `json:"extruder"`
+	// Spool loaded on the extruder, 0 if none
+	Spool     int     `json:"spool"`
+	Required  float64 `json:"required"`
+	Remaining float64 `json:"remaining"`
+	// Grams
+	RequiredWeight  float64 `json:"requiredWeight"`
+	RemainingWeight float64 `json:"remainingWeight"`
+	Sufficient bool   `json:"sufficient"`
+}
+
+// Check whether loaded spools hold enough filament, given mm needed per extruder
+func (p *Printer) CheckFilament(required []float64) []FilamentCheck {
+	spoolsMutex.RLock()
+	defer spoolsMutex.RUnlock()
+
+	rv := make([]FilamentCheck, len(required))
+
+	for i, length := range required {
+		rv[i] = FilamentCheck{ Extruder: i, Required: length }
+
+		if s := findLoadedSpool(p.UniqueName, i); s != nil {
+			rv[i].Spool = s.Id
+			rv[i].Remaining = s.remainingLength()
+			rv[i].RequiredWeight = s.weightOf(length)
+			rv[i].RemainingWeight = s.RemainingWeight
+			rv[i].Sufficient = rv[i].Remaining >= length
+		} else {
+			rv[i].Sufficient = length <= 0
+		}
+	}
+
+	return rv
+}
+
+// Filament the rest of a file uses from a position on, mm per extruder
+func analyzeFilament(r io.Reader, from jobPosition) ([]float64, error) {
+	reader := bufio.NewReader(r)
+	filament := make([]float64, 0)
+
+	position := from
+	for {
+		raw, err := reader.ReadString('\n')
+		if err == io.EOF && raw == "" {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		next, command, _ := position.advance(raw)
+		if tool := position.State.Tool; isMoveCommand(command) && tool >= 0 {
+			for len(filament) <= tool {
+				filament = append(filament, 0)
+			}
+			filament[tool] += next.State.E - position.State.E
+		}
+		position = next
+	}
+
+	// A file that only retracts uses no filament
+	for i := range filament {
+		filament[i] = math.Max(0, filament[i])
+	}
+	return filament, nil
+}
+
+// Warn when a loaded spool holds less filament than a job needs. Extruders
+// without a spool are not tracked and don't warn.
+func (p *Printer) warnFilament(job *Job) {
+	for _, check := range p.CheckFilament(job.Filament) {
+		if check.Spool == 0 || check.Sufficient {
+			continue
+		}
+
+		p.log().Warnf("Job %s needs %.0f mm of filament on extruder %d, spool %d has %.0f mm",
+			job.Id, check.Required, check.Extruder, check.Spool, check.Remaining)
+		p.emitEvent(EVENT_FILAMENT_INSUFFICIENT, map[string]string{
+			"job": job.Id,
+			"file": job.File,
+			"extruder": strconv.Itoa(check.Extruder),
+			"spool": strconv.Itoa(check.Spool),
+			"required": fmt.Sprintf("%.0f", check.Required),
+			"remaining": fmt.Sprintf("%.0f", check.Remaining),
+		})
+	}
+}
+
+// Spools loaded on the printer's extruders
+func (p *Printer) GetLoadedSpools() []Spool {
+	spoolsMutex.RLock()
+	defer spoolsMutex.RUnlock()
+
+	rv := make([]Spool, 0)
+	for i := range spools {
+		if spools[i].Printer == p.UniqueName {
+			rv = append(rv, spools[i])
+		}
+	}
+	return rv
+}
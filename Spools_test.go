@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Replace the spool list for a test, without saving the configuration
+func withSpools(t *testing.T, list []Spool) {
+	spoolsMutex.Lock()
+	old, oldSaved := spools, spoolsSaved
+	spools = list
+	spoolsSaved = time.Now()
+	spoolsMutex.Unlock()
+
+	t.Cleanup(func() {
+		spoolsMutex.Lock()
+		spools, spoolsSaved = old, oldSaved
+		spoolsMutex.Unlock()
+	})
+}
+
+func TestArcExtrusion(t *testing.T) {
+	p := LoadPrinter(PrinterSettings{ UniqueName: "test" })
+	p.resetMotion()
+	// Counters are not due for saving
+	p.usage.lastSave = time.Now()
+
+	for _, line := range [][]string{ { "T1" }, { "G1", "X10", "Y0", "E2" }, { "G2", "X10", "Y-20", "I0", "J-10", "E10" }, { "G3", "X10", "Y0", "R10", "E12.5" } } {
+		p.trackMotion(line[0], line[1:])
+	}
+
+	if pending := p.extrusion.pending[1]; pending != 12.5 {
+		t.Errorf("expected 12.5 mm pending on T1, got %g", pending)
+	}
+	if c := p.GetMaintenance().Counters; math.Abs(c.ExtrudedMeters - 0.0125) > 1e-9 {
+		t.Errorf("expected 0.0125 m extruded, got %g", c.ExtrudedMeters)
+	}
+}
+
+func TestFlushFilament(t *testing.T) {
+	s0 := Spool{ Id: 1, Material: "PLA", InitialWeight: 1000, RemainingWeight: 1000, Printer: "test", Extruder: 0 }
+	s1 := Spool{ Id: 2, Material: "PETG", InitialWeight: 1000, RemainingWeight: 1000, Printer: "test", Extruder: 1 }
+	s0.normalize()
+	s1.normalize()
+	withSpools(t, []Spool{ s0, s1 })
+
+	p := LoadPrinter(PrinterSettings{ UniqueName: "test" })
+	p.extrusion.pending = map[int]float64{ 0: 400, 1: 250 }
+
+	if !p.flushFilament(1) {
+		t.Fatal("expected filament to be booked")
+	}
+	if p.extrusion.pending[0] != 400 || p.extrusion.pending[1] != 0 {
+		t.Errorf("only extruder 1 should be booked, pending %v", p.extrusion.pending)
+	}
+
+	if !p.flushFilament(-1) {
+		t.Fatal("expected filament to be booked")
+	}
+	if p.flushFilament(-1) {
+		t.Error("nothing should be left to book")
+	}
+
+	spoolsMutex.RLock()
+	defer spoolsMutex.RUnlock()
+
+	for _, expected := range []struct{ id int; length float64 }{ { 1, 400 }, { 2, 250 } } {
+		s := findSpool(expected.id)
+		if len(s.History) != 1 || s.History[0].Length != expected.length {
+			t.Errorf("spool %d: expected %g mm booked, got %+v", expected.id, expected.length, s.History)
+		}
+		if remaining := s.InitialWeight - s.weightOf(expected.length); math.Abs(s.RemainingWeight - remaining) > 1e-9 {
+			t.Errorf("spool %d: expected %g g left, got %g", expected.id, remaining, s.RemainingWeight)
+		}
+	}
+}
+
+func TestCopySpools(t *testing.T) {
+	withSpools(t, []Spool{ { Id: 1, History: []SpoolUsage{ { Date: "2026-10-19", Length: 100 } } } })
+
+	spoolsMutex.RLock()
+	copied := copySpools()
+	spoolsMutex.RUnlock()
+
+	spools[0].History[0].Length = 200
+	if copied[0].History[0].Length != 100 {
+		t.Error("history of copied spools should not change with the original")
+	}
+}
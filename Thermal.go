@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EVENT_THERMAL_FAULT = "thermal_fault"
+)
+
+const (
+	THERMAL_HEATING_PERIOD = 60 // seconds
+	THERMAL_HEATING_GAIN = 2.0
+	THERMAL_HYSTERESIS = 4.0
+	THERMAL_DROP = 15.0
+	THERMAL_STALE_TIMEOUT = 30 // seconds
+	THERMAL_STALE_CHECK_INTERVAL = 1000 // 1 second
+)
+
+// Host-side thermal runaway protection, for firmware lacking it
+type ThermalSettings struct {
+	// Enabled unless set to false
+	Enabled         *bool              `json:"enabled"`
+	// Maximum allowed temperature by heater (T, T0, B...)
+	MaxTemperatures map[string]float64 `json:"maxTemperatures"`
+	// A heater below target must rise by HeatingGain within HeatingPeriod seconds
+	HeatingPeriod   uint               `json:"heatingPeriod"`
+	HeatingGain     float64            `json:"heatingGain"`
+	// Drop below a reached target considered a fault
+	Drop            float64            `json:"drop"`
+	// Seconds without temperature reports while heating
+	StaleTimeout    uint               `json:"staleTimeout"`
+	// "M112" (default) or "heaters_off"
+	Action          string             `json:"action"`
+}
+
+// Watchdog state of a single heater
+type heaterWatch struct {
+	target      float64
+	reached     bool
+	riseStart   time.Time
+	riseTemp    float64
+}
+
+var defaultMaxTemperatures = map[string]float64{ "T": 285, "B": 120, "C": 80 }
+
+func (ts *ThermalSettings) enabled() bool {
+	return ts.Enabled == nil || *ts.Enabled
+}
+
+func (ts *ThermalSettings) heatingPeriod() time.Duration {
+	if ts.HeatingPeriod == 0 {
+		return THERMAL_HEATING_PERIOD * time.Second
+	}
+	return time.Duration(ts.HeatingPeriod) * time.Second
+}
+
+func (ts *ThermalSettings) heatingGain() float64 {
+	if ts.HeatingGain == 0 {
+		return THERMAL_HEATING_GAIN
+	}
+	return ts.HeatingGain
+}
+
+func (ts *ThermalSettings) drop() float64 {
+	if ts.Drop == 0 {
+		return THERMAL_DROP
+	}
+	return ts.Drop
+}
+
+func (ts *ThermalSettings) staleTimeout() time.Duration {
+	if ts.StaleTimeout == 0 {
+		return THERMAL_STALE_TIMEOUT * time.Second
+	}
+	return time.Duration(ts.StaleTimeout) * time.Second
+}
+
+func (ts *ThermalSettings) maxTemperature(heater string) (float64, bool) {
+	if max, ok := ts.MaxTemperatures[heater]; ok {
+		return max, true
+	}
+
+	// T0, T1... fall back to T
+	if len(heater) > 1 && heater[0] == 'T' {
+		if max, ok := ts.MaxTemperatures["T"]; ok {
+			return max, true
+		}
+		heater = "T"
+	}
+
+	max, ok := defaultMaxTemperatures[heater]
+	return max, ok
+}
+
+// Check new temperature readings, called after each temperature report
+func (p *Printer) checkThermal(temps map[string]Temperature) {
+	ts := &p.Thermal
+	if !ts.enabled() || p.GetFault() != "" {
+		return
+	}
+
+	p.thermalLock.Lock()
+	defer p.thermalLock.Unlock()
+
+	now := time.Now()
+
+	for heater, temp := range temps {
+		if max, ok := ts.maxTemperature(heater); ok && temp.Current > max {
+			p.thermalFault(heater, temp, fmt.Sprintf("temperature above maximum of %.0f", max))
+			return
+		}
+
+		if temp.Target <= 0 {
+			delete(p.heaterWatches, heater)
+			continue
+		}
+
+		if temp.Current < TEMPERATURE_SANE_MIN {
+			p.thermalFault(heater, temp, "thermistor disconnected")
+			return
+		}
+
+		w, ok := p.heaterWatches[heater]
+		if !ok || w.target != temp.Target {
+			// New target, start watching again
+			w = &heaterWatch{ target: temp.Target, riseStart: now, riseTemp: temp.Current }
+			p.heaterWatches[heater] = w
+		}
+
+		if temp.Current >= temp.Target - THERMAL_HYSTERESIS {
+			w.reached = true
+			w.riseStart = now
+			w.riseTemp = temp.Current
+			continue
+		}
+
+		if w.reached {
+			if temp.Current < temp.Target - ts.drop() {
+				p.thermalFault(heater, temp, "temperature dropped while holding target")
+				return
+			}
+			continue
+		}
+
+		// Heating up, must make progress within the watch period
+		if temp.Current >= w.riseTemp + ts.heatingGain() {
+			w.riseStart = now
+			w.riseTemp = temp.Current
+		} else if now.Sub(w.riseStart) > ts.heatingPeriod() {
+			p.thermalFault(heater, temp, "heater failing to heat up")
+			return
+		}
+	}
+}
+
+// Check for missing temperature reports while connected. Runs apart from
+// temperatureLoop, which is stuck waiting for M105 if the firmware hangs.
+func (p *Printer) thermalStaleLoop() {
+	// A loop from the previous connection may still be running
+	if !atomic.CompareAndSwapInt32(&p.checkingThermal, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&p.checkingThermal, 0)
+
+	ticker := time.NewTicker(time.Millisecond * THERMAL_STALE_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <-ticker.C:
+			case <-p.channel:
+				return
+		}
+
+		if p.GetState() != STATE_CONNECTED {
+			return
+		}
+
+		// Temperatures are not polled during uploads to SD
+		if !p.isWritingSd() {
+			p.checkThermalStale()
+		}
+	}
+}
+
+// Detect missing temperature reports while heaters are on
+func (p *Printer) checkThermalStale() {
+	ts := &p.Thermal
+	if !ts.enabled() || p.GetFault() != "" {
+		return
+	}
+
+	p.thermalLock.Lock()
+	defer p.thermalLock.Unlock()
+
+	if len(p.heaterWatches) == 0 {
+		return
+	}
+
+	if time.Since(p.temperaturesLastUpdated()) > ts.staleTimeout() {
+		p.thermalFault("*", Temperature{}, "no temperature reports")
+	}
+}
+
+// Must be called with thermalLock held
+func (p *Printer) thermalFault(heater string, temp Temperature, reason string) {
+	p.faultLock.Lock()
+	if p.fault != "" {
+		p.faultLock.Unlock()
+		return
+	}
+	p.fault = fmt.Sprintf("Thermal fault on %s: %s", heater, reason)
+	p.faultLock.Unlock()
+
+	p.log().WithField("heater", heater).Errorf("Thermal fault: %s (current %.1f, target %.1f)", reason, temp.Current, temp.Target)
+
+	if p.Thermal.Action == "heaters_off" {
+		// Bypass the queue to break out of a running M109/M190 wait,
+		// which would otherwise hold the commands below back
+		p.writeCommand("M108\n")
+
+		// Not rejected because of the fault
+		commands := p.heatersOffCommands()
+		go func() {
+			for _, command := range commands {
+				p.sendCommand(command, nil, false)
+			}
+		}()
+	} else {
+		// Bypass the command queue, so that the emergency parser of the firmware
+		// can act even while a command (e.g. M109) is running
+		p.writeCommand("M112\n")
+	}
+
+	p.heaterWatches = make(map[string]*heaterWatch)
+
+	p.emitEvent(EVENT_THERMAL_FAULT, map[string]string{
+		"heater": heater,
+		"reason": reason,
+		"current": fmt.Sprintf("%.1f", temp.Current),
+		"target": fmt.Sprintf("%.1f", temp.Target),
+	})
+}
+
+// Commands turning off every extruder, the bed and the chamber if there is one
+func (p *Printer) heatersOffCommands() []string {
+	extruders := make([]string, 0)
+	chamber := false
+
+	for heater, _ := range p.GetTemperatures() {
+		if len(heater) > 1 && heater[0] == 'T' {
+			extruders = append(extruders, heater[1:])
+		} else if heater == "C" {
+			chamber = true
+		}
+	}
+	sort.Strings(extruders)
+
+	commands := make([]string, 0)
+	if len(extruders) == 0 {
+		commands = append(commands, "M104 S0")
+	}
+	for _, n := range extruders {
+		commands = append(commands, "M104 T" + n + " S0")
+	}
+
+	commands = append(commands, "M140 S0")
+	if chamber {
+		commands = append(commands, "M141 S0")
+	}
+	return commands
+}
+
+// Fault description or an empty string
+func (p *Printer) GetFault() string {
+	p.faultLock.Lock()
+	defer p.faultLock.Unlock()
+
+	return p.fault
+}
+
+func (p *Printer) ClearFault() {
+	p.faultLock.Lock()
+	defer p.faultLock.Unlock()
+
+	p.fault = ""
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Printer with thermal protection enabled, writing to a pipe instead of a serial port.
+// The returned function closes the port and returns everything written to it.
+func thermalPrinter(t *testing.T, action string) (*Printer, func() string) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := LoadPrinter(PrinterSettings{ UniqueName: "test", Thermal: ThermalSettings{ Action: action } })
+	p.port = w
+	p.sendWaitChan = make(chan int, 1)
+
+	return p, func() string {
+		w.Close()
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		return string(data)
+	}
+}
+
+func TestThermalMaxTemperature(t *testing.T) {
+	p, written := thermalPrinter(t, "")
+
+	p.checkThermal(map[string]Temperature{ "T0": { Current: 250, Target: 250 }, "B": { Current: 60, Target: 60 } })
+	if fault := p.GetFault(); fault != "" {
+		t.Fatalf("unexpected fault: %s", fault)
+	}
+
+	p.checkThermal(map[string]Temperature{ "T0": { Current: 290, Target: 250 } })
+	if fault := p.GetFault(); !strings.Contains(fault, "T0") {
+		t.Fatalf("expected a fault on T0, got %q", fault)
+	}
+
+	if out := written(); out != "M112\n" {
+		t.Errorf("expected M112, got %q", out)
+	}
+}
+
+func TestThermalDisconnected(t *testing.T) {
+	p, written := thermalPrinter(t, "")
+
+	p.checkThermal(map[string]Temperature{ "B": { Current: -14, Target: 60 } })
+	if fault := p.GetFault(); !strings.Contains(fault, "thermistor disconnected") {
+		t.Errorf("expected a disconnected thermistor, got %q", fault)
+	}
+	written()
+}
+
+func TestThermalHeatingUp(t *testing.T) {
+	p, written := thermalPrinter(t, "")
+	defer written()
+
+	p.checkThermal(map[string]Temperature{ "T0": { Current: 25, Target: 210 } })
+
+	// Rising by the required gain restarts the period
+	p.heaterWatches["T0"].riseStart = time.Now().Add(-2 * time.Minute)
+	p.checkThermal(map[string]Temperature{ "T0": { Current: 30, Target: 210 } })
+	if fault := p.GetFault(); fault != "" {
+		t.Fatalf("unexpected fault: %s", fault)
+	}
+
+	p.heaterWatches["T0"].riseStart = time.Now().Add(-2 * time.Minute)
+	p.checkThermal(map[string]Temperature{ "T0": { Current: 31, Target: 210 } })
+	if fault := p.GetFault(); !strings.Contains(fault, "failing to heat up") {
+		t.Errorf("expected a heating fault, got %q", fault)
+	}
+}
+
+func TestThermalDrop(t *testing.T) {
+	p, written := thermalPrinter(t, "")
+	defer written()
+
+	p.checkThermal(map[string]Temperature{ "B": { Current: 58, Target: 60 } })
+	if w := p.heaterWatches["B"]; w == nil || !w.reached {
+		t.Fatal("target should be reached within hysteresis")
+	}
+
+	p.checkThermal(map[string]Temperature{ "B": { Current: 50, Target: 60 } })
+	if fault := p.GetFault(); fault != "" {
+		t.Fatalf("unexpected fault: %s", fault)
+	}
+
+	p.checkThermal(map[string]Temperature{ "B": { Current: 44, Target: 60 } })
+	if fault := p.GetFault(); !strings.Contains(fault, "dropped") {
+		t.Errorf("expected a drop fault, got %q", fault)
+	}
+}
+
+func TestThermalNewTarget(t *testing.T) {
+	p, written := thermalPrinter(t, "")
+	defer written()
+
+	p.checkThermal(map[string]Temperature{ "T0": { Current: 210, Target: 210 } })
+
+	// Raising the target starts heating up again rather than counting as a drop
+	p.checkThermal(map[string]Temperature{ "T0": { Current: 210, Target: 240 } })
+	if w := p.heaterWatches["T0"]; w == nil || w.reached || w.target != 240 {
+		t.Errorf("expected a new watch, got %+v", w)
+	}
+
+	p.checkThermal(map[string]Temperature{ "T0": { Current: 180, Target: 0 } })
+	if _, ok := p.heaterWatches["T0"]; ok {
+		t.Error("watch should be removed once the heater is off")
+	}
+
+	if fault := p.GetFault(); fault != "" {
+		t.Errorf("unexpected fault: %s", fault)
+	}
+}
+
+func TestThermalDisabled(t *testing.T) {
+	p, written := thermalPrinter(t, "")
+	disabled := false
+	p.Thermal.Enabled = &disabled
+
+	p.checkThermal(map[string]Temperature{ "T0": { Current: 400, Target: 210 } })
+	if fault := p.GetFault(); fault != "" {
+		t.Errorf("unexpected fault: %s", fault)
+	}
+	if out := written(); out != "" {
+		t.Errorf("nothing should be sent, got %q", out)
+	}
+}
+
+func TestThermalEnabledByDefault(t *testing.T) {
+	for input, expected := range map[string]bool{
+		`{}`: true,
+		`{"enabled": true}`: true,
+		`{"enabled": false}`: false,
+	} {
+		var ts ThermalSettings
+		if err := json.Unmarshal([]byte(input), &ts); err != nil {
+			t.Fatal(err)
+		}
+		if ts.enabled() != expected {
+			t.Errorf("%s: expected enabled %v", input, expected)
+		}
+	}
+}
+
+func TestThermalHeatersOff(t *testing.T) {
+	p, written := thermalPrinter(t, "heaters_off")
+
+	p.parseTemperatures("M105", "ok T0:200.0 /200.0 T1:150.0 /0.0 B:60.0 /60.0 C:40.0 /45.0")
+	p.checkThermal(map[string]Temperature{ "T1": { Current: 300, Target: 0 } })
+
+	if fault := p.GetFault(); fault == "" {
+		t.Fatal("expected a fault")
+	}
+	if out := written(); out != "M108\n" {
+		t.Errorf("expected only M108 to bypass the queue, got %q", out)
+	}
+
+	expected := []string{ "M104 T0 S0", "M104 T1 S0", "M140 S0", "M141 S0" }
+	if commands := p.heatersOffCommands(); !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected %v, got %v", expected, commands)
+	}
+}
+
+func TestHeatersOffSingleExtruder(t *testing.T) {
+	p, written := thermalPrinter(t, "heaters_off")
+	defer written()
+
+	p.parseTemperatures("M105", "ok T:200.0 /200.0 B:60.0 /60.0 @:0 B@:0")
+
+	expected := []string{ "M104 S0", "M140 S0" }
+	if commands := p.heatersOffCommands(); !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected %v, got %v", expected, commands)
+	}
+}
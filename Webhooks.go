@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	WEBHOOK_TIMEOUT = 10 // seconds
+	WEBHOOK_RETRIES = 5
+	WEBHOOK_BACKOFF = 1000 // 1 second, doubled after each attempt
+)
+
+type Webhook struct {
+	Name     string   `json:"name"`
+	URL      string   `json:"url"`
+	// Event names to deliver, all events if empty
+	Events   []string `json:"events"`
+	// text/template producing the request body, the event is sent as JSON if empty
+	Template string   `json:"template"`
+	// If set, the body is signed with HMAC-SHA256 in the X-Dashprint-Signature header
+	Secret   string   `json:"secret"`
+}
+
+var webhooks []Webhook
+var webhooksMutex sync.RWMutex
+
+var webhookClient = &http.Client{ Timeout: WEBHOOK_TIMEOUT * time.Second }
+
+// Delay before the first retry
+var webhookBackoff = WEBHOOK_BACKOFF * time.Millisecond
+
+// PrinterListener delivering events to configured webhooks
+type printerWebhooks struct {
+	printer *Printer
+}
+
+func (h *printerWebhooks) onPrinterStateChanged(oldState int, newState int) {
+}
+
+func (h *printerWebhooks) onPrinterEvent(event PrinterEvent) {
+	for _, wh := range getWebhooks() {
+		if wh.matches(event.Name) {
+			go wh.deliver(h.printer, event)
+		}
+	}
+}
+
+// Copy of the named webhook, nil if there is none
+func findWebhook(name string) *Webhook {
+	webhooksMutex.RLock()
+	defer webhooksMutex.RUnlock()
+
+	for _, wh := range webhooks {
+		if wh.Name == name {
+			return &wh
+		}
+	}
+	return nil
+}
+
+// Copy of all webhooks
+func getWebhooks() []Webhook {
+	webhooksMutex.RLock()
+	defer webhooksMutex.RUnlock()
+
+	rv := make([]Webhook, len(webhooks))
+	copy(rv, webhooks)
+	return rv
+}
+
+func (wh *Webhook) matches(event string) bool {
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (wh *Webhook) payload(event PrinterEvent) ([]byte, error) {
+	if wh.Template == "" {
+		return json.Marshal(event)
+	}
+
+	funcs := template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}
+
+	tmpl, err := template.New(wh.Name).Funcs(funcs).Parse(wh.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, event); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Deliver the event of a printer, retrying with exponential backoff
+func (wh *Webhook) deliver(p *Printer, event PrinterEvent) {
+	body, err := wh.payload(event)
+	if err != nil {
+		p.log().Errorf("Webhook %s: cannot build payload: %v", wh.Name, err)
+		return
+	}
+
+	delay := webhookBackoff
+
+	for attempt := 1; ; attempt++ {
+		err = wh.post(body)
+		if err == nil {
+			return
+		}
+
+		p.log().Warnf("Webhook %s: attempt %d failed: %v", wh.Name, attempt, err)
+
+		if attempt == WEBHOOK_RETRIES {
+			p.log().Errorf("Webhook %s: giving up on %s event", wh.Name, event.Name)
+			return
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (wh *Webhook) post(body []byte) error {
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dashprint")
+
+	if wh.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Dashprint-Signature", "sha256=" + hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// Send a sample event once, without retrying
+func (wh *Webhook) test() error {
+	event := PrinterEvent{
+		Name: "test",
+		Printer: defaultPrinter,
+		Time: time.Now(),
+		Data: map[string]string{ "message": "Test notification from dashprint" },
+	}
+
+	body, err := wh.payload(event)
+	if err != nil {
+		return err
+	}
+	return wh.post(body)
+}
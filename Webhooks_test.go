@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	body      string
+	signature string
+}
+
+// Local stand-in for a webhook receiver, failing the first failures requests
+func webhookServer(t *testing.T, failures int) (*httptest.Server, func() []webhookRequest) {
+	var lock sync.Mutex
+	received := make([]webhookRequest, 0)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		lock.Lock()
+		received = append(received, webhookRequest{ body: string(body), signature: r.Header.Get("X-Dashprint-Signature") })
+		n := len(received)
+		lock.Unlock()
+
+		if n <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	return ts, func() []webhookRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]webhookRequest(nil), received...)
+	}
+}
+
+func testWebhookEvent() PrinterEvent {
+	return PrinterEvent{
+		Name: EVENT_CONNECTED,
+		Printer: "mk3",
+		Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Data: map[string]string{ "heater": "T0" },
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	ts, received := webhookServer(t, 0)
+	defer ts.Close()
+
+	wh := Webhook{ Name: "signed", URL: ts.URL, Secret: "s3cret" }
+	wh.deliver(LoadPrinter(PrinterSettings{ UniqueName: "mk3" }), testWebhookEvent())
+
+	reqs := received()
+	if len(reqs) != 1 {
+		t.Fatalf("Got %d requests, want 1", len(reqs))
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(reqs[0].body))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); reqs[0].signature != want {
+		t.Errorf("Signature %q, want %q", reqs[0].signature, want)
+	}
+}
+
+func TestWebhookUnsigned(t *testing.T) {
+	ts, received := webhookServer(t, 0)
+	defer ts.Close()
+
+	wh := Webhook{ Name: "plain", URL: ts.URL }
+	wh.deliver(LoadPrinter(PrinterSettings{ UniqueName: "mk3" }), testWebhookEvent())
+
+	if reqs := received(); len(reqs) != 1 || reqs[0].signature != "" {
+		t.Errorf("Unexpected requests %+v", reqs)
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	ts, received := webhookServer(t, 0)
+	defer ts.Close()
+
+	wh := Webhook{
+		Name: "chat",
+		URL: ts.URL,
+		Template: `{"text": "{{.Printer}}: {{.Name}} {{index .Data "heater"}}", "data": {{json .Data}}}`,
+	}
+	wh.deliver(LoadPrinter(PrinterSettings{ UniqueName: "mk3" }), testWebhookEvent())
+
+	reqs := received()
+	if len(reqs) != 1 {
+		t.Fatalf("Got %d requests, want 1", len(reqs))
+	}
+	if want := `{"text": "mk3: connected T0", "data": {"heater":"T0"}}`; reqs[0].body != want {
+		t.Errorf("Body %s, want %s", reqs[0].body, want)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	saved := webhookBackoff
+	webhookBackoff = 10 * time.Millisecond
+	defer func() { webhookBackoff = saved }()
+
+	ts, received := webhookServer(t, 2)
+	defer ts.Close()
+
+	wh := Webhook{ Name: "flaky", URL: ts.URL }
+
+	start := time.Now()
+	wh.deliver(LoadPrinter(PrinterSettings{ UniqueName: "mk3" }), testWebhookEvent())
+
+	if reqs := received(); len(reqs) != 3 {
+		t.Fatalf("Got %d requests, want 3", len(reqs))
+	}
+	// 10 ms, then 20 ms
+	if elapsed := time.Since(start); elapsed < 30 * time.Millisecond {
+		t.Errorf("Retried after %v, backoff not applied", elapsed)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	saved := webhookBackoff
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = saved }()
+
+	ts, received := webhookServer(t, WEBHOOK_RETRIES + 1)
+	defer ts.Close()
+
+	wh := Webhook{ Name: "down", URL: ts.URL }
+	wh.deliver(LoadPrinter(PrinterSettings{ UniqueName: "mk3" }), testWebhookEvent())
+
+	if reqs := received(); len(reqs) != WEBHOOK_RETRIES {
+		t.Errorf("Got %d requests, want %d", len(reqs), WEBHOOK_RETRIES)
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	all := Webhook{}
+	some := Webhook{ Events: []string{ EVENT_CONNECTED } }
+
+	if !all.matches(EVENT_DISCONNECTED) || !some.matches(EVENT_CONNECTED) || some.matches(EVENT_DISCONNECTED) {
+		t.Error("Event filter mismatch")
+	}
+}
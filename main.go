@@ -3,6 +3,7 @@ package main
 //go:generate $GOPATH/bin/go-bindata -pkg $GOPACKAGE -o assets.go -prefix web/dist web/dist/...
 
 import (
+	"encoding/json"
 	"net/http"
 	"log"
 	"flag"
@@ -17,20 +18,32 @@ var wsUpgrader = websocket.Upgrader{}
 
 func main() {
 	flag.Parse()
+	setupLogging()
 
 	loadConfig()
+	if ensureAdminUser() {
+		saveConfig()
+	}
+	startMqtt()
 
 	router := mux.NewRouter()
-	router.HandleFunc("/websocket", handleWebsocket)
+	router.HandleFunc("/healthz", handleHealthz).Methods("GET")
+	router.HandleFunc("/readyz", handleReadyz).Methods("GET")
+	router.HandleFunc("/websocket", requireRole(ROLE_VIEWER, handleWebsocket))
+	router.HandleFunc("/metrics", requireRole(ROLE_VIEWER, metricsHandler().ServeHTTP))
 
 	SetupRouteApiV1(router.PathPrefix("/api/v1").Subrouter())
 
+	if octoPrintSettings.Enabled {
+		SetupRouteOctoPrint(router.PathPrefix("/api").Subrouter())
+	}
+	if moonrakerSettings.Enabled {
+		SetupRouteMoonraker(router)
+	}
+
 	router.PathPrefix("/").HandlerFunc(serveStatic)
 
-	err := http.ListenAndServe(*httpAddr, router);
-	if err != nil {
-		log.Fatal("HTTP error: ", err)
-	}
+	runServer(router)
 }
 
 func handleWebsocket(w http.ResponseWriter, r *http.Request) {
@@ -41,6 +54,12 @@ func handleWebsocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	defer c.Close()
+
+	moonraker := newMoonrakerClient(c, r)
+	defer moonraker.close()
+
+	user := currentUser(r)
+
 	for {
 		mt, message, err := c.ReadMessage()
 
@@ -50,7 +69,17 @@ func handleWebsocket(w http.ResponseWriter, r *http.Request) {
 		}
 
 		_ = mt;
-		_ = message;
+
+		// Macros called from the terminal, anything else is for Moonraker clients
+		var macro MacroRequest
+		if json.Unmarshal(message, &macro) == nil && (macro.Macro != "" || macro.Abort) {
+			moonraker.write(handleMacroRequest(macro, user, remoteAddr(r)))
+			continue
+		}
+
+		if moonrakerSettings.Enabled {
+			moonraker.receive(message)
+		}
 		// err = c.WriteMessage...
 	}
 }
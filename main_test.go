@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Keep files written by tests, also by saves still running when a test ends,
+// out of the data directory of the user running them
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "dashprint-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	dataDirOverride = dir
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}